@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Administrative actions recorded in admin_audit
+const (
+	AdminActionUnblock         = "unblock"
+	AdminActionBan             = "ban"
+	AdminActionAllowListChange = "allowlist-change"
+	AdminActionConfigLoad      = "config-load"
+	AdminActionGeoIPReload     = "geoip-reload"
+	AdminActionIntelReload     = "intel-reload"
+)
+
+// systemActor is the actor of the actions autowaf takes by itself
+const systemActor = "autowaf"
+
+// the most entries /admin/audit returns at once
+const maxAdminAuditLimit = 1000
+
+// AdminAuditEntry is an administrative action in admin_audit
+type AdminAuditEntry struct {
+	ID       int       `json:"id"`
+	Ts       time.Time `json:"ts"`
+	Action   string    `json:"action"`
+	Actor    string    `json:"actor"`
+	SourceIP string    `json:"source_ip"`
+	Payload  string    `json:"payload"`
+	Outcome  string    `json:"outcome"`
+}
+
+// requestSourceIP returns the IP the request came from. That's the address the connection
+// came from, unless it's one of TRUSTED_PROXIES. Then it's the right-most X-Forwarded-For hop
+// that isn't a trusted proxy, which is the address the first trusted proxy saw. Hops to the
+// left of it are whatever the client sent.
+func requestSourceIP(r *http.Request) string {
+	source, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		source = r.RemoteAddr
+	}
+	if !trustedProxy(source) {
+		return source
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		source = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return source
+}
+
+// trustedProxy is true when ip is in TRUSTED_PROXIES
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range envConfig.TrustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordAdminAction appends an administrative action to admin_audit. A failure to record
+// it is logged, it doesn't fail the action.
+func RecordAdminAction(r *http.Request, action string, actor string, payload []byte, outcome string) {
+	if db == nil {
+		return
+	}
+	entry := AdminAuditEntry{
+		Ts:       time.Now().UTC(),
+		Action:   action,
+		Actor:    actor,
+		SourceIP: requestSourceIP(r),
+		Payload:  string(payload),
+		Outcome:  outcome,
+	}
+	InsertAdminAudit(db, &entry)
+}
+
+// RecordSystemAction appends something autowaf did by itself that changes what it blocks, such
+// as reloading a GeoIP database, to admin_audit with payload as JSON
+func RecordSystemAction(action string, payload interface{}, outcome string) {
+	if db == nil {
+		return
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Str("Action", action).Msg("Error encoding admin audit payload")
+	}
+	entry := AdminAuditEntry{
+		Ts:      time.Now().UTC(),
+		Action:  action,
+		Actor:   systemActor,
+		Payload: string(encoded),
+		Outcome: outcome,
+	}
+	InsertAdminAudit(db, &entry)
+}
+
+// configLoad is the payload of a config-load entry
+type configLoad struct {
+	AllowList  []string    `json:"allowlist"`
+	Policies   []BanPolicy `json:"policies"`
+	IntelFeeds []string    `json:"intel_feeds"`
+}
+
+// RecordConfigLoad records the configuration autowaf started with. The configuration only
+// changes with a restart, so an ALLOWLIST that differs from the last one recorded is also
+// recorded as an allowlist change.
+func RecordConfigLoad(env *EnvConfig) {
+	if db == nil {
+		return
+	}
+	loaded := configLoad{AllowList: []string{}, Policies: env.BanPolicies(), IntelFeeds: []string{}}
+	for _, network := range env.AllowList {
+		loaded.AllowList = append(loaded.AllowList, network.String())
+	}
+	for _, feed := range env.IntelFeeds {
+		loaded.IntelFeeds = append(loaded.IntelFeeds, feed.Name)
+	}
+	previous, err := GetAdminAudit(db, time.Time{}, time.Time{}, AdminActionConfigLoad, 1)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error reading the last configuration from admin audit")
+	} else if len(previous) > 0 {
+		var last configLoad
+		if err := json.Unmarshal([]byte(previous[0].Payload), &last); err == nil {
+			lastPtrs := make([]*string, len(last.AllowList))
+			for i := range last.AllowList {
+				lastPtrs[i] = &last.AllowList[i]
+			}
+			loadedPtrs := make([]*string, len(loaded.AllowList))
+			for i := range loaded.AllowList {
+				loadedPtrs[i] = &loaded.AllowList[i]
+			}
+			added, removed := DiffAddresses(lastPtrs, loadedPtrs)
+			if len(added) > 0 || len(removed) > 0 {
+				RecordSystemAction(AdminActionAllowListChange, map[string][]string{"added": added, "removed": removed}, "success")
+			}
+		}
+	}
+	RecordSystemAction(AdminActionConfigLoad, loaded, "success")
+}
+
+// adminAuditWriter returns admin_audit entries, newest first. The optional query parameters
+// are from and to (RFC3339), action and limit.
+func adminAuditWriter(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	query := r.URL.Query()
+	var from, to time.Time
+	var err error
+	if value := query.Get("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode("from must be an RFC3339 time")
+			return
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode("to must be an RFC3339 time")
+			return
+		}
+	}
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxAdminAuditLimit {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode("limit must be between 1 and " + strconv.Itoa(maxAdminAuditLimit))
+			return
+		}
+	}
+	entries, err := GetAdminAudit(db, from, to, query.Get("action"), limit)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error reading admin audit")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+}
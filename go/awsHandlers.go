@@ -2,8 +2,8 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"net"
+	"sort"
 
 	"github.com/rs/zerolog/log"
 
@@ -64,6 +64,46 @@ func UpdateIPSet(iplist []*string, updater IPSetUpdater, ipset *wafv2.IPSetSumma
 	return nil
 }
 
+// GetIPSetAddresses returns the addresses currently in ipset
+func GetIPSetAddresses(ipSetGetter IPSetGetter, ipset *wafv2.IPSetSummary) ([]*string, error) {
+	scope := "REGIONAL"
+	gipInput := wafv2.GetIPSetInput{
+		Id:    ipset.Id,
+		Name:  ipset.Name,
+		Scope: &scope,
+	}
+	ipsetOutput, err := ipSetGetter(&gipInput)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error getting full IP set")
+		return nil, err
+	}
+	return ipsetOutput.IPSet.Addresses, nil
+}
+
+// DiffAddresses returns the addresses in desired that aren't in current (added)
+// and the addresses in current that aren't in desired (removed), both sorted
+func DiffAddresses(current, desired []*string) (added, removed []string) {
+	currentSet := make(map[string]bool, len(current))
+	for _, addr := range current {
+		currentSet[*addr] = true
+	}
+	desiredSet := make(map[string]bool, len(desired))
+	for _, addr := range desired {
+		desiredSet[*addr] = true
+		if !currentSet[*addr] {
+			added = append(added, *addr)
+		}
+	}
+	for _, addr := range current {
+		if !desiredSet[*addr] {
+			removed = append(removed, *addr)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
 // RemoveIPfromIPSet will pull the current IP set, remove ip from it and update that ipset
 func RemoveIPfromIPSet(ipSetLister IPSetLister, ipSetGetter IPSetGetter,
 	ipIPSetUpdater IPSetUpdater, envConfig *EnvConfig, ip *string) error {
@@ -98,7 +138,7 @@ func RemoveIPfromIPSet(ipSetLister IPSetLister, ipSetGetter IPSetGetter,
 	ipIndex := -1
 
 	for idx, currentIP := range ipsetOutput.IPSet.Addresses {
-		if *currentIP == fmt.Sprintf("%s/32", *ip) {
+		if *currentIP == hostCIDR(*ip) {
 			ipIndex = idx
 			break
 		}
@@ -173,3 +173,38 @@ func TestRemoveIPfromIPSetFailNoIP(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestGetIPSetAddresses(t *testing.T) {
+	tval := "test"
+	ipset := wafv2.IPSetSummary{Id: &tval, Name: &tval}
+	addresses, err := GetIPSetAddresses(MockIPSetGetter, &ipset)
+	if err != nil || len(addresses) != 2 {
+		t.Logf("Expected 2 addresses, got %d (err: %v)", len(addresses), err)
+		t.Fail()
+	}
+	_, err = GetIPSetAddresses(MockIPSetGetterFail, &ipset)
+	if err == nil {
+		t.Log("Nil error (shouldn't be)")
+		t.Fail()
+	}
+}
+
+func TestDiffAddresses(t *testing.T) {
+	ip1 := "192.168.1.1/32"
+	ip2 := "192.168.1.2/32"
+	ip3 := "192.168.1.3/32"
+	added, removed := DiffAddresses([]*string{&ip1, &ip2}, []*string{&ip3, &ip2})
+	if len(added) != 1 || added[0] != ip3 {
+		t.Logf("Unexpected added addresses: %v", added)
+		t.Fail()
+	}
+	if len(removed) != 1 || removed[0] != ip1 {
+		t.Logf("Unexpected removed addresses: %v", removed)
+		t.Fail()
+	}
+	added, removed = DiffAddresses([]*string{&ip1}, []*string{&ip1})
+	if len(added) != 0 || len(removed) != 0 {
+		t.Log("Identical lists shouldn't have a diff")
+		t.Fail()
+	}
+}
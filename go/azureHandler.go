@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Azure WAF policy types
+const (
+	AzureAppGateway = "appgateway"
+	AzureFrontDoor  = "frontdoor"
+)
+
+// ErrAzurePolicyChanged is returned when the policy kept changing under an update
+var ErrAzurePolicyChanged = errors.New("Azure WAF policy changed while it was being updated")
+
+// ErrAzureForeignRule is returned when a rule the sink doesn't manage is in its priority range or
+// has a name with its prefix
+var ErrAzureForeignRule = errors.New("Azure WAF policy has a rule autowaf doesn't manage in autowaf's priority range or with its name prefix")
+
+// how many times an update is retried when the policy's etag changed under it
+const azureUpdateAttempts = 3
+
+// AzureSink keeps custom block rules in an Azure Application Gateway or Front Door WAF policy.
+// The blocklist is split across as many rules as the per rule IP limit needs. Custom rules have
+// no description, so the sink's rules are the ones exactly as buildRules makes them: named with
+// the prefix and their index, at the priority for that index, blocking on RemoteAddr.
+type AzureSink struct {
+	client       *http.Client
+	loginURL     string
+	mgmtURL      string
+	tenantID     string
+	clientID     string
+	clientSecret string
+	policyPath   string
+	apiVersion   string
+	wafType      string
+	rulePrefix   string
+	priority     int
+	ipsPerRule   int
+	maxRules     int
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewAzureSink makes the sink for the policy in envconf
+func NewAzureSink(envconf *EnvConfig) *AzureSink {
+	provider := "ApplicationGatewayWebApplicationFirewallPolicies"
+	if envconf.AzureWAFType == AzureFrontDoor {
+		provider = "FrontDoorWebApplicationFirewallPolicies"
+	}
+	return &AzureSink{
+		client:       &http.Client{Timeout: 60 * time.Second},
+		loginURL:     strings.TrimRight(envconf.AzureLoginURL, "/"),
+		mgmtURL:      strings.TrimRight(envconf.AzureManagementURL, "/"),
+		tenantID:     envconf.AzureTenantID,
+		clientID:     envconf.AzureClientID,
+		clientSecret: envconf.AzureClientSecret,
+		policyPath: fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/%s/%s",
+			url.PathEscape(envconf.AzureSubscriptionID), url.PathEscape(envconf.AzureResourceGroup), provider,
+			url.PathEscape(envconf.AzurePolicyName)),
+		apiVersion: envconf.AzureAPIVersion,
+		wafType:    envconf.AzureWAFType,
+		rulePrefix: envconf.AzureRulePrefix,
+		priority:   envconf.AzureRulePriority,
+		ipsPerRule: envconf.AzureIPsPerRule,
+		maxRules:   envconf.AzureMaxRules,
+	}
+}
+
+// Name is azure
+func (a *AzureSink) Name() string {
+	return "azure"
+}
+
+// accessToken returns a token from the client credentials, reusing it until shortly before it expires
+func (a *AzureSink) accessToken() (string, error) {
+	if a.token != "" && time.Now().Before(a.tokenExpiry) {
+		return a.token, nil
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {a.clientID},
+		"client_secret": {a.clientSecret},
+		"scope":         {a.mgmtURL + "/.default"},
+	}
+	resp, err := a.client.PostForm(fmt.Sprintf("%s/%s/oauth2/v2.0/token", a.loginURL, url.PathEscape(a.tenantID)), form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1048576)).Decode(&token); err != nil {
+		return "", fmt.Errorf("Azure token endpoint returned %d with a body that isn't JSON", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return "", fmt.Errorf("Azure token endpoint returned %d: %s %s", resp.StatusCode, token.Error, token.ErrorDescription)
+	}
+	a.token = token.AccessToken
+	a.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn-60) * time.Second)
+	return a.token, nil
+}
+
+// call makes a request to the management API, returning the status, the body and the etag
+func (a *AzureSink) call(method string, body interface{}, etag string) (int, []byte, error) {
+	token, err := a.accessToken()
+	if err != nil {
+		return 0, nil, err
+	}
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, a.mgmtURL+a.policyPath+"?api-version="+url.QueryEscape(a.apiVersion), reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16*1048576))
+	return resp.StatusCode, data, err
+}
+
+// customRules returns the policy's custom rules, which Front Door nests one level deeper
+func (a *AzureSink) customRules(policy map[string]interface{}) []interface{} {
+	properties, _ := policy["properties"].(map[string]interface{})
+	if a.wafType == AzureFrontDoor {
+		customRules, _ := properties["customRules"].(map[string]interface{})
+		rules, _ := customRules["rules"].([]interface{})
+		return rules
+	}
+	rules, _ := properties["customRules"].([]interface{})
+	return rules
+}
+
+// setCustomRules replaces the policy's custom rules
+func (a *AzureSink) setCustomRules(policy map[string]interface{}, rules []interface{}) {
+	properties, ok := policy["properties"].(map[string]interface{})
+	if !ok {
+		properties = map[string]interface{}{}
+		policy["properties"] = properties
+	}
+	if a.wafType == AzureFrontDoor {
+		customRules, ok := properties["customRules"].(map[string]interface{})
+		if !ok {
+			customRules = map[string]interface{}{}
+			properties["customRules"] = customRules
+		}
+		customRules["rules"] = rules
+		return
+	}
+	properties["customRules"] = rules
+}
+
+// ruleIndex returns where the rule's priority is in the sink's range, and whether it's in it
+func (a *AzureSink) ruleIndex(rule interface{}) (int, bool) {
+	fields, _ := rule.(map[string]interface{})
+	priority, ok := fields["priority"].(float64)
+	index := int(priority) - a.priority
+	return index, ok && index >= 0 && index < a.maxRules
+}
+
+// isOurRule is true for the rules the sink manages
+func (a *AzureSink) isOurRule(rule interface{}) bool {
+	index, ok := a.ruleIndex(rule)
+	if !ok {
+		return false
+	}
+	fields, _ := rule.(map[string]interface{})
+	conditions, _ := fields["matchConditions"].([]interface{})
+	if fields["name"] != fmt.Sprintf("%s%d", a.rulePrefix, index) || fields["ruleType"] != "MatchRule" ||
+		fields["action"] != "Block" || len(conditions) != 1 {
+		return false
+	}
+	condition, _ := conditions[0].(map[string]interface{})
+	if condition["operator"] != "IPMatch" {
+		return false
+	}
+	if a.wafType == AzureFrontDoor {
+		return condition["matchVariable"] == "RemoteAddr"
+	}
+	variables, _ := condition["matchVariables"].([]interface{})
+	if len(variables) != 1 {
+		return false
+	}
+	variable, _ := variables[0].(map[string]interface{})
+	return variable["variableName"] == "RemoteAddr"
+}
+
+// checkRules returns ErrAzureForeignRule when a rule in the sink's priority range or with its
+// name prefix isn't one of its own, so it's never overwritten or deleted
+func (a *AzureSink) checkRules(rules []interface{}) error {
+	for _, rule := range rules {
+		fields, _ := rule.(map[string]interface{})
+		name, _ := fields["name"].(string)
+		_, inRange := a.ruleIndex(rule)
+		if (inRange || strings.HasPrefix(name, a.rulePrefix)) && !a.isOurRule(rule) {
+			log.Warn().Str("Sink", a.Name()).Str("Rule", name).Msg("Not changing a rule autowaf doesn't manage")
+			return ErrAzureForeignRule
+		}
+	}
+	return nil
+}
+
+// ruleCIDRs returns the addresses blocked by the sink's rules
+func (a *AzureSink) ruleCIDRs(rules []interface{}) []string {
+	cidrs := []string{}
+	for _, rule := range rules {
+		if !a.isOurRule(rule) {
+			continue
+		}
+		fields, _ := rule.(map[string]interface{})
+		conditions, _ := fields["matchConditions"].([]interface{})
+		for _, condition := range conditions {
+			conditionFields, _ := condition.(map[string]interface{})
+			key := "matchValues"
+			if a.wafType == AzureFrontDoor {
+				key = "matchValue"
+			}
+			values, _ := conditionFields[key].([]interface{})
+			for _, value := range values {
+				if cidr, ok := value.(string); ok {
+					cidrs = append(cidrs, cidr)
+				}
+			}
+		}
+	}
+	sort.Strings(cidrs)
+	return cidrs
+}
+
+// buildRules splits cidrs into block rules of at most ipsPerRule addresses
+func (a *AzureSink) buildRules(cidrs []string) ([]interface{}, error) {
+	rules := []interface{}{}
+	for start := 0; start < len(cidrs); start += a.ipsPerRule {
+		end := start + a.ipsPerRule
+		if end > len(cidrs) {
+			end = len(cidrs)
+		}
+		values := cidrs[start:end]
+		index := len(rules)
+		var rule map[string]interface{}
+		if a.wafType == AzureFrontDoor {
+			rule = map[string]interface{}{
+				"name":         fmt.Sprintf("%s%d", a.rulePrefix, index),
+				"priority":     a.priority + index,
+				"enabledState": "Enabled",
+				"ruleType":     "MatchRule",
+				"action":       "Block",
+				"matchConditions": []interface{}{map[string]interface{}{
+					"matchVariable": "RemoteAddr",
+					"operator":      "IPMatch",
+					"matchValue":    values,
+				}},
+			}
+		} else {
+			rule = map[string]interface{}{
+				"name":     fmt.Sprintf("%s%d", a.rulePrefix, index),
+				"priority": a.priority + index,
+				"state":    "Enabled",
+				"ruleType": "MatchRule",
+				"action":   "Block",
+				"matchConditions": []interface{}{map[string]interface{}{
+					"matchVariables": []interface{}{map[string]interface{}{"variableName": "RemoteAddr"}},
+					"operator":       "IPMatch",
+					"matchValues":    values,
+				}},
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) > a.maxRules {
+		return nil, fmt.Errorf("%d IPs need %d rules, more than the %d allowed", len(cidrs), len(rules), a.maxRules)
+	}
+	return rules, nil
+}
+
+// update reads the policy, lets change work out the new addresses from the current ones and
+// writes the policy back if they're different. The etag makes the write fail if the policy
+// changed since it was read, in which case it starts again. change returning nil leaves the
+// policy as it is.
+func (a *AzureSink) update(change func(current []string) []string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for attempt := 0; attempt < azureUpdateAttempts; attempt++ {
+		status, body, err := a.call("GET", nil, "")
+		if err != nil {
+			return false, err
+		}
+		if status != http.StatusOK {
+			return false, fmt.Errorf("Azure returned %d getting the WAF policy: %s", status, strings.TrimSpace(string(body)))
+		}
+		var policy map[string]interface{}
+		if err := json.Unmarshal(body, &policy); err != nil {
+			return false, err
+		}
+		rules := a.customRules(policy)
+		if err := a.checkRules(rules); err != nil {
+			return false, err
+		}
+		current := a.ruleCIDRs(rules)
+		desired := change(current)
+		if desired == nil || strings.Join(desired, ",") == strings.Join(current, ",") {
+			return false, nil
+		}
+		ours, err := a.buildRules(desired)
+		if err != nil {
+			return false, err
+		}
+		kept := []interface{}{}
+		for _, rule := range rules {
+			if !a.isOurRule(rule) {
+				kept = append(kept, rule)
+			}
+		}
+		a.setCustomRules(policy, append(kept, ours...))
+		etag, _ := policy["etag"].(string)
+		status, body, err = a.call("PUT", policy, etag)
+		if err != nil {
+			return false, err
+		}
+		if status == http.StatusPreconditionFailed {
+			log.Warn().Str("Sink", a.Name()).Msg("Azure WAF policy changed while updating it, retrying")
+			continue
+		}
+		if status != http.StatusOK && status != http.StatusCreated && status != http.StatusAccepted {
+			return false, fmt.Errorf("Azure returned %d updating the WAF policy: %s", status, strings.TrimSpace(string(body)))
+		}
+		return true, nil
+	}
+	return false, ErrAzurePolicyChanged
+}
+
+// Sync makes the sink's rules block exactly entries
+func (a *AzureSink) Sync(entries []BanEntry, dryRun bool) error {
+	return syncRules(a, "Azure WAF policy", a.update, entries, dryRun)
+}
+
+// Remove takes ip out of the sink's rules
+func (a *AzureSink) Remove(ip string) error {
+	return removeFromRules(a.update, ip)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// FakeAzure is enough of the Azure login and management APIs for the sink
+type FakeAzure struct {
+	mu     sync.Mutex
+	policy map[string]interface{}
+	etag   int
+	// conflicts is how many PUTs get a 412 before one succeeds
+	conflicts int
+	tokens    int
+	puts      int
+}
+
+func (f *FakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/tenant/oauth2/v2.0/token" {
+		r.ParseForm()
+		if r.PostForm.Get("grant_type") != "client_credentials" || r.PostForm.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client", "error_description": "bad secret"})
+			return
+		}
+		f.tokens++
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token", "expires_in": 3600})
+		return
+	}
+	if r.URL.Path != "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/ApplicationGatewayWebApplicationFirewallPolicies/policy" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		f.policy["etag"] = fmt.Sprintf("W/\"%d\"", f.etag)
+		json.NewEncoder(w).Encode(f.policy)
+	case "PUT":
+		if f.conflicts > 0 || r.Header.Get("If-Match") != fmt.Sprintf("W/\"%d\"", f.etag) {
+			f.conflicts--
+			// someone else changed the policy
+			f.etag++
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		var policy map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&policy)
+		f.policy = policy
+		f.etag++
+		f.puts++
+		json.NewEncoder(w).Encode(policy)
+	}
+}
+
+func newTestAzureSink(t *testing.T) (*AzureSink, *FakeAzure) {
+	fake := &FakeAzure{policy: map[string]interface{}{
+		"name":     "policy",
+		"location": "westeurope",
+		"properties": map[string]interface{}{
+			"customRules":    []interface{}{map[string]interface{}{"name": "allowOffice", "priority": 1}},
+			"policySettings": map[string]interface{}{"mode": "Prevention"},
+		},
+	}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	sink := NewAzureSink(&EnvConfig{
+		AzureWAFType:        AzureAppGateway,
+		AzureTenantID:       "tenant",
+		AzureClientID:       "client",
+		AzureClientSecret:   "secret",
+		AzureSubscriptionID: "sub",
+		AzureResourceGroup:  "rg",
+		AzurePolicyName:     "policy",
+		AzureAPIVersion:     "2022-05-01",
+		AzureLoginURL:       server.URL,
+		AzureManagementURL:  server.URL,
+		AzureRulePrefix:     "autowaf",
+		AzureRulePriority:   10,
+		AzureIPsPerRule:     2,
+		AzureMaxRules:       3,
+	})
+	return sink, fake
+}
+
+func TestAzureSync(t *testing.T) {
+	sink, fake := newTestAzureSink(t)
+	entries := []BanEntry{
+		NewBanEntry("192.168.1.1", time.Time{}),
+		NewBanEntry("192.168.1.2", time.Time{}),
+		NewBanEntry("2001:db8::1", time.Time{}),
+	}
+	if err := sink.Sync(entries, false); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	rules := sink.customRules(fake.policy)
+	// the existing rule is kept and the 3 IPs are split over 2 rules
+	if len(rules) != 3 || rules[0].(map[string]interface{})["name"] != "allowOffice" {
+		t.Logf("Unexpected rules: %v", rules)
+		t.FailNow()
+	}
+	second := rules[2].(map[string]interface{})
+	if second["name"] != "autowaf1" || second["priority"] != float64(11) {
+		t.Logf("Unexpected rule: %v", second)
+		t.Fail()
+	}
+	cidrs := sink.ruleCIDRs(rules)
+	if strings.Join(cidrs, ",") != "192.168.1.1/32,192.168.1.2/32,2001:db8::1/128" {
+		t.Logf("Unexpected CIDRs: %v", cidrs)
+		t.Fail()
+	}
+	// other settings survive the round trip
+	settings := fake.policy["properties"].(map[string]interface{})["policySettings"].(map[string]interface{})
+	if settings["mode"] != "Prevention" {
+		t.Logf("Lost the policy settings: %v", fake.policy)
+		t.Fail()
+	}
+	// nothing changed, so the policy isn't written again, and the token is reused
+	if err := sink.Sync(entries, false); err != nil || fake.puts != 1 || fake.tokens != 1 {
+		t.Logf("Expected 1 PUT and 1 token, got %d and %d (err: %v)", fake.puts, fake.tokens, err)
+		t.Fail()
+	}
+	// a dry run doesn't change the policy
+	if err := sink.Sync(entries[:1], true); err != nil || fake.puts != 1 {
+		t.Logf("A dry run shouldn't change the policy (err: %v)", err)
+		t.Fail()
+	}
+	// too many IPs for the rules allowed
+	for i := 3; i < 8; i++ {
+		entries = append(entries, NewBanEntry(fmt.Sprintf("192.168.1.%d", i), time.Time{}))
+	}
+	if err := sink.Sync(entries, false); err == nil || fake.puts != 1 {
+		t.Logf("Expected an error for too many rules (err: %v)", err)
+		t.Fail()
+	}
+}
+
+func TestAzureConflict(t *testing.T) {
+	sink, fake := newTestAzureSink(t)
+	fake.conflicts = 1
+	if err := sink.Sync([]BanEntry{NewBanEntry("192.168.1.1", time.Time{})}, false); err != nil || fake.puts != 1 {
+		t.Logf("Expected the update to be retried (err: %v)", err)
+		t.Fail()
+	}
+	fake.conflicts = azureUpdateAttempts
+	if err := sink.Sync([]BanEntry{}, false); err != ErrAzurePolicyChanged {
+		t.Logf("Expected ErrAzurePolicyChanged, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestAzureForeignRule(t *testing.T) {
+	for name, rule := range map[string]map[string]interface{}{
+		"in the priority range": {"name": "allowPartner", "priority": float64(11), "action": "Allow"},
+		"with the name prefix":  {"name": "autowafAllow", "priority": float64(100), "action": "Allow"},
+		"allowing an autowaf name": {"name": "autowaf0", "priority": float64(10), "ruleType": "MatchRule", "action": "Allow",
+			"matchConditions": []interface{}{map[string]interface{}{
+				"matchVariables": []interface{}{map[string]interface{}{"variableName": "RemoteAddr"}},
+				"operator":       "IPMatch",
+				"matchValues":    []interface{}{"192.168.1.9/32"},
+			}}},
+	} {
+		sink, fake := newTestAzureSink(t)
+		properties := fake.policy["properties"].(map[string]interface{})
+		properties["customRules"] = append(properties["customRules"].([]interface{}), rule)
+		if err := sink.Sync([]BanEntry{NewBanEntry("192.168.1.1", time.Time{})}, false); err != ErrAzureForeignRule || fake.puts != 0 {
+			t.Logf("%s: expected ErrAzureForeignRule and no PUT, got %v and %d", name, err, fake.puts)
+			t.Fail()
+		}
+	}
+}
+
+func TestAzureRemove(t *testing.T) {
+	sink, fake := newTestAzureSink(t)
+	sink.Sync([]BanEntry{NewBanEntry("192.168.1.1", time.Time{}), NewBanEntry("192.168.1.2", time.Time{})}, false)
+	if err := sink.Remove("192.168.1.1"); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.Fail()
+	}
+	if cidrs := sink.ruleCIDRs(sink.customRules(fake.policy)); len(cidrs) != 1 || cidrs[0] != "192.168.1.2/32" {
+		t.Logf("Unexpected CIDRs: %v", cidrs)
+		t.Fail()
+	}
+	if err := sink.Remove("192.168.1.1"); err != ErrIPNotFound {
+		t.Logf("Expected ErrIPNotFound, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestAzureBadSecret(t *testing.T) {
+	sink, _ := newTestAzureSink(t)
+	sink.clientSecret = "wrong"
+	err := sink.Sync([]BanEntry{}, false)
+	if err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Logf("Expected the token error, got %v", err)
+		t.Fail()
+	}
+}
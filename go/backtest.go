@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// BacktestReport is what a set of policies would have done to a series of events
+type BacktestReport struct {
+	// Source is "simulated" for a replay and "history" for the bans autowaf actually made
+	Source string `json:"source"`
+	Events int    `json:"events"`
+	// Bans is the number of times an IP went onto the blocklist
+	Bans        int            `json:"bans"`
+	BansByTable map[string]int `json:"bans_by_table"`
+	BannedIPs   []string       `json:"banned_ips"`
+	// TotalBanTime is the time all the IPs spent on the blocklist, added up
+	TotalBanTime  time.Duration `json:"total_ban_time"`
+	LongestBan    time.Duration `json:"longest_ban"`
+	PeakBlocklist int           `json:"peak_blocklist"`
+	PeakAt        time.Time     `json:"peak_at"`
+	// UnblockedIPs are the banned IPs with failures an admin has since unblocked
+	UnblockedIPs []string `json:"unblocked_ips"`
+}
+
+// BanRecord is a ban autowaf made, as kept in ban_history
+type BanRecord struct {
+	IP    string    `json:"ip"`
+	Table string    `json:"table"`
+	Ts    time.Time `json:"ts"`
+}
+
+// AverageBan is the average time an IP spent on the blocklist
+func (r *BacktestReport) AverageBan() time.Duration {
+	if r.Bans == 0 {
+		return 0
+	}
+	return r.TotalBanTime / time.Duration(r.Bans)
+}
+
+// BanHistoryReport summarises the bans autowaf actually made. Only the ban counts and IPs
+// are known, the times IPs spent on the blocklist are left at zero.
+func BanHistoryReport(bans []BanRecord) *BacktestReport {
+	report := &BacktestReport{Source: "history", BansByTable: map[string]int{}, BannedIPs: []string{}, UnblockedIPs: []string{}}
+	banned := map[string]bool{}
+	for _, ban := range bans {
+		report.Bans++
+		report.BansByTable[ban.Table]++
+		if !banned[ban.IP] {
+			banned[ban.IP] = true
+			report.BannedIPs = append(report.BannedIPs, ban.IP)
+		}
+	}
+	sort.Strings(report.BannedIPs)
+	return report
+}
+
+// BacktestOverlap compares the IPs banned in two backtests
+type BacktestOverlap struct {
+	Both          int `json:"both"`
+	OnlyCandidate int `json:"only_candidate"`
+	OnlyBaseline  int `json:"only_baseline"`
+}
+
+// banExpiry is an entry in the queue of blocklist expiries
+type banExpiry struct {
+	until time.Time
+	ip    string
+}
+
+type expiryQueue []banExpiry
+
+func (q expiryQueue) Len() int            { return len(q) }
+func (q expiryQueue) Less(i, j int) bool  { return q[i].until.Before(q[j].until) }
+func (q expiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(banExpiry)) }
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// Backtest replays events through policies in simulated time. It mirrors CheckAndInsert:
+// every event adds up the stored weights of the IP's failures a policy matches over its period and bans
+// (or extends the ban of) the IP for the period when the score reaches the limit. Bans
+// expire exactly on time rather than on the next run of the WAF update task. Failures an
+// admin has since unblocked are replayed, and their IPs are listed in UnblockedIPs if banned.
+func Backtest(events []NewFailure, policies []BanPolicy) *BacktestReport {
+	sorted := make([]NewFailure, len(events))
+	copy(sorted, events)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Ts.Before(sorted[j].Ts) })
+
+	report := &BacktestReport{Source: "simulated", Events: len(sorted), BansByTable: map[string]int{},
+		BannedIPs: []string{}, UnblockedIPs: []string{}}
+	// history[p][ip] holds the times of the IP's failures policy p matches, and scores[p][ip] the
+	// running total of their weights, scores[p][ip][i] is the total before history[p][ip][i]
+	history := make([]map[string][]time.Time, len(policies))
+	scores := make([]map[string][]float64, len(policies))
+	for i := range policies {
+		history[i] = map[string][]time.Time{}
+		scores[i] = map[string][]float64{}
+	}
+	tableUntil := map[string]map[string]time.Time{}
+	blockedUntil := map[string]time.Time{}
+	blockedSince := map[string]time.Time{}
+	banned := map[string]bool{}
+	unblocked := map[string]bool{}
+	expiries := &expiryQueue{}
+	size := 0
+
+	// takes IPs whose ban ran out by t off the blocklist
+	expire := func(t time.Time, all bool) {
+		for expiries.Len() > 0 && (all || !(*expiries)[0].until.After(t)) {
+			entry := heap.Pop(expiries).(banExpiry)
+			if !blockedUntil[entry.ip].Equal(entry.until) {
+				// the ban was extended after this entry was queued
+				continue
+			}
+			duration := entry.until.Sub(blockedSince[entry.ip])
+			report.TotalBanTime += duration
+			if duration > report.LongestBan {
+				report.LongestBan = duration
+			}
+			size--
+		}
+	}
+
+	for _, event := range sorted {
+		if event.ReasonIgnored {
+			continue
+		}
+		if event.Unblocked {
+			unblocked[event.IP] = true
+		}
+		t := event.Ts
+		expire(t, false)
+		for i := range policies {
+			policy := &policies[i]
+			// only per IP failure counts are simulated
+			if policy.Shadow || (policy.Kind != "" && policy.Kind != KindFailures) || !policy.Matches(&event) {
+				continue
+			}
+			if scores[i][event.IP] == nil {
+				scores[i][event.IP] = []float64{0}
+			}
+			ipHistory := append(history[i][event.IP], t)
+			history[i][event.IP] = ipHistory
+			ipScores := append(scores[i][event.IP], scores[i][event.IP][len(scores[i][event.IP])-1]+event.Weight)
+			scores[i][event.IP] = ipScores
+			windowStart := t.Add(-time.Duration(policy.Period) * time.Hour)
+			first := sort.Search(len(ipHistory), func(i int) bool { return ipHistory[i].After(windowStart) })
+			if ipScores[len(ipHistory)]-ipScores[first] < float64(policy.LimitFor(&event)) {
+				continue
+			}
+			end := t.Add(time.Duration(policy.Period) * time.Hour)
+			if tableUntil[policy.Table] == nil {
+				tableUntil[policy.Table] = map[string]time.Time{}
+			}
+			if !tableUntil[policy.Table][event.IP].After(t) {
+				report.BansByTable[policy.Table]++
+			}
+			tableUntil[policy.Table][event.IP] = end
+			if !blockedUntil[event.IP].After(t) {
+				blockedSince[event.IP] = t
+				size++
+				report.Bans++
+				banned[event.IP] = true
+			}
+			if end.After(blockedUntil[event.IP]) {
+				blockedUntil[event.IP] = end
+				heap.Push(expiries, banExpiry{until: end, ip: event.IP})
+			}
+		}
+		if size > report.PeakBlocklist {
+			report.PeakBlocklist = size
+			report.PeakAt = t
+		}
+	}
+	expire(time.Time{}, true)
+
+	for ip := range banned {
+		report.BannedIPs = append(report.BannedIPs, ip)
+		if unblocked[ip] {
+			report.UnblockedIPs = append(report.UnblockedIPs, ip)
+		}
+	}
+	sort.Strings(report.BannedIPs)
+	sort.Strings(report.UnblockedIPs)
+	return report
+}
+
+// CompareBacktests counts the IPs banned by both reports and by only one of them
+func CompareBacktests(candidate, baseline *BacktestReport) BacktestOverlap {
+	overlap := BacktestOverlap{}
+	baselineSet := map[string]bool{}
+	for _, ip := range baseline.BannedIPs {
+		baselineSet[ip] = true
+	}
+	for _, ip := range candidate.BannedIPs {
+		if baselineSet[ip] {
+			overlap.Both++
+			delete(baselineSet, ip)
+		} else {
+			overlap.OnlyCandidate++
+		}
+	}
+	overlap.OnlyBaseline = len(baselineSet)
+	return overlap
+}
+
+// ReadEventsJSONL reads failures from a file with one /logonfailure style JSON object per line
+func ReadEventsJSONL(path string) ([]NewFailure, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	events := []NewFailure{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var record NewFailure
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil || record.IP == "" || record.Ts.IsZero() {
+			log.Warn().Int("Line", line).Msg("Skipping line that isn't a failure event")
+			continue
+		}
+		events = append(events, record)
+	}
+	return events, scanner.Err()
+}
+
+// runBacktest is the backtest subcommand
+func runBacktest(args []string) {
+	envConfig = GetEnvVars()
+	flags := flag.NewFlagSet("backtest", flag.ExitOnError)
+	jsonlPath := flags.String("jsonl", "", "read events from a JSONL file instead of logon_audit")
+	localDbg := flags.Bool("ldb", false, "read logon_audit from the local debug database")
+	from := flags.String("from", "", "only replay events at or after this RFC3339 time")
+	to := flags.String("to", "", "only replay events before this RFC3339 time")
+	shortLimit := flags.Int("short-limit", envConfig.ShortTermLimit, "candidate SHORT_LIMIT")
+	shortPeriod := flags.Int("short-period", envConfig.ShortTermPeriod, "candidate SHORT_PERIOD in hours")
+	longLimit := flags.Int("long-limit", envConfig.LongTermLimit, "candidate LONG_LIMIT")
+	longPeriod := flags.Int("long-period", envConfig.LongTermPeriod, "candidate LONG_PERIOD in hours")
+	jsonOutput := flags.Bool("json", false, "print the report as JSON")
+	flags.Parse(args)
+
+	var fromTs, toTs time.Time
+	var err error
+	if *from != "" {
+		if fromTs, err = time.Parse(time.RFC3339, *from); err != nil {
+			log.Fatal().Str("Error", err.Error()).Msg("Invalid -from time")
+		}
+	}
+	if *to != "" {
+		if toTs, err = time.Parse(time.RFC3339, *to); err != nil {
+			log.Fatal().Str("Error", err.Error()).Msg("Invalid -to time")
+		}
+	}
+
+	var events []NewFailure
+	var baseline *BacktestReport
+	if *jsonlPath != "" {
+		events, err = ReadEventsJSONL(*jsonlPath)
+		if err != nil {
+			log.Fatal().Str("Error", err.Error()).Msg("Couldn't read events")
+		}
+		events = filterEvents(events, fromTs, toTs)
+		// weighed and located as they would be if they came in now
+		lookup, err := NewGeoIP(envConfig.GeoIPCountryDB, envConfig.GeoIPASNDB)
+		if err != nil {
+			log.Fatal().Str("Error", err.Error()).Msg("Error opening GeoIP database")
+		}
+		for i := range events {
+			envConfig.ReasonWeights.Apply(&events[i])
+			lookup.Enrich(&events[i])
+		}
+		lookup.Close()
+	} else {
+		if *localDbg {
+			envConfig.DBPort = 54320
+		}
+		db = openDatabase(*localDbg)
+		events, err = GetAuditEvents(db, fromTs, toTs)
+		if err != nil {
+			log.Fatal().Str("Error", err.Error()).Msg("Couldn't read events from logon_audit")
+		}
+		// the baseline is the bans that were actually made
+		bans, err := GetBanHistory(db, fromTs, toTs)
+		if err != nil {
+			log.Fatal().Str("Error", err.Error()).Msg("Couldn't read ban_history")
+		}
+		baseline = BanHistoryReport(bans)
+		baseline.Events = len(events)
+	}
+
+	if baseline == nil {
+		// there's no history for events from a file, so the baseline is the running
+		// configuration replayed over them
+		baseline = Backtest(events, envConfig.BanPolicies())
+	}
+	// the candidate is the running configuration with the short and long term bans changed,
+	// so the scoped policies that made some of the real bans are replayed too
+	candidateConfig := envConfig
+	candidateConfig.ShortTermLimit, candidateConfig.ShortTermPeriod = *shortLimit, *shortPeriod
+	candidateConfig.LongTermLimit, candidateConfig.LongTermPeriod = *longLimit, *longPeriod
+	candidate := Backtest(events, candidateConfig.BanPolicies())
+	overlap := CompareBacktests(candidate, baseline)
+
+	if *jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"candidate": candidate,
+			"baseline":  baseline,
+			"overlap":   overlap,
+		})
+		return
+	}
+	fmt.Printf("Events replayed: %d\n\n", candidate.Events)
+	fmt.Printf("%-24s %12s %12s\n", "", "candidate", "baseline")
+	fmt.Printf("%-24s %12s %12s\n", "", candidate.Source, baseline.Source)
+	fmt.Printf("%-24s %12d %12d\n", "IPs banned", len(candidate.BannedIPs), len(baseline.BannedIPs))
+	fmt.Printf("%-24s %12d %12d\n", "Bans", candidate.Bans, baseline.Bans)
+	fmt.Printf("%-24s %12d %12d\n", "Short term bans", candidate.BansByTable["short_ban"], baseline.BansByTable["short_ban"])
+	fmt.Printf("%-24s %12d %12d\n", "Long term bans", candidate.BansByTable["long_ban"], baseline.BansByTable["long_ban"])
+	fmt.Printf("%-24s %12s %12s\n", "Average ban", candidate.AverageBan().Round(time.Minute), simulatedOnly(baseline, baseline.AverageBan().Round(time.Minute)))
+	fmt.Printf("%-24s %12s %12s\n", "Longest ban", candidate.LongestBan.Round(time.Minute), simulatedOnly(baseline, baseline.LongestBan.Round(time.Minute)))
+	fmt.Printf("%-24s %12d %12s\n", "Peak blocklist size", candidate.PeakBlocklist, simulatedOnly(baseline, baseline.PeakBlocklist))
+	fmt.Printf("\nIPs banned by both: %d, only by the candidate: %d, only by the baseline: %d\n",
+		overlap.Both, overlap.OnlyCandidate, overlap.OnlyBaseline)
+	if len(candidate.UnblockedIPs) > 0 {
+		fmt.Printf("IPs the candidate bans that an admin has unblocked: %d %v\n", len(candidate.UnblockedIPs), candidate.UnblockedIPs)
+	}
+}
+
+// simulatedOnly prints value for a simulated report and "-" for the ban history, which
+// doesn't record how long IPs stayed on the blocklist
+func simulatedOnly(report *BacktestReport, value interface{}) string {
+	if report.Source != "simulated" {
+		return "-"
+	}
+	return fmt.Sprint(value)
+}
+
+// filterEvents keeps the events in [from, to). Zero times aren't applied.
+func filterEvents(events []NewFailure, from, to time.Time) []NewFailure {
+	filtered := make([]NewFailure, 0, len(events))
+	for _, event := range events {
+		if !from.IsZero() && event.Ts.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !event.Ts.Before(to) {
+			continue
+		}
+		filtered = append(filtered, event)
+	}
+	return filtered
+}
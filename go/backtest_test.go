@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func failuresAt(ip string, start time.Time, count int, gap time.Duration) []NewFailure {
+	events := make([]NewFailure, count)
+	for i := range events {
+		events[i] = NewFailure{Ts: start.Add(time.Duration(i) * gap), IP: ip, Weight: 1}
+	}
+	return events
+}
+
+func TestBacktest(t *testing.T) {
+	start := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	events := failuresAt("192.168.1.1", start, 3, time.Minute)
+	events = append(events, failuresAt("192.168.1.2", start.Add(30*time.Minute), 3, time.Minute)...)
+	// not enough failures to be banned
+	events = append(events, failuresAt("192.168.1.3", start, 2, time.Minute)...)
+	policies := []BanPolicy{{Name: "short", Table: "short_ban", Period: 1, Limit: 3}}
+
+	report := Backtest(events, policies)
+	if report.Events != 8 || report.Bans != 2 || report.BansByTable["short_ban"] != 2 {
+		t.Logf("Unexpected report: %+v", report)
+		t.Fail()
+	}
+	if len(report.BannedIPs) != 2 || report.BannedIPs[0] != "192.168.1.1" || report.BannedIPs[1] != "192.168.1.2" {
+		t.Logf("Unexpected banned IPs: %v", report.BannedIPs)
+		t.Fail()
+	}
+	// both bans last an hour and overlap
+	if report.PeakBlocklist != 2 || report.LongestBan != time.Hour || report.AverageBan() != time.Hour {
+		t.Logf("Unexpected report: %+v", report)
+		t.Fail()
+	}
+}
+
+func TestBacktestBanExtension(t *testing.T) {
+	start := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	// a fourth failure 30 minutes into the ban refreshes it
+	events := failuresAt("192.168.1.1", start, 3, 0)
+	events = append(events, NewFailure{Ts: start.Add(30 * time.Minute), IP: "192.168.1.1", Weight: 1})
+	// and the IP comes back after the ban ran out
+	events = append(events, failuresAt("192.168.1.1", start.Add(5*time.Hour), 3, 0)...)
+	policies := []BanPolicy{
+		{Name: "short", Table: "short_ban", Period: 1, Limit: 3},
+		{Name: "shadow", Table: "short_ban", Period: 1, Limit: 1, Shadow: true},
+	}
+
+	report := Backtest(events, policies)
+	if report.Bans != 2 || report.PeakBlocklist != 1 {
+		t.Logf("Unexpected report: %+v", report)
+		t.Fail()
+	}
+	if report.LongestBan != 90*time.Minute || report.TotalBanTime != 150*time.Minute {
+		t.Logf("Unexpected ban times: longest %s, total %s", report.LongestBan, report.TotalBanTime)
+		t.Fail()
+	}
+}
+
+func TestBacktestReasonWeights(t *testing.T) {
+	start := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	weights, _ := ParseReasonWeights("MFA_FAILURE:3,USER_NOT_FOUND:0.5", 1, []string{"PASSWORD_EXPIRED"})
+	events := []NewFailure{
+		// one MFA failure is enough on its own
+		{Ts: start, IP: "192.168.1.1", Reason: "MFA_FAILURE"},
+		// four unknown users only score 2
+		{Ts: start, IP: "192.168.1.2", Reason: "USER_NOT_FOUND"},
+		{Ts: start, IP: "192.168.1.2", Reason: "USER_NOT_FOUND"},
+		{Ts: start, IP: "192.168.1.2", Reason: "USER_NOT_FOUND"},
+		{Ts: start, IP: "192.168.1.2", Reason: "USER_NOT_FOUND"},
+		// ignored reasons never count
+		{Ts: start, IP: "192.168.1.3", Reason: "PASSWORD_EXPIRED"},
+		{Ts: start, IP: "192.168.1.3", Reason: "PASSWORD_EXPIRED"},
+		{Ts: start, IP: "192.168.1.3", Reason: "PASSWORD_FAILURE"},
+		{Ts: start, IP: "192.168.1.3", Reason: "PASSWORD_FAILURE"},
+	}
+	for i := range events {
+		weights.Apply(&events[i])
+	}
+	policies := []BanPolicy{{Name: "short", Table: "short_ban", Period: 1, Limit: 3}}
+
+	report := Backtest(events, policies)
+	if len(report.BannedIPs) != 1 || report.BannedIPs[0] != "192.168.1.1" {
+		t.Logf("Unexpected banned IPs: %v", report.BannedIPs)
+		t.Fail()
+	}
+}
+
+func TestCompareBacktests(t *testing.T) {
+	candidate := &BacktestReport{BannedIPs: []string{"192.168.1.1", "192.168.1.2"}}
+	baseline := &BacktestReport{BannedIPs: []string{"192.168.1.2", "192.168.1.3", "192.168.1.4"}}
+	overlap := CompareBacktests(candidate, baseline)
+	if overlap.Both != 1 || overlap.OnlyCandidate != 1 || overlap.OnlyBaseline != 2 {
+		t.Logf("Unexpected overlap: %+v", overlap)
+		t.Fail()
+	}
+}
+
+func TestBacktestScopedPolicy(t *testing.T) {
+	start := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	// two failures on the portal and one elsewhere don't reach the portal policy's limit
+	events := failuresAt("192.168.1.1", start, 3, time.Minute)
+	events[0].App, events[1].App = "portal", "portal"
+	policies := []BanPolicy{{Name: "portal", Table: "short_ban", Period: 1, Limit: 3, Match: map[string]string{"app": "portal"}}}
+
+	if report := Backtest(events, policies); report.Bans != 0 {
+		t.Logf("Unexpected report: %+v", report)
+		t.Fail()
+	}
+	events[2].App = "portal"
+	if report := Backtest(events, policies); report.Bans != 1 {
+		t.Logf("Unexpected report: %+v", report)
+		t.Fail()
+	}
+}
+
+func TestBacktestHighRiskCountry(t *testing.T) {
+	start := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	// two failures only reach the halved limit from a high risk country
+	events := failuresAt("192.168.1.1", start, 2, time.Minute)
+	events = append(events, failuresAt("192.168.1.2", start, 2, time.Minute)...)
+	for i := range events[:2] {
+		events[i].Country = "KP"
+	}
+	policies := []BanPolicy{{Name: "short", Table: "short_ban", Period: 1, Limit: 4,
+		HighRiskCountries: []string{"KP"}, HighRiskFactor: 0.5}}
+
+	report := Backtest(events, policies)
+	if report.Bans != 1 || len(report.BannedIPs) != 1 || report.BannedIPs[0] != "192.168.1.1" {
+		t.Logf("Unexpected report: %+v", report)
+		t.Fail()
+	}
+}
+
+func TestBacktestUnblocked(t *testing.T) {
+	start := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	// the failures of 192.168.1.1 were ignored when an admin unblocked it
+	events := failuresAt("192.168.1.1", start, 3, time.Minute)
+	for i := range events {
+		events[i].Unblocked = true
+	}
+	events = append(events, failuresAt("192.168.1.2", start, 3, time.Minute)...)
+	policies := []BanPolicy{{Name: "short", Table: "short_ban", Period: 1, Limit: 3}}
+
+	report := Backtest(events, policies)
+	if report.Bans != 2 || len(report.UnblockedIPs) != 1 || report.UnblockedIPs[0] != "192.168.1.1" {
+		t.Logf("Unexpected report: %+v", report)
+		t.Fail()
+	}
+}
+
+func TestBanHistoryReport(t *testing.T) {
+	start := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	report := BanHistoryReport([]BanRecord{
+		{IP: "192.168.1.1", Table: "short_ban", Ts: start},
+		{IP: "192.168.1.1", Table: "long_ban", Ts: start.Add(time.Minute)},
+		{IP: "192.168.1.2", Table: "short_ban", Ts: start.Add(time.Hour)},
+	})
+	if report.Source != "history" || report.Bans != 3 || report.BansByTable["short_ban"] != 2 || report.BansByTable["long_ban"] != 1 {
+		t.Logf("Unexpected report: %+v", report)
+		t.Fail()
+	}
+	if len(report.BannedIPs) != 2 || report.BannedIPs[0] != "192.168.1.1" || report.BannedIPs[1] != "192.168.1.2" {
+		t.Logf("Unexpected banned IPs: %v", report.BannedIPs)
+		t.Fail()
+	}
+}
+
+func TestReadEventsJSONL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	content := `{"ts": "2021-11-01T10:00:00Z", "ip": "192.168.1.1", "username": "bob", "reason": "PASSWORD_FAILURE"}
+{"request_id": "not-an-event"}
+not json
+{"ts": "2021-11-01T10:01:00Z", "ip": "192.168.1.2"}
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Couldn't write %s: %s", path, err)
+	}
+	events, err := ReadEventsJSONL(path)
+	if err != nil || len(events) != 2 {
+		t.Logf("Expected 2 events, got %d (err: %v)", len(events), err)
+		t.Fail()
+	}
+	filtered := filterEvents(events, time.Date(2021, 11, 1, 10, 0, 30, 0, time.UTC), time.Time{})
+	if len(filtered) != 1 || filtered[0].IP != "192.168.1.2" {
+		t.Logf("Unexpected filtered events: %v", filtered)
+		t.Fail()
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrCloudflareOperationTimeout is returned when a bulk operation doesn't finish in time
+var ErrCloudflareOperationTimeout = errors.New("Timed out waiting for the Cloudflare bulk operation")
+
+// cloudflareResponse is the envelope of every Cloudflare API response
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo struct {
+		Cursors struct {
+			After string `json:"after"`
+		} `json:"cursors"`
+	} `json:"result_info"`
+}
+
+// cloudflareListItem is an entry in a Cloudflare IP list
+type cloudflareListItem struct {
+	ID      string `json:"id,omitempty"`
+	IP      string `json:"ip"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// cloudflareOperation is the status of an asynchronous bulk operation on a list
+type cloudflareOperation struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+// CloudflareSink is an account level Cloudflare IP list, used in WAF custom rules
+type CloudflareSink struct {
+	client       *http.Client
+	baseURL      string
+	token        string
+	accountID    string
+	listID       string
+	pollInterval time.Duration
+	timeout      time.Duration
+}
+
+// NewCloudflareSink makes the sink for the list in envconf
+func NewCloudflareSink(envconf *EnvConfig) *CloudflareSink {
+	return &CloudflareSink{
+		client:       &http.Client{Timeout: 30 * time.Second},
+		baseURL:      strings.TrimRight(envconf.CloudflareAPIURL, "/"),
+		token:        envconf.CloudflareAPIToken,
+		accountID:    envconf.CloudflareAccountID,
+		listID:       envconf.CloudflareListID,
+		pollInterval: time.Second,
+		timeout:      time.Duration(envconf.CloudflareOperationTimeout) * time.Second,
+	}
+}
+
+// cloudflareAddress returns the list entry for ip. Lists take single IPv4 addresses, but
+// IPv6 only down to a /64, so an IPv6 address bans its whole /64.
+func cloudflareAddress(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return ip
+	}
+	network := net.IPNet{IP: parsed.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+	return network.String()
+}
+
+// Name is cloudflare
+func (c *CloudflareSink) Name() string {
+	return "cloudflare"
+}
+
+// call makes a request to the Cloudflare API and returns the response envelope
+func (c *CloudflareSink) call(method string, path string, body interface{}) (*cloudflareResponse, error) {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16*1048576))
+	if err != nil {
+		return nil, err
+	}
+	var envelope cloudflareResponse
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("Cloudflare returned %d with a body that isn't JSON", resp.StatusCode)
+	}
+	if !envelope.Success || resp.StatusCode >= 300 {
+		messages := []string{}
+		for _, apiErr := range envelope.Errors {
+			messages = append(messages, fmt.Sprintf("%d: %s", apiErr.Code, apiErr.Message))
+		}
+		return nil, fmt.Errorf("Cloudflare returned %d: %s", resp.StatusCode, strings.Join(messages, ", "))
+	}
+	return &envelope, nil
+}
+
+// itemsPath is the path of the list's items
+func (c *CloudflareSink) itemsPath() string {
+	return fmt.Sprintf("/accounts/%s/rules/lists/%s/items", url.PathEscape(c.accountID), url.PathEscape(c.listID))
+}
+
+// listItems returns every item in the list, following the pagination cursors
+func (c *CloudflareSink) listItems() ([]cloudflareListItem, error) {
+	items := []cloudflareListItem{}
+	cursor := ""
+	for {
+		path := c.itemsPath() + "?per_page=500"
+		if cursor != "" {
+			path += "&cursor=" + url.QueryEscape(cursor)
+		}
+		resp, err := c.call("GET", path, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page []cloudflareListItem
+		if err := json.Unmarshal(resp.Result, &page); err != nil {
+			return nil, err
+		}
+		items = append(items, page...)
+		cursor = resp.ResultInfo.Cursors.After
+		if cursor == "" {
+			return items, nil
+		}
+	}
+}
+
+// waitForOperation polls a bulk operation until it completes, fails or times out
+func (c *CloudflareSink) waitForOperation(result json.RawMessage) error {
+	var started struct {
+		OperationID string `json:"operation_id"`
+	}
+	if err := json.Unmarshal(result, &started); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(c.timeout)
+	path := fmt.Sprintf("/accounts/%s/rules/lists/bulk_operations/%s", url.PathEscape(c.accountID), url.PathEscape(started.OperationID))
+	for {
+		resp, err := c.call("GET", path, nil)
+		if err != nil {
+			return err
+		}
+		var operation cloudflareOperation
+		if err := json.Unmarshal(resp.Result, &operation); err != nil {
+			return err
+		}
+		switch operation.Status {
+		case "completed":
+			return nil
+		case "failed":
+			return fmt.Errorf("Cloudflare bulk operation %s failed: %s", started.OperationID, operation.Error)
+		}
+		if time.Now().After(deadline) {
+			return ErrCloudflareOperationTimeout
+		}
+		time.Sleep(c.pollInterval)
+	}
+}
+
+// Sync replaces the items in the list when they don't match entries
+func (c *CloudflareSink) Sync(entries []BanEntry, dryRun bool) error {
+	desired := map[string]bool{}
+	for _, entry := range entries {
+		desired[cloudflareAddress(entry.IP)] = true
+	}
+	items, err := c.listItems()
+	if err != nil {
+		return err
+	}
+	current := map[string]bool{}
+	for _, item := range items {
+		current[item.IP] = true
+	}
+	added, removed := []string{}, []string{}
+	for address := range desired {
+		if !current[address] {
+			added = append(added, address)
+		}
+	}
+	for address := range current {
+		if !desired[address] {
+			removed = append(removed, address)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		log.Debug().Str("Sink", c.Name()).Msg("Cloudflare list is up to date")
+		return nil
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	if dryRun {
+		log.Info().Str("Sink", c.Name()).Strs("Added", added).Strs("Removed", removed).
+			Msg("Dry run: not updating Cloudflare list")
+		return nil
+	}
+	// the items are replaced all at once, so a failed sync never leaves half a list
+	replacement := make([]cloudflareListItem, 0, len(desired))
+	for address := range desired {
+		replacement = append(replacement, cloudflareListItem{IP: address, Comment: "autowaf"})
+	}
+	sort.Slice(replacement, func(i, j int) bool { return replacement[i].IP < replacement[j].IP })
+	resp, err := c.call("PUT", c.itemsPath(), replacement)
+	if err != nil {
+		return err
+	}
+	if err := c.waitForOperation(resp.Result); err != nil {
+		return err
+	}
+	log.Info().Str("Sink", c.Name()).Int("Added", len(added)).Int("Removed", len(removed)).Msg("Updated Cloudflare list")
+	return nil
+}
+
+// Remove deletes ip from the list
+func (c *CloudflareSink) Remove(ip string) error {
+	address := cloudflareAddress(ip)
+	items, err := c.listItems()
+	if err != nil {
+		return err
+	}
+	toDelete := []map[string]string{}
+	for _, item := range items {
+		if item.IP == address {
+			toDelete = append(toDelete, map[string]string{"id": item.ID})
+		}
+	}
+	if len(toDelete) == 0 {
+		log.Info().Str("IP", ip).Msg("Tried to remove IP that wasn't in the Cloudflare list")
+		return ErrIPNotFound
+	}
+	resp, err := c.call("DELETE", c.itemsPath(), map[string]interface{}{"items": toDelete})
+	if err != nil {
+		return err
+	}
+	if err := c.waitForOperation(resp.Result); err != nil {
+		return err
+	}
+	log.Info().Str("IP", ip).Msg("Removed IP from Cloudflare list")
+	return nil
+}
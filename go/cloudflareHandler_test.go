@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// FakeCloudflare is enough of the Cloudflare lists API for the sink
+type FakeCloudflare struct {
+	mu     sync.Mutex
+	items  []cloudflareListItem
+	nextID int
+	// polls counts the status requests for each operation, operations complete on the second one
+	polls    map[string]int
+	fail     bool
+	replaces int
+}
+
+func (f *FakeCloudflare) respond(w http.ResponseWriter, status int, result interface{}, after string) {
+	data, _ := json.Marshal(result)
+	resp := map[string]interface{}{"success": status < 300, "errors": []interface{}{}, "result": json.RawMessage(data)}
+	if status >= 300 {
+		resp["errors"] = []map[string]interface{}{{"code": 10000, "message": "Authentication error"}}
+	}
+	if after != "" {
+		resp["result_info"] = map[string]interface{}{"cursors": map[string]string{"after": after}}
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (f *FakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail || r.Header.Get("Authorization") != "Bearer token" {
+		f.respond(w, http.StatusForbidden, nil, "")
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/accounts/acct/rules/lists/bulk_operations/"):
+		id := strings.TrimPrefix(r.URL.Path, "/accounts/acct/rules/lists/bulk_operations/")
+		f.polls[id]++
+		status := "pending"
+		if f.polls[id] > 1 {
+			status = "completed"
+		}
+		f.respond(w, http.StatusOK, cloudflareOperation{ID: id, Status: status}, "")
+	case r.URL.Path == "/accounts/acct/rules/lists/list/items" && r.Method == "GET":
+		// two items a page
+		start, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		end := start + 2
+		after := strconv.Itoa(end)
+		if end >= len(f.items) {
+			end = len(f.items)
+			after = ""
+		}
+		f.respond(w, http.StatusOK, f.items[start:end], after)
+	case r.URL.Path == "/accounts/acct/rules/lists/list/items" && r.Method == "PUT":
+		var items []cloudflareListItem
+		json.NewDecoder(r.Body).Decode(&items)
+		f.items = nil
+		for _, item := range items {
+			f.nextID++
+			f.items = append(f.items, cloudflareListItem{ID: fmt.Sprintf("item%d", f.nextID), IP: item.IP})
+		}
+		f.replaces++
+		f.respond(w, http.StatusOK, map[string]string{"operation_id": fmt.Sprintf("op%d", f.nextID)}, "")
+	case r.URL.Path == "/accounts/acct/rules/lists/list/items" && r.Method == "DELETE":
+		var body struct {
+			Items []struct {
+				ID string `json:"id"`
+			} `json:"items"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		kept := []cloudflareListItem{}
+		for _, item := range f.items {
+			deleted := false
+			for _, del := range body.Items {
+				deleted = deleted || del.ID == item.ID
+			}
+			if !deleted {
+				kept = append(kept, item)
+			}
+		}
+		f.items = kept
+		f.nextID++
+		f.respond(w, http.StatusOK, map[string]string{"operation_id": fmt.Sprintf("op%d", f.nextID)}, "")
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *FakeCloudflare) addresses() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	addresses := []string{}
+	for _, item := range f.items {
+		addresses = append(addresses, item.IP)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func newTestCloudflareSink(t *testing.T) (*CloudflareSink, *FakeCloudflare) {
+	fake := &FakeCloudflare{polls: map[string]int{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	sink := NewCloudflareSink(&EnvConfig{
+		CloudflareAPIURL:           server.URL + "/",
+		CloudflareAPIToken:         "token",
+		CloudflareAccountID:        "acct",
+		CloudflareListID:           "list",
+		CloudflareOperationTimeout: 5,
+	})
+	sink.pollInterval = time.Millisecond
+	return sink, fake
+}
+
+func TestCloudflareSync(t *testing.T) {
+	sink, fake := newTestCloudflareSink(t)
+	entries := []BanEntry{
+		NewBanEntry("192.168.1.1", time.Time{}),
+		NewBanEntry("192.168.1.2", time.Time{}),
+		NewBanEntry("192.168.1.3", time.Time{}),
+		NewBanEntry("2001:db8::1", time.Time{}),
+		NewBanEntry("2001:db8::2", time.Time{}),
+	}
+	if err := sink.Sync(entries, false); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	addresses := fake.addresses()
+	// both IPv6 addresses are in the same /64
+	expected := []string{"192.168.1.1", "192.168.1.2", "192.168.1.3", "2001:db8::/64"}
+	if strings.Join(addresses, ",") != strings.Join(expected, ",") {
+		t.Logf("Expected %v, got %v", expected, addresses)
+		t.Fail()
+	}
+	// nothing changed, so the list isn't replaced again
+	if err := sink.Sync(entries, false); err != nil || fake.replaces != 1 {
+		t.Logf("Expected 1 replace, got %d (err: %v)", fake.replaces, err)
+		t.Fail()
+	}
+	// a dry run doesn't change the list
+	if err := sink.Sync(entries[:1], true); err != nil || len(fake.addresses()) != 4 {
+		t.Logf("A dry run shouldn't change the list (err: %v)", err)
+		t.Fail()
+	}
+}
+
+func TestCloudflareRemove(t *testing.T) {
+	sink, fake := newTestCloudflareSink(t)
+	sink.Sync([]BanEntry{NewBanEntry("192.168.1.1", time.Time{}), NewBanEntry("192.168.1.2", time.Time{})}, false)
+	if err := sink.Remove("192.168.1.1"); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.Fail()
+	}
+	if addresses := fake.addresses(); len(addresses) != 1 || addresses[0] != "192.168.1.2" {
+		t.Logf("Unexpected addresses: %v", addresses)
+		t.Fail()
+	}
+	if err := sink.Remove("192.168.1.1"); err != ErrIPNotFound {
+		t.Logf("Expected ErrIPNotFound, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestCloudflareAPIError(t *testing.T) {
+	sink, fake := newTestCloudflareSink(t)
+	fake.fail = true
+	err := sink.Sync([]BanEntry{NewBanEntry("192.168.1.1", time.Time{})}, false)
+	if err == nil || !strings.Contains(err.Error(), "Authentication error") {
+		t.Logf("Expected the API error, got %v", err)
+		t.Fail()
+	}
+}
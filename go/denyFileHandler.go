@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Deny file formats
+const (
+	// DenyFormatNginx is an nginx include of deny directives
+	DenyFormatNginx = "nginx"
+	// DenyFormatHAProxy is a HAProxy map of CIDRs, for use with map_ip
+	DenyFormatHAProxy = "haproxy"
+	// DenyFormatPlain is one CIDR per line
+	DenyFormatPlain = "plain"
+)
+
+// the signals a pidfile can be sent
+var denyFileSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// how long the reload command gets to run
+var denyFileReloadTimeout = 30 * time.Second
+
+const denyFileHeader = "# generated by autowaf, changes will be overwritten\n"
+
+// CommandRunner runs a shell command, returning its combined output
+type CommandRunner func(ctx context.Context, command string) ([]byte, error)
+
+// ProcessSignaler sends sig to the process pid
+type ProcessSignaler func(pid int, sig syscall.Signal) error
+
+// runShellCommand runs command with sh
+func runShellCommand(ctx context.Context, command string) ([]byte, error) {
+	return exec.CommandContext(ctx, "sh", "-c", command).CombinedOutput()
+}
+
+// DenyFileSink renders the blocklist to a file for a web server to include, and tells
+// the server to reload it
+type DenyFileSink struct {
+	path          string
+	format        string
+	reloadCommand string
+	pidFile       string
+	signal        syscall.Signal
+	run           CommandRunner
+	kill          ProcessSignaler
+	// mu stops an unblock and the background task writing the file at once
+	mu sync.Mutex
+	// reloadPending is set when the file changed but the reload failed, so it's retried
+	reloadPending bool
+}
+
+// NewDenyFileSink makes the sink for the file in envconf
+func NewDenyFileSink(envconf *EnvConfig) *DenyFileSink {
+	return &DenyFileSink{
+		path:          envconf.DenyFilePath,
+		format:        envconf.DenyFileFormat,
+		reloadCommand: envconf.DenyFileReloadCommand,
+		pidFile:       envconf.DenyFilePidFile,
+		signal:        denyFileSignals[envconf.DenyFileSignal],
+		run:           runShellCommand,
+		kill:          syscall.Kill,
+	}
+}
+
+// validDenyFormat checks format is one of the deny file formats
+func validDenyFormat(format string) bool {
+	return format == DenyFormatNginx || format == DenyFormatHAProxy || format == DenyFormatPlain
+}
+
+// RenderDenyFile renders the CIDRs in format, sorted so the same list always renders the same
+func RenderDenyFile(format string, cidrs []string) []byte {
+	sorted := make([]string, len(cidrs))
+	copy(sorted, cidrs)
+	sort.Strings(sorted)
+	var buf bytes.Buffer
+	buf.WriteString(denyFileHeader)
+	for _, cidr := range sorted {
+		switch format {
+		case DenyFormatNginx:
+			fmt.Fprintf(&buf, "deny %s;\n", cidr)
+		case DenyFormatHAProxy:
+			fmt.Fprintf(&buf, "%s 1\n", cidr)
+		default:
+			fmt.Fprintf(&buf, "%s\n", cidr)
+		}
+	}
+	return buf.Bytes()
+}
+
+// parseDenyFile returns the CIDRs in a rendered deny file
+func parseDenyFile(format string, content []byte) []string {
+	cidrs := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimSuffix(line, ";"))
+		if format == DenyFormatNginx && len(fields) == 2 && fields[0] == "deny" {
+			cidrs = append(cidrs, fields[1])
+		} else if format != DenyFormatNginx && len(fields) > 0 {
+			cidrs = append(cidrs, fields[0])
+		}
+	}
+	return cidrs
+}
+
+// Name is the file's path
+func (f *DenyFileSink) Name() string {
+	return "file:" + f.path
+}
+
+// write atomically replaces the file with content, and reloads the server, unless the
+// file already has that content
+func (f *DenyFileSink) write(content []byte) (bool, error) {
+	current, err := ioutil.ReadFile(f.path)
+	if err == nil && sha256.Sum256(current) == sha256.Sum256(content) {
+		if f.reloadPending {
+			return false, f.reload()
+		}
+		return false, nil
+	}
+	// the temporary file is in the same directory so that the rename is atomic
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), ".autowaf-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return false, err
+	}
+	return true, f.reload()
+}
+
+// reload runs the reload command and signals the pidfile's process, whichever are configured
+func (f *DenyFileSink) reload() error {
+	f.reloadPending = true
+	if f.reloadCommand != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), denyFileReloadTimeout)
+		defer cancel()
+		output, err := f.run(ctx, f.reloadCommand)
+		if err != nil {
+			log.Error().Str("Error", err.Error()).Str("Output", string(output)).Msg("Deny file reload command failed")
+			return fmt.Errorf("reload command failed: %s", err)
+		}
+	}
+	if f.pidFile != "" {
+		data, err := ioutil.ReadFile(f.pidFile)
+		if err != nil {
+			return err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || pid < 1 {
+			return fmt.Errorf("pidfile %s doesn't have a pid", f.pidFile)
+		}
+		if err := f.kill(pid, f.signal); err != nil {
+			return err
+		}
+	}
+	f.reloadPending = false
+	return nil
+}
+
+// Sync renders entries to the file
+func (f *DenyFileSink) Sync(entries []BanEntry, dryRun bool) error {
+	cidrs := make([]string, len(entries))
+	for i := range entries {
+		cidrs[i] = entries[i].CIDR
+	}
+	if dryRun {
+		current, _ := ioutil.ReadFile(f.path)
+		currentPtrs := []*string{}
+		for _, cidr := range parseDenyFile(f.format, current) {
+			cidr := cidr
+			currentPtrs = append(currentPtrs, &cidr)
+		}
+		desiredPtrs := make([]*string, len(cidrs))
+		for i := range cidrs {
+			desiredPtrs[i] = &cidrs[i]
+		}
+		added, removed := DiffAddresses(currentPtrs, desiredPtrs)
+		log.Info().Str("Sink", f.Name()).Strs("Added", added).Strs("Removed", removed).Msg("Dry run: not updating deny file")
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changed, err := f.write(RenderDenyFile(f.format, cidrs))
+	if err != nil {
+		return err
+	}
+	if changed {
+		log.Info().Str("Sink", f.Name()).Int("Count", len(cidrs)).Msg("Updated deny file")
+	}
+	return nil
+}
+
+// Remove rewrites the file without ip
+func (f *DenyFileSink) Remove(ip string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrIPNotFound
+		}
+		return err
+	}
+	target := hostCIDR(ip)
+	cidrs := []string{}
+	found := false
+	for _, cidr := range parseDenyFile(f.format, current) {
+		if cidr == target {
+			found = true
+			continue
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	if !found {
+		return ErrIPNotFound
+	}
+	_, err = f.write(RenderDenyFile(f.format, cidrs))
+	return err
+}
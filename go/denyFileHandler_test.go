@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRenderDenyFile(t *testing.T) {
+	cidrs := []string{"192.168.1.2/32", "192.168.1.1/32"}
+	for format, expected := range map[string]string{
+		DenyFormatNginx:   denyFileHeader + "deny 192.168.1.1/32;\ndeny 192.168.1.2/32;\n",
+		DenyFormatHAProxy: denyFileHeader + "192.168.1.1/32 1\n192.168.1.2/32 1\n",
+		DenyFormatPlain:   denyFileHeader + "192.168.1.1/32\n192.168.1.2/32\n",
+	} {
+		rendered := RenderDenyFile(format, cidrs)
+		if string(rendered) != expected {
+			t.Logf("Unexpected %s file: %q", format, rendered)
+			t.Fail()
+		}
+		parsed := parseDenyFile(format, rendered)
+		if len(parsed) != 2 || parsed[0] != "192.168.1.1/32" || parsed[1] != "192.168.1.2/32" {
+			t.Logf("Unexpected parsed %s file: %v", format, parsed)
+			t.Fail()
+		}
+	}
+}
+
+func newTestDenyFileSink(t *testing.T, format string) (*DenyFileSink, *int) {
+	dir := t.TempDir()
+	reloads := 0
+	sink := NewDenyFileSink(&EnvConfig{
+		DenyFilePath:          filepath.Join(dir, "deny.conf"),
+		DenyFileFormat:        format,
+		DenyFileReloadCommand: "nginx -s reload",
+	})
+	sink.run = func(ctx context.Context, command string) ([]byte, error) {
+		reloads++
+		return nil, nil
+	}
+	return sink, &reloads
+}
+
+func TestDenyFileSync(t *testing.T) {
+	sink, reloads := newTestDenyFileSink(t, DenyFormatNginx)
+	entries := []BanEntry{NewBanEntry("192.168.1.1", time.Time{}), NewBanEntry("2001:db8::1", time.Time{})}
+	if err := sink.Sync(entries, false); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	content, _ := ioutil.ReadFile(sink.path)
+	if string(content) != denyFileHeader+"deny 192.168.1.1/32;\ndeny 2001:db8::1/128;\n" {
+		t.Logf("Unexpected file: %q", content)
+		t.Fail()
+	}
+	// the same list doesn't rewrite or reload
+	sink.Sync(entries, false)
+	if *reloads != 1 {
+		t.Logf("Expected 1 reload, got %d", *reloads)
+		t.Fail()
+	}
+	if err := sink.Remove("192.168.1.1"); err != nil || *reloads != 2 {
+		t.Logf("Remove should rewrite and reload, %d reloads (err: %v)", *reloads, err)
+		t.Fail()
+	}
+	if err := sink.Remove("192.168.1.1"); err != ErrIPNotFound {
+		t.Logf("Expected ErrIPNotFound, got %v", err)
+		t.Fail()
+	}
+	// no temporary files are left behind
+	files, _ := ioutil.ReadDir(filepath.Dir(sink.path))
+	if len(files) != 1 {
+		t.Logf("Expected only the deny file, got %d files", len(files))
+		t.Fail()
+	}
+}
+
+func TestRemoveMappedAddress(t *testing.T) {
+	sink, _ := newTestDenyFileSink(t, DenyFormatPlain)
+	sink.Sync([]BanEntry{NewBanEntry("::ffff:192.168.1.1", time.Time{})}, false)
+	defer func(saved []BlockListSink) { sinks = saved }(sinks)
+	sinks = []BlockListSink{sink}
+	// unblocking the mapped form takes the IPv4 address off
+	if failures := removeFromSinks("::ffff:192.168.1.1"); failures != 0 {
+		t.Logf("Expected no failures, got %d", failures)
+		t.Fail()
+	}
+	if err := sink.Remove("192.168.1.1"); err != ErrIPNotFound {
+		t.Logf("Expected the address to be gone, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestDenyFileReloadRetry(t *testing.T) {
+	sink, reloads := newTestDenyFileSink(t, DenyFormatPlain)
+	sink.run = func(ctx context.Context, command string) ([]byte, error) {
+		*reloads++
+		if *reloads == 1 {
+			return []byte("nginx: configuration file test failed"), errors.New("exit status 1")
+		}
+		return nil, nil
+	}
+	entries := []BanEntry{NewBanEntry("192.168.1.1", time.Time{})}
+	if err := sink.Sync(entries, false); err == nil {
+		t.Log("A failed reload should be an error")
+		t.Fail()
+	}
+	// the file is unchanged but the reload didn't happen, so it's tried again
+	if err := sink.Sync(entries, false); err != nil || *reloads != 2 {
+		t.Logf("Expected the reload to be retried, %d reloads (err: %v)", *reloads, err)
+		t.Fail()
+	}
+}
+
+func TestDenyFilePidFile(t *testing.T) {
+	sink, _ := newTestDenyFileSink(t, DenyFormatHAProxy)
+	sink.reloadCommand = ""
+	sink.pidFile = filepath.Join(filepath.Dir(sink.path), "haproxy.pid")
+	sink.signal = syscall.SIGUSR2
+	ioutil.WriteFile(sink.pidFile, []byte(strconv.Itoa(4321)+"\n"), 0644)
+	var gotPid int
+	var gotSignal syscall.Signal
+	sink.kill = func(pid int, sig syscall.Signal) error {
+		gotPid, gotSignal = pid, sig
+		return nil
+	}
+	if err := sink.Sync([]BanEntry{NewBanEntry("192.168.1.1", time.Time{})}, false); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.Fail()
+	}
+	if gotPid != 4321 || gotSignal != syscall.SIGUSR2 {
+		t.Logf("Expected USR2 to 4321, got %v to %d", gotSignal, gotPid)
+		t.Fail()
+	}
+	os.Remove(sink.pidFile)
+}
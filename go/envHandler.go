@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"log"
+	"net"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -23,6 +26,134 @@ type EnvConfig struct {
 	LongTermLimit   int
 	RetentionPeriod int
 	UpdateRate      int
+	// ban evaluation queue
+	QueueDepth      int
+	QueueWorkers    int
+	QueueRetryAfter int
+	// SQS consumer
+	SQSQueueURL    string
+	SQSRegion      string
+	SQSWaitTime    int
+	SQSMaxMessages int
+	// syslog receiver
+	SyslogUDPAddr     string
+	SyslogTCPAddr     string
+	SyslogTLSCert     string
+	SyslogTLSKey      string
+	SyslogPatternFile string
+	// log file tailing
+	TailFiles        []string
+	TailPatternFile  string
+	TailPollInterval int
+	// webhook notifications
+	WebhookURLs         []string
+	WebhookEvents       []string
+	WebhookSecret       string
+	WebhookMaxAttempts  int
+	WebhookPollInterval int
+	// policy testing
+	ShadowPolicies []BanPolicy
+	DryRun         bool
+	// username based detectors
+	UsernamesPerIPLimit  int
+	UsernamesPerIPPeriod int
+	UsernamesPerIPAction string
+	IPsPerUsernameLimit  int
+	IPsPerUsernamePeriod int
+	IPsPerUsernameAction string
+	UnknownUserLimit     int
+	UnknownUserPeriod    int
+	UnknownUserAction    string
+	UnknownUserReasons   []string
+	// password spraying
+	PasswordSprayLimit  int
+	PasswordSprayPeriod int
+	PasswordSprayAction string
+	// hashing at rest, nil when there are no keys
+	Pepper *Pepper
+	// how much each failure reason counts
+	ReasonWeights *ReasonWeights
+	// successful logons
+	SuccessAction        string
+	SuccessPolicyActions map[string]string
+	TrustPeriod          int
+	// unblock exemptions
+	ExemptionMaxHours int
+	// the proxies whose X-Forwarded-For hops are believed for the admin audit
+	TrustedProxies []*net.IPNet
+	// Cloudflare IP list sink
+	CloudflareAPIURL           string
+	CloudflareAPIToken         string
+	CloudflareAccountID        string
+	CloudflareListID           string
+	CloudflareOperationTimeout int
+	// deny file sink
+	DenyFilePath          string
+	DenyFileFormat        string
+	DenyFileReloadCommand string
+	DenyFilePidFile       string
+	DenyFileSignal        string
+	// host firewall sink
+	FirewallBackend   string
+	FirewallNftFamily string
+	FirewallNftTable  string
+	FirewallSetV4     string
+	FirewallSetV6     string
+	// Azure WAF policy sink
+	AzureWAFType        string
+	AzureTenantID       string
+	AzureClientID       string
+	AzureClientSecret   string
+	AzureSubscriptionID string
+	AzureResourceGroup  string
+	AzurePolicyName     string
+	AzureAPIVersion     string
+	AzureLoginURL       string
+	AzureManagementURL  string
+	AzureRulePrefix     string
+	AzureRulePriority   int
+	AzureIPsPerRule     int
+	AzureMaxRules       int
+	// Cloud Armor security policy sink
+	GCPSecurityPolicy   string
+	GCPProject          string
+	GCPCredentialsFile  string
+	GCPAPIURL           string
+	GCPMetadataURL      string
+	GCPDenyAction       string
+	GCPRulePriority     int
+	GCPIPsPerRule       int
+	GCPMaxRules         int
+	GCPOperationTimeout int
+	// threat intel feeds and the allowlist
+	IntelFeeds       []IntelFeed
+	IntelRefreshRate int
+	IntelMaxAge      int
+	AllowList        AllowList
+	// federated ban sharing
+	FederationInstance     string
+	FederationKey          ed25519.PrivateKey
+	FederationPeers        []FederationPeer
+	FederationTrust        string
+	FederationQuorum       int
+	FederationQuorumWindow int
+	FederationMaxSkew      int
+	FederationMaxAttempts  int
+	// GeoIP enrichment and the policies that use it
+	GeoIPCountryDB      string
+	GeoIPASNDB          string
+	GeoIPReloadInterval int
+	HighRiskCountries   []string
+	HighRiskFactor      float64
+	HostingASNs         []uint
+	HostingASNLimit     int
+	HostingASNPeriod    int
+	HostingASNAction    string
+	ASNFailureLimit     int
+	ASNFailurePeriod    int
+	ASNFailureAction    string
+	// policies scoped to one login surface by the failures' metadata
+	ScopedPolicies []BanPolicy
 }
 
 // GetEnvVars returns a configuration object from the environmental vars
@@ -48,6 +179,229 @@ func GetEnvVars() EnvConfig {
 	retPeriod := getVarInt("RETENTION_PERIOD", 90)
 	//
 	updateRate := getVarInt("UPDATE_RATE", 5)
+	// ban evaluation queue
+	queueDepth := getVarInt("QUEUE_DEPTH", 1000)
+	queueWorkers := getVarInt("QUEUE_WORKERS", 4)
+	queueRetryAfter := getVarInt("QUEUE_RETRY_AFTER", 5)
+	// optional SQS consumer, disabled when no queue is set
+	sqsQueueURL := getVar("SQS_QUEUE_URL", "")
+	sqsRegion := getVar("SQS_REGION", regions[0])
+	sqsWaitTime := getVarInt("SQS_WAIT_TIME", 20)
+	sqsMaxMessages := getVarInt("SQS_MAX_MESSAGES", 10)
+	// optional syslog listeners, disabled when no address is set
+	syslogUDPAddr := getVar("SYSLOG_UDP_ADDR", "")
+	syslogTCPAddr := getVar("SYSLOG_TCP_ADDR", "")
+	syslogTLSCert := getVar("SYSLOG_TLS_CERT", "")
+	syslogTLSKey := getVar("SYSLOG_TLS_KEY", "")
+	syslogPatternFile := getVar("SYSLOG_PATTERN_FILE", "")
+	// optional log file tailing, disabled when no files are set
+	tailFiles := getVarList("TAIL_FILES", "")
+	tailPatternFile := getVar("TAIL_PATTERN_FILE", "")
+	tailPollInterval := getVarInt("TAIL_POLL_INTERVAL", 2)
+	// webhooks for ban changes, disabled when no URLs are set
+	webhookURLs := getVarList("WEBHOOK_URLS", "")
+	webhookEvents := getVarList("WEBHOOK_EVENTS", "")
+	webhookSecret := getVar("WEBHOOK_SECRET", "")
+	webhookMaxAttempts := getVarInt("WEBHOOK_MAX_ATTEMPTS", 10)
+	webhookPollInterval := getVarInt("WEBHOOK_POLL_INTERVAL", 10)
+	// username based detectors, a limit of 0 turns the detector off
+	usernamesPerIPLimit := getVarInt("USERNAMES_PER_IP_LIMIT", 0)
+	usernamesPerIPPeriod := getVarInt("USERNAMES_PER_IP_PERIOD", 1)
+	usernamesPerIPAction := getVarTable("USERNAMES_PER_IP_ACTION", "short_ban")
+	ipsPerUsernameLimit := getVarInt("IPS_PER_USERNAME_LIMIT", 0)
+	ipsPerUsernamePeriod := getVarInt("IPS_PER_USERNAME_PERIOD", 1)
+	ipsPerUsernameAction := getVarTable("IPS_PER_USERNAME_ACTION", "short_ban")
+	unknownUserLimit := getVarInt("UNKNOWN_USER_LIMIT", 0)
+	unknownUserPeriod := getVarInt("UNKNOWN_USER_PERIOD", 6)
+	unknownUserAction := getVarTable("UNKNOWN_USER_ACTION", "short_ban")
+	unknownUserReasons := getVarList("UNKNOWN_USER_REASONS", "USER_NOT_FOUND")
+	// password spraying detection, a limit of 0 turns it off
+	passwordSprayLimit := getVarInt("PASSWORD_SPRAY_LIMIT", 0)
+	passwordSprayPeriod := getVarInt("PASSWORD_SPRAY_PERIOD", 1)
+	passwordSprayAction := getVarTable("PASSWORD_SPRAY_ACTION", "long_ban")
+	// pepper keys for hashing pwhash and usernames before they're stored
+	pepper, err := ParsePepperKeys(getVar("PEPPER_KEYS", ""), getVar("PEPPER_ACTIVE_KEY", ""), getVarBool("HASH_USERNAMES", false))
+	if err != nil {
+		log.Fatalf("Error in PEPPER_KEYS: %s", err)
+	}
+	// reason weights for the failures policies
+	reasonWeights, err := ParseReasonWeights(getVar("REASON_WEIGHTS", ""), getVarFloat("REASON_DEFAULT_WEIGHT", 1),
+		getVarList("REASON_IGNORE", ""))
+	if err != nil {
+		log.Fatalf("Error in REASON_WEIGHTS: %s", err)
+	}
+	// what successful logons do for each policy
+	successAction := getVar("SUCCESS_ACTION", SuccessDiscount)
+	if !validSuccessAction(successAction) {
+		log.Fatalf("Error in SUCCESS_ACTION: %s should be none, discount or trust", successAction)
+	}
+	successPolicyActions, err := ParseSuccessActions(getVar("SUCCESS_POLICY_ACTIONS", ""))
+	if err != nil {
+		log.Fatalf("Error in SUCCESS_POLICY_ACTIONS: %s", err)
+	}
+	trustPeriod := getVarInt("TRUST_PERIOD", 24)
+	// the longest exemption an unblock can grant
+	exemptionMaxHours := getVarInt("EXEMPTION_MAX_HOURS", 720)
+	trustedProxies, err := ParseAllowList(getVarList("TRUSTED_PROXIES", ""))
+	if err != nil {
+		log.Fatalf("Error in TRUSTED_PROXIES: %s", err)
+	}
+	// Cloudflare IP list sink, turned on by setting the list ID
+	cloudflareAPIURL := getVar("CLOUDFLARE_API_URL", "https://api.cloudflare.com/client/v4")
+	cloudflareAPIToken := getVar("CLOUDFLARE_API_TOKEN", "")
+	cloudflareAccountID := getVar("CLOUDFLARE_ACCOUNT_ID", "")
+	cloudflareListID := getVar("CLOUDFLARE_LIST_ID", "")
+	cloudflareOperationTimeout := getVarInt("CLOUDFLARE_OPERATION_TIMEOUT", 60)
+	if cloudflareListID != "" && (cloudflareAPIToken == "" || cloudflareAccountID == "") {
+		log.Fatalf("CLOUDFLARE_LIST_ID needs CLOUDFLARE_API_TOKEN and CLOUDFLARE_ACCOUNT_ID")
+	}
+	// deny file sink, turned on by setting the path
+	denyFilePath := getVar("DENY_FILE_PATH", "")
+	denyFileFormat := getVar("DENY_FILE_FORMAT", DenyFormatNginx)
+	if !validDenyFormat(denyFileFormat) {
+		log.Fatalf("Error in DENY_FILE_FORMAT: %s should be nginx, haproxy or plain", denyFileFormat)
+	}
+	denyFileReloadCommand := getVar("DENY_FILE_RELOAD_COMMAND", "")
+	denyFilePidFile := getVar("DENY_FILE_PIDFILE", "")
+	denyFileSignal := strings.TrimPrefix(strings.ToUpper(getVar("DENY_FILE_SIGNAL", "HUP")), "SIG")
+	if _, ok := denyFileSignals[denyFileSignal]; !ok {
+		log.Fatalf("Error in DENY_FILE_SIGNAL: %s should be HUP, USR1 or USR2", denyFileSignal)
+	}
+	// host firewall sink, turned on by choosing a backend
+	firewallBackend := getVar("FIREWALL_BACKEND", "")
+	if firewallBackend != "" && firewallBackend != FirewallNftables && firewallBackend != FirewallIPSet {
+		log.Fatalf("Error in FIREWALL_BACKEND: %s should be nftables or ipset", firewallBackend)
+	}
+	firewallNftFamily := getVar("FIREWALL_NFT_FAMILY", "inet")
+	firewallNftTable := getVar("FIREWALL_NFT_TABLE", "autowaf")
+	firewallSetV4 := getVar("FIREWALL_SET_V4", "autowaf_v4")
+	firewallSetV6 := getVar("FIREWALL_SET_V6", "autowaf_v6")
+	// Azure WAF policy sink, turned on by setting the policy name
+	azureWAFType := getVar("AZURE_WAF_TYPE", AzureAppGateway)
+	if azureWAFType != AzureAppGateway && azureWAFType != AzureFrontDoor {
+		log.Fatalf("Error in AZURE_WAF_TYPE: %s should be appgateway or frontdoor", azureWAFType)
+	}
+	azureTenantID := getVar("AZURE_TENANT_ID", "")
+	azureClientID := getVar("AZURE_CLIENT_ID", "")
+	azureClientSecret := getVar("AZURE_CLIENT_SECRET", "")
+	azureSubscriptionID := getVar("AZURE_SUBSCRIPTION_ID", "")
+	azureResourceGroup := getVar("AZURE_RESOURCE_GROUP", "")
+	azurePolicyName := getVar("AZURE_WAF_POLICY", "")
+	azureAPIVersion := getVar("AZURE_API_VERSION", "2022-05-01")
+	azureLoginURL := getVar("AZURE_LOGIN_URL", "https://login.microsoftonline.com")
+	azureManagementURL := getVar("AZURE_MANAGEMENT_URL", "https://management.azure.com")
+	azureRulePrefix := getVar("AZURE_RULE_PREFIX", "autowaf")
+	azureRulePriority := getVarInt("AZURE_RULE_PRIORITY", 10)
+	azureIPsPerRule := getVarInt("AZURE_IPS_PER_RULE", 600)
+	azureMaxRules := getVarInt("AZURE_MAX_RULES", 50)
+	if azurePolicyName != "" && (azureTenantID == "" || azureClientID == "" || azureClientSecret == "" ||
+		azureSubscriptionID == "" || azureResourceGroup == "") {
+		log.Fatalf("AZURE_WAF_POLICY needs AZURE_TENANT_ID, AZURE_CLIENT_ID, AZURE_CLIENT_SECRET, AZURE_SUBSCRIPTION_ID and AZURE_RESOURCE_GROUP")
+	}
+	if azureIPsPerRule < 1 || azureMaxRules < 1 {
+		log.Fatalf("AZURE_IPS_PER_RULE and AZURE_MAX_RULES must be at least 1")
+	}
+	// Cloud Armor security policy sink, turned on by setting the policy name
+	gcpSecurityPolicy := getVar("GCP_SECURITY_POLICY", "")
+	gcpProject := getVar("GCP_PROJECT", "")
+	gcpCredentialsFile := getVar("GCP_CREDENTIALS_FILE", "")
+	gcpAPIURL := getVar("GCP_API_URL", "https://compute.googleapis.com/compute/v1")
+	gcpMetadataURL := getVar("GCP_METADATA_URL", "http://metadata.google.internal")
+	gcpDenyAction := getVar("GCP_DENY_ACTION", "deny(403)")
+	gcpRulePriority := getVarInt("GCP_RULE_PRIORITY", 1000)
+	gcpIPsPerRule := getVarInt("GCP_IPS_PER_RULE", 10)
+	gcpMaxRules := getVarInt("GCP_MAX_RULES", 50)
+	gcpOperationTimeout := getVarInt("GCP_OPERATION_TIMEOUT", 120)
+	if gcpSecurityPolicy != "" && gcpProject == "" {
+		log.Fatalf("GCP_SECURITY_POLICY needs GCP_PROJECT")
+	}
+	if gcpIPsPerRule < 1 || gcpMaxRules < 1 {
+		log.Fatalf("GCP_IPS_PER_RULE and GCP_MAX_RULES must be at least 1")
+	}
+	// threat intel feeds are imported as an extra source of bans
+	intelFeeds, err := ParseIntelFeeds(getVar("INTEL_FEEDS", ""))
+	if err != nil {
+		log.Fatalf("Error in INTEL_FEEDS: %s", err)
+	}
+	intelRefreshRate := getVarInt("INTEL_REFRESH_RATE", 60)
+	intelMaxAge := getVarInt("INTEL_MAX_AGE", 48)
+	if intelRefreshRate < 1 || intelMaxAge < 1 {
+		log.Fatalf("INTEL_REFRESH_RATE and INTEL_MAX_AGE must be at least 1")
+	}
+	allowList, err := ParseAllowList(getVarList("ALLOWLIST", ""))
+	if err != nil {
+		log.Fatalf("Error in ALLOWLIST: %s", err)
+	}
+	// federated ban sharing, turned on by setting the peers
+	federationInstance := getVar("FEDERATION_INSTANCE", "")
+	federationKey, err := ParseFederationKey(getVar("FEDERATION_PRIVATE_KEY", ""))
+	if err != nil {
+		log.Fatalf("Error in FEDERATION_PRIVATE_KEY: %s", err)
+	}
+	federationPeers, err := ParseFederationPeers(getVar("FEDERATION_PEERS", ""))
+	if err != nil {
+		log.Fatalf("Error in FEDERATION_PEERS: %s", err)
+	}
+	federationTrust := getVar("FEDERATION_TRUST", FederationTrustAll)
+	if !validFederationTrust(federationTrust) {
+		log.Fatalf("Error in FEDERATION_TRUST: %s should be all, long or quorum", federationTrust)
+	}
+	federationQuorum := getVarInt("FEDERATION_QUORUM", 2)
+	federationQuorumWindow := getVarInt("FEDERATION_QUORUM_WINDOW", 24)
+	federationMaxSkew := getVarInt("FEDERATION_MAX_SKEW", 300)
+	federationMaxAttempts := getVarInt("FEDERATION_MAX_ATTEMPTS", 5)
+	if len(federationPeers) > 0 && (!identifierPattern.MatchString(federationInstance) || federationKey == nil) {
+		log.Fatalf("FEDERATION_PEERS needs FEDERATION_INSTANCE and FEDERATION_PRIVATE_KEY")
+	}
+	if federationQuorum < 1 || federationQuorumWindow < 1 || federationMaxAttempts < 1 {
+		log.Fatalf("FEDERATION_QUORUM, FEDERATION_QUORUM_WINDOW and FEDERATION_MAX_ATTEMPTS must be at least 1")
+	}
+	// GeoIP enrichment, turned on by setting either database
+	geoIPCountryDB := getVar("GEOIP_COUNTRY_DB", "")
+	geoIPASNDB := getVar("GEOIP_ASN_DB", "")
+	geoIPReloadInterval := getVarInt("GEOIP_RELOAD_INTERVAL", 5)
+	if geoIPReloadInterval < 1 {
+		log.Fatalf("GEOIP_RELOAD_INTERVAL must be at least 1")
+	}
+	highRiskCountries := []string{}
+	for _, country := range getVarList("HIGH_RISK_COUNTRIES", "") {
+		highRiskCountries = append(highRiskCountries, strings.ToUpper(country))
+	}
+	highRiskFactor := getVarFloat("HIGH_RISK_FACTOR", 0.5)
+	if highRiskFactor <= 0 || highRiskFactor > 1 {
+		log.Fatalf("HIGH_RISK_FACTOR must be more than 0 and at most 1")
+	}
+	if len(highRiskCountries) > 0 && geoIPCountryDB == "" {
+		log.Fatalf("HIGH_RISK_COUNTRIES needs GEOIP_COUNTRY_DB")
+	}
+	// hosting networks are banned on their first failures, a limit of 0 turns ASN aggregation off
+	hostingASNs, err := ParseASNs(getVarList("HOSTING_ASNS", ""))
+	if err != nil {
+		log.Fatalf("Error in HOSTING_ASNS: %s", err)
+	}
+	hostingASNLimit := getVarInt("HOSTING_ASN_LIMIT", 1)
+	hostingASNPeriod := getVarInt("HOSTING_ASN_PERIOD", 1)
+	hostingASNAction := getVarTable("HOSTING_ASN_ACTION", "short_ban")
+	asnFailureLimit := getVarInt("ASN_FAILURE_LIMIT", 0)
+	asnFailurePeriod := getVarInt("ASN_FAILURE_PERIOD", 1)
+	asnFailureAction := getVarTable("ASN_FAILURE_ACTION", "short_ban")
+	if (len(hostingASNs) > 0 || asnFailureLimit > 0) && geoIPASNDB == "" {
+		log.Fatalf("HOSTING_ASNS and ASN_FAILURE_LIMIT need GEOIP_ASN_DB")
+	}
+	if hostingASNLimit < 1 {
+		log.Fatalf("HOSTING_ASN_LIMIT must be at least 1")
+	}
+	// scoped policies only count the failures with their metadata
+	scopedPolicies, err := ParseScopedPolicies(getVar("SCOPED_POLICIES", ""), unknownUserReasons)
+	if err != nil {
+		log.Fatalf("Error in SCOPED_POLICIES: %s", err)
+	}
+	// shadow policies only record what they would ban
+	shadowPolicies, err := ParseShadowPolicies(getVar("SHADOW_POLICIES", ""), unknownUserReasons)
+	if err != nil {
+		log.Fatalf("Error in SHADOW_POLICIES: %s", err)
+	}
+	dryRun := getVarBool("DRY_RUN", false)
 
 	return EnvConfig{
 		Regions:         regions,
@@ -64,9 +418,140 @@ func GetEnvVars() EnvConfig {
 		LongTermPeriod:  longPeriod,
 		RetentionPeriod: retPeriod,
 		UpdateRate:      updateRate,
+
+		QueueDepth:      queueDepth,
+		QueueWorkers:    queueWorkers,
+		QueueRetryAfter: queueRetryAfter,
+
+		SQSQueueURL:    sqsQueueURL,
+		SQSRegion:      sqsRegion,
+		SQSWaitTime:    sqsWaitTime,
+		SQSMaxMessages: sqsMaxMessages,
+
+		SyslogUDPAddr:     syslogUDPAddr,
+		SyslogTCPAddr:     syslogTCPAddr,
+		SyslogTLSCert:     syslogTLSCert,
+		SyslogTLSKey:      syslogTLSKey,
+		SyslogPatternFile: syslogPatternFile,
+
+		TailFiles:        tailFiles,
+		TailPatternFile:  tailPatternFile,
+		TailPollInterval: tailPollInterval,
+
+		WebhookURLs:         webhookURLs,
+		WebhookEvents:       webhookEvents,
+		WebhookSecret:       webhookSecret,
+		WebhookMaxAttempts:  webhookMaxAttempts,
+		WebhookPollInterval: webhookPollInterval,
+
+		ShadowPolicies: shadowPolicies,
+		DryRun:         dryRun,
+
+		UsernamesPerIPLimit:  usernamesPerIPLimit,
+		UsernamesPerIPPeriod: usernamesPerIPPeriod,
+		UsernamesPerIPAction: usernamesPerIPAction,
+		IPsPerUsernameLimit:  ipsPerUsernameLimit,
+		IPsPerUsernamePeriod: ipsPerUsernamePeriod,
+		IPsPerUsernameAction: ipsPerUsernameAction,
+		UnknownUserLimit:     unknownUserLimit,
+		UnknownUserPeriod:    unknownUserPeriod,
+		UnknownUserAction:    unknownUserAction,
+		UnknownUserReasons:   unknownUserReasons,
+
+		PasswordSprayLimit:  passwordSprayLimit,
+		PasswordSprayPeriod: passwordSprayPeriod,
+		PasswordSprayAction: passwordSprayAction,
+
+		Pepper: pepper,
+
+		ReasonWeights: reasonWeights,
+
+		SuccessAction:        successAction,
+		SuccessPolicyActions: successPolicyActions,
+		TrustPeriod:          trustPeriod,
+
+		ExemptionMaxHours: exemptionMaxHours,
+		TrustedProxies:    trustedProxies,
+
+		CloudflareAPIURL:           cloudflareAPIURL,
+		CloudflareAPIToken:         cloudflareAPIToken,
+		CloudflareAccountID:        cloudflareAccountID,
+		CloudflareListID:           cloudflareListID,
+		CloudflareOperationTimeout: cloudflareOperationTimeout,
+
+		DenyFilePath:          denyFilePath,
+		DenyFileFormat:        denyFileFormat,
+		DenyFileReloadCommand: denyFileReloadCommand,
+		DenyFilePidFile:       denyFilePidFile,
+		DenyFileSignal:        denyFileSignal,
+
+		FirewallBackend:   firewallBackend,
+		FirewallNftFamily: firewallNftFamily,
+		FirewallNftTable:  firewallNftTable,
+		FirewallSetV4:     firewallSetV4,
+		FirewallSetV6:     firewallSetV6,
+
+		AzureWAFType:        azureWAFType,
+		AzureTenantID:       azureTenantID,
+		AzureClientID:       azureClientID,
+		AzureClientSecret:   azureClientSecret,
+		AzureSubscriptionID: azureSubscriptionID,
+		AzureResourceGroup:  azureResourceGroup,
+		AzurePolicyName:     azurePolicyName,
+		AzureAPIVersion:     azureAPIVersion,
+		AzureLoginURL:       azureLoginURL,
+		AzureManagementURL:  azureManagementURL,
+		AzureRulePrefix:     azureRulePrefix,
+		AzureRulePriority:   azureRulePriority,
+		AzureIPsPerRule:     azureIPsPerRule,
+		AzureMaxRules:       azureMaxRules,
+
+		GCPSecurityPolicy:   gcpSecurityPolicy,
+		GCPProject:          gcpProject,
+		GCPCredentialsFile:  gcpCredentialsFile,
+		GCPAPIURL:           gcpAPIURL,
+		GCPMetadataURL:      gcpMetadataURL,
+		GCPDenyAction:       gcpDenyAction,
+		GCPRulePriority:     gcpRulePriority,
+		GCPIPsPerRule:       gcpIPsPerRule,
+		GCPMaxRules:         gcpMaxRules,
+		GCPOperationTimeout: gcpOperationTimeout,
+
+		IntelFeeds:       intelFeeds,
+		IntelRefreshRate: intelRefreshRate,
+		IntelMaxAge:      intelMaxAge,
+		AllowList:        allowList,
+
+		FederationInstance:     federationInstance,
+		FederationKey:          federationKey,
+		FederationPeers:        federationPeers,
+		FederationTrust:        federationTrust,
+		FederationQuorum:       federationQuorum,
+		FederationQuorumWindow: federationQuorumWindow,
+		FederationMaxSkew:      federationMaxSkew,
+		FederationMaxAttempts:  federationMaxAttempts,
+
+		GeoIPCountryDB:      geoIPCountryDB,
+		GeoIPASNDB:          geoIPASNDB,
+		GeoIPReloadInterval: geoIPReloadInterval,
+		HighRiskCountries:   highRiskCountries,
+		HighRiskFactor:      highRiskFactor,
+		HostingASNs:         hostingASNs,
+		HostingASNLimit:     hostingASNLimit,
+		HostingASNPeriod:    hostingASNPeriod,
+		HostingASNAction:    hostingASNAction,
+		ASNFailureLimit:     asnFailureLimit,
+		ASNFailurePeriod:    asnFailurePeriod,
+		ASNFailureAction:    asnFailureAction,
+
+		ScopedPolicies: scopedPolicies,
 	}
 }
 
+// identifierPattern is what names that are stored or exported as labels have to look like:
+// intel feed names, the federation instance and metadata label keys
+var identifierPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
 func getVar(varname, defaultVal string) string {
 	envvar := os.Getenv(varname)
 	if envvar == "" {
@@ -75,6 +560,37 @@ func getVar(varname, defaultVal string) string {
 	return envvar
 }
 
+// getVarList splits a comma separated variable, dropping empty entries
+func getVarList(varname, defaultVal string) []string {
+	list := []string{}
+	for _, item := range strings.Split(getVar(varname, defaultVal), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getVarTable reads the name of a ban table
+func getVarTable(varname, defaultVal string) string {
+	table := getVar(varname, defaultVal)
+	if !validTable(table) {
+		log.Fatalf("Error in environmental variable %s: %s is not short_ban or long_ban", varname, table)
+	}
+	return table
+}
+
+func getVarBool(varname string, defaultVal bool) bool {
+	envvar := getVar(varname, strconv.FormatBool(defaultVal))
+	b, err := strconv.ParseBool(envvar)
+	if err == nil {
+		return b
+	}
+	log.Fatalf("Error in converting environmental variable to a boolean: %s", err)
+	return false
+}
+
 func getVarInt(varname string, defaultVal int) int {
 	envvar := getVar(varname, strconv.Itoa(defaultVal))
 	n, err := strconv.Atoi(envvar)
@@ -84,3 +600,13 @@ func getVarInt(varname string, defaultVal int) int {
 	log.Fatalf("Error in converting environmental variable to an integer: %s", err)
 	return -1
 }
+
+func getVarFloat(varname string, defaultVal float64) float64 {
+	envvar := getVar(varname, strconv.FormatFloat(defaultVal, 'f', -1, 64))
+	f, err := strconv.ParseFloat(envvar, 64)
+	if err == nil {
+		return f
+	}
+	log.Fatalf("Error in converting environmental variable to a number: %s", err)
+	return -1
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Ban event types
+const (
+	EventBanCreated   = "ban-created"
+	EventBanEscalated = "ban-escalated"
+	EventBanExpired   = "ban-expired"
+	EventIPUnblocked  = "ip-unblocked"
+	EventWAFSync      = "waf-sync"
+)
+
+// BanEvent describes a change to the set of banned IPs, or a sync of that set to the WAF
+type BanEvent struct {
+	Type  string    `json:"type"`
+	IP    string    `json:"ip,omitempty"`
+	Table string    `json:"table,omitempty"`
+	Ts    time.Time `json:"ts"`
+	// only set for waf-sync events
+	Region string `json:"region,omitempty"`
+	Count  int    `json:"count,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// the federation peer that reported a ban, empty for autowaf's own
+	Origin string `json:"origin,omitempty"`
+}
+
+// EventBus fans events out to every subscriber. Publishing never blocks, a
+// subscriber that falls behind misses events rather than holding up bans.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan BanEvent]struct{}
+	dropped     *Counter
+}
+
+// NewEventBus creates an event bus with no subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan BanEvent]struct{}),
+		dropped:     RegisterCounter("autowaf_events_dropped_total", "Events a slow subscriber missed"),
+	}
+}
+
+// Subscribe returns a channel that receives every event published from now on
+func (b *EventBus) Subscribe(buffer int) chan BanEvent {
+	ch := make(chan BanEvent, buffer)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe stops sending events to ch and closes it
+func (b *EventBus) Unsubscribe(ch chan BanEvent) {
+	b.mu.Lock()
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+	b.mu.Unlock()
+}
+
+// Publish sends event to every subscriber that has room for it
+func (b *EventBus) Publish(event BanEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			b.dropped.Inc()
+		}
+	}
+}
+
+var eventBus = NewEventBus()
+
+// emitBanEvent hands event to everything that wants to know about ban changes
+func emitBanEvent(event BanEvent) {
+	if len(envConfig.WebhookURLs) > 0 {
+		QueueWebhookEvent(db, &envConfig, event)
+	}
+	eventBus.Publish(event)
+}
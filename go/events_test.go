@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBusFanOut(t *testing.T) {
+	bus := NewEventBus()
+	first := bus.Subscribe(1)
+	second := bus.Subscribe(1)
+	bus.Publish(BanEvent{Type: EventBanCreated, IP: "192.168.1.1"})
+	if (<-first).IP != "192.168.1.1" || (<-second).IP != "192.168.1.1" {
+		t.Log("Every subscriber should get the event")
+		t.Fail()
+	}
+	bus.Unsubscribe(second)
+	if _, open := <-second; open {
+		t.Log("Unsubscribing should close the channel")
+		t.Fail()
+	}
+	bus.Publish(BanEvent{Type: EventBanExpired, IP: "192.168.1.1"})
+	if (<-first).Type != EventBanExpired {
+		t.Log("Remaining subscribers should still get events")
+		t.Fail()
+	}
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	bus := NewEventBus()
+	slow := bus.Subscribe(1)
+	done := make(chan struct{})
+	go func() {
+		// the second publish has nowhere to go, it mustn't block
+		bus.Publish(BanEvent{Type: EventBanCreated, IP: "192.168.1.1"})
+		bus.Publish(BanEvent{Type: EventBanCreated, IP: "192.168.1.2"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Log("Publish blocked on a slow subscriber")
+		t.FailNow()
+	}
+	if (<-slow).IP != "192.168.1.1" {
+		t.Log("The first event should have been delivered")
+		t.Fail()
+	}
+}
+
+func TestEventStreamWriter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(eventStreamWriter))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"?types="+EventIPUnblocked, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Logf("Unexpected content type: %s", resp.Header.Get("Content-Type"))
+		t.Fail()
+	}
+	// filtered out by the types parameter
+	eventBus.Publish(BanEvent{Type: EventBanCreated, IP: "192.168.1.1"})
+	eventBus.Publish(BanEvent{Type: EventIPUnblocked, IP: "192.168.1.2"})
+
+	reader := bufio.NewReader(resp.Body)
+	eventLine, _ := reader.ReadString('\n')
+	dataLine, _ := reader.ReadString('\n')
+	if eventLine != "event: ip-unblocked\n" {
+		t.Logf("Unexpected event line: %q", eventLine)
+		t.Fail()
+	}
+	if !strings.Contains(dataLine, `"ip":"192.168.1.2"`) {
+		t.Logf("Unexpected data line: %q", dataLine)
+		t.Fail()
+	}
+}
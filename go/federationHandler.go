@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Federation trust policies
+const (
+	// FederationTrustAll accepts every ban a peer reports
+	FederationTrustAll = "all"
+	// FederationTrustLong only accepts long term bans
+	FederationTrustLong = "long"
+	// FederationTrustQuorum only bans once enough peers have reported the IP
+	FederationTrustQuorum = "quorum"
+)
+
+const federationSignaturePrefix = "ed25519="
+
+// the most a peer can send in one event
+const federationMaxBody = 4096
+
+// Federation verification errors
+var (
+	ErrFederationUnknownPeer = errors.New("unknown federation peer")
+	ErrFederationSignature   = errors.New("bad federation signature")
+	ErrFederationStale       = errors.New("federation event is too old or in the future")
+	ErrFederationInvalid     = errors.New("invalid federation event")
+	ErrFederationReplayed    = errors.New("federation event was already received")
+)
+
+// FederationPeer is another autowaf instance bans are shared with
+type FederationPeer struct {
+	Name string
+	// URL is where the peer receives events, empty for a peer that's only listened to
+	URL string
+	Key ed25519.PublicKey
+}
+
+// FederationEvent is a ban sent to a peer. ID is random, and a peer only accepts an ID from an
+// origin once while the event is inside the skew window, so a captured event can't be replayed.
+type FederationEvent struct {
+	ID     string    `json:"id"`
+	Origin string    `json:"origin"`
+	IP     string    `json:"ip"`
+	Table  string    `json:"table"`
+	Ts     time.Time `json:"ts"`
+}
+
+// ParseFederationKey decodes a base64 ed25519 private key, either the 32 byte seed or the
+// 64 byte key
+func ParseFederationKey(value string) (ed25519.PrivateKey, error) {
+	if value == "" {
+		return nil, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	}
+	return nil, fmt.Errorf("key is %d bytes, it should be %d or %d", len(raw), ed25519.SeedSize, ed25519.PrivateKeySize)
+}
+
+// ParseFederationPeers parses a comma separated list of name|url|publickey peers
+func ParseFederationPeers(value string) ([]FederationPeer, error) {
+	peers := []FederationPeer{}
+	seen := map[string]bool{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, "|")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%s should be name|url|publickey", item)
+		}
+		if !identifierPattern.MatchString(parts[0]) {
+			return nil, fmt.Errorf("peer name %s should be up to 64 letters, digits, '_', '.' or '-'", parts[0])
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("peer name %s is used twice", parts[0])
+		}
+		seen[parts[0]] = true
+		key, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("public key of peer %s isn't a base64 ed25519 key", parts[0])
+		}
+		peers = append(peers, FederationPeer{Name: parts[0], URL: parts[1], Key: ed25519.PublicKey(key)})
+	}
+	return peers, nil
+}
+
+// validFederationTrust checks trust is one of the trust policies
+func validFederationTrust(trust string) bool {
+	return trust == FederationTrustAll || trust == FederationTrustLong || trust == FederationTrustQuorum
+}
+
+// SignFederationEvent returns the X-Autowaf-Signature header for body
+func SignFederationEvent(key ed25519.PrivateKey, body []byte) string {
+	return federationSignaturePrefix + base64.StdEncoding.EncodeToString(ed25519.Sign(key, body))
+}
+
+// VerifyFederationEvent checks body was signed by origin, a known peer, and is recent, and returns the event
+func VerifyFederationEvent(peers []FederationPeer, origin string, signature string, body []byte, now time.Time,
+	maxSkew time.Duration) (*FederationEvent, error) {
+	var peer *FederationPeer
+	for i := range peers {
+		if peers[i].Name == origin {
+			peer = &peers[i]
+		}
+	}
+	if peer == nil {
+		return nil, ErrFederationUnknownPeer
+	}
+	if !strings.HasPrefix(signature, federationSignaturePrefix) {
+		return nil, ErrFederationSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(signature, federationSignaturePrefix))
+	if err != nil || !ed25519.Verify(peer.Key, body, sig) {
+		return nil, ErrFederationSignature
+	}
+	var event FederationEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, ErrFederationInvalid
+	}
+	// the origin is signed too, so one peer can't pass off another's events
+	if event.Origin != origin || !identifierPattern.MatchString(event.ID) || net.ParseIP(event.IP) == nil ||
+		!validTable(event.Table) {
+		return nil, ErrFederationInvalid
+	}
+	if event.Ts.Before(now.Add(-maxSkew)) || event.Ts.After(now.Add(maxSkew)) {
+		return nil, ErrFederationStale
+	}
+	return &event, nil
+}
+
+// ApplyFederationEvent bans the event's IP if the trust policy accepts it, returning the table
+// it was banned in, or "" when it wasn't
+func ApplyFederationEvent(db *sql.DB, envconf *EnvConfig, event *FederationEvent) (string, error) {
+	switch envconf.FederationTrust {
+	case FederationTrustLong:
+		if event.Table != "long_ban" {
+			return "", nil
+		}
+	case FederationTrustQuorum:
+		reports, longReports, err := RecordFederationReport(db, event.IP, event.Origin, event.Table, event.Ts,
+			envconf.FederationQuorumWindow)
+		if err != nil {
+			return "", err
+		}
+		if reports < envconf.FederationQuorum {
+			return "", nil
+		}
+		// it's only a long term ban when enough peers say so
+		table := "short_ban"
+		if longReports >= envconf.FederationQuorum {
+			table = "long_ban"
+		}
+		return table, InsertFederatedBan(db, event.IP, table, event.Origin, event.Ts)
+	}
+	return event.Table, InsertFederatedBan(db, event.IP, event.Table, event.Origin, event.Ts)
+}
+
+// federationPeerLabel is the peer label of a metric for an event from origin. The origin header
+// isn't authenticated, so anything that isn't a configured peer is "unknown" rather than a new label.
+func federationPeerLabel(peers []FederationPeer, origin string) string {
+	for _, peer := range peers {
+		if peer.Name == origin {
+			return origin
+		}
+	}
+	return "unknown"
+}
+
+// federationEventWriter receives a ban from a peer
+func federationEventWriter(w http.ResponseWriter, r *http.Request) {
+	if len(envConfig.FederationPeers) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, federationMaxBody))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	origin := r.Header.Get("X-Autowaf-Origin")
+	event, err := VerifyFederationEvent(envConfig.FederationPeers, origin, r.Header.Get("X-Autowaf-Signature"), body,
+		time.Now(), time.Duration(envConfig.FederationMaxSkew)*time.Second)
+	if err != nil {
+		RegisterCounter("autowaf_federation_rejected_total", "Federation events that failed verification",
+			"peer", federationPeerLabel(envConfig.FederationPeers, origin)).Inc()
+		log.Warn().Str("Error", err.Error()).Str("Peer", origin).Str("Source", requestSourceIP(r)).Msg("Rejected federation event")
+		if err == ErrFederationInvalid || err == ErrFederationStale {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		} else {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		return
+	}
+	maxSkew := time.Duration(envConfig.FederationMaxSkew) * time.Second
+	claimed, err := RecordFederationEventID(db, origin, event.ID, event.Ts.Add(maxSkew))
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Str("Peer", origin).Msg("Error recording federation event id")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		RegisterCounter("autowaf_federation_rejected_total", "Federation events that failed verification",
+			"peer", origin).Inc()
+		log.Warn().Str("Error", ErrFederationReplayed.Error()).Str("Peer", origin).Str("ID", event.ID).
+			Str("Source", requestSourceIP(r)).Msg("Rejected federation event")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	RegisterCounter("autowaf_federation_received_total", "Federation events received", "peer", origin).Inc()
+	table, err := ApplyFederationEvent(db, &envConfig, event)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Str("Peer", origin).Str("IP", event.IP).Msg("Error applying federation event")
+		ForgetFederationEventID(db, origin, event.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if table == "" {
+		log.Debug().Str("Peer", origin).Str("IP", event.IP).Str("Trust", envConfig.FederationTrust).Msg("Federation event not trusted enough to ban")
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// SendFederationEvent posts a signed event to peer. A Conflict means the peer already has the
+// event, so it counts as delivered.
+func SendFederationEvent(poster WebhookPoster, peer FederationPeer, origin string, body []byte, signature string) error {
+	req, err := http.NewRequest("POST", peer.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Autowaf-Origin", origin)
+	req.Header.Set("X-Autowaf-Signature", signature)
+	resp, err := poster(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if (resp.StatusCode < 200 || resp.StatusCode > 299) && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("Peer returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// federationRetry is an event waiting to be sent to a peer
+type federationRetry struct {
+	body      []byte
+	signature string
+	attempts  int
+	due       time.Time
+}
+
+// federationPeerSender delivers events to one peer. A failed send is retried after backoff
+// without holding up the queue: events wait in a pending list of at most maxPending, and while
+// the peer is failing nothing is sent to it until the failed event's retry is due. Events that
+// don't fit or run out of attempts are counted in dropped.
+func federationPeerSender(poster WebhookPoster, peer FederationPeer, origin string, queue chan []byte,
+	key ed25519.PrivateKey, maxAttempts int, maxPending int, backoff func(int) time.Duration, dropped *Counter) {
+	pending := []federationRetry{}
+	var blockedUntil time.Time
+	for {
+		var wake <-chan time.Time
+		if len(pending) > 0 {
+			next := pending[0].due
+			for _, retry := range pending {
+				if retry.due.Before(next) {
+					next = retry.due
+				}
+			}
+			if blockedUntil.After(next) {
+				next = blockedUntil
+			}
+			wake = time.After(time.Until(next))
+		}
+		select {
+		case body, ok := <-queue:
+			if !ok {
+				return
+			}
+			if len(pending) >= maxPending {
+				log.Warn().Str("Peer", peer.Name).Msg("Too many federation events waiting for the peer, dropping the oldest")
+				dropped.Inc()
+				pending = pending[1:]
+			}
+			pending = append(pending, federationRetry{body: body, signature: SignFederationEvent(key, body), due: time.Now()})
+		case <-wake:
+		}
+		if time.Now().Before(blockedUntil) {
+			continue
+		}
+		kept := pending[:0]
+		failed := false
+		for _, retry := range pending {
+			if failed || retry.due.After(time.Now()) {
+				kept = append(kept, retry)
+				continue
+			}
+			err := SendFederationEvent(poster, peer, origin, retry.body, retry.signature)
+			if err == nil {
+				continue
+			}
+			retry.attempts++
+			log.Warn().Str("Error", err.Error()).Str("Peer", peer.Name).Int("Attempts", retry.attempts).Msg("Error sending federation event")
+			if retry.attempts >= maxAttempts {
+				log.Error().Str("Peer", peer.Name).Msg("Giving up on federation event")
+				dropped.Inc()
+				continue
+			}
+			retry.due = time.Now().Add(backoff(retry.attempts))
+			// the peer is probably down, so leave the rest until this one is retried
+			blockedUntil = retry.due
+			failed = true
+			kept = append(kept, retry)
+		}
+		pending = kept
+	}
+}
+
+// startFederation passes autowaf's own new bans on to the peers that have a URL. Bans that
+// came from a peer aren't passed on, so events don't loop between instances.
+func startFederation(envconf *EnvConfig) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	queues := []chan []byte{}
+	dropped := []*Counter{}
+	for _, peer := range envconf.FederationPeers {
+		if peer.URL == "" {
+			continue
+		}
+		queue := make(chan []byte, 1000)
+		queues = append(queues, queue)
+		peerDropped := RegisterCounter("autowaf_federation_dropped_total", "Federation events that were never delivered to the peer",
+			"peer", peer.Name)
+		dropped = append(dropped, peerDropped)
+		go federationPeerSender(client.Do, peer, envconf.FederationInstance, queue, envconf.FederationKey,
+			envconf.FederationMaxAttempts, 1000, WebhookBackoff, peerDropped)
+	}
+	if len(queues) == 0 {
+		return
+	}
+	events := eventBus.Subscribe(1000)
+	go func() {
+		for event := range events {
+			if event.Origin != "" || (event.Type != EventBanCreated && event.Type != EventBanEscalated) {
+				continue
+			}
+			body, err := json.Marshal(FederationEvent{ID: newFederationEventID(), Origin: envconf.FederationInstance,
+				IP: event.IP, Table: event.Table, Ts: event.Ts})
+			if err != nil {
+				continue
+			}
+			for i, queue := range queues {
+				select {
+				case queue <- body:
+				default:
+					log.Warn().Str("IP", event.IP).Msg("Federation queue is full, dropping event")
+					dropped[i].Inc()
+				}
+			}
+		}
+	}()
+}
+
+// newFederationEventID returns a random event id
+func newFederationEventID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// runKeygen prints a new federation key pair
+func runKeygen() {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal().Str("Error", err.Error()).Msg("Error generating key")
+	}
+	fmt.Printf("FEDERATION_PRIVATE_KEY=%s\n", base64.StdEncoding.EncodeToString(private.Seed()))
+	fmt.Printf("public key for peers: %s\n", base64.StdEncoding.EncodeToString(public))
+}
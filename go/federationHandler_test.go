@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testFederationKeys makes a key from a fixed seed, and the peer entry for it
+func testFederationKeys(name string, seed byte) (ed25519.PrivateKey, FederationPeer) {
+	key := ed25519.NewKeyFromSeed([]byte(strings.Repeat(string([]byte{seed}), ed25519.SeedSize)))
+	return key, FederationPeer{Name: name, Key: key.Public().(ed25519.PublicKey)}
+}
+
+func TestParseFederationPeers(t *testing.T) {
+	_, peer := testFederationKeys("retail", 1)
+	encoded := base64.StdEncoding.EncodeToString(peer.Key)
+	peers, err := ParseFederationPeers("retail|https://autowaf.retail.example.com/federation/events|" + encoded +
+		", audit||" + encoded)
+	if err != nil || len(peers) != 2 || peers[0].URL != "https://autowaf.retail.example.com/federation/events" ||
+		peers[1].URL != "" || !peers[1].Key.Equal(peer.Key) {
+		t.Logf("Unexpected peers: %v (err: %v)", peers, err)
+		t.Fail()
+	}
+	for _, bad := range []string{"retail|url", "retail|url|notakey", "a|x|" + encoded + ",a|y|" + encoded} {
+		if _, err := ParseFederationPeers(bad); err == nil {
+			t.Logf("Expected an error for %s", bad)
+			t.Fail()
+		}
+	}
+	key, err := ParseFederationKey(base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		t.Logf("Expected a key from the seed (err: %v)", err)
+		t.Fail()
+	}
+	if _, err := ParseFederationKey(base64.StdEncoding.EncodeToString(make([]byte, 16))); err == nil {
+		t.Logf("Expected an error for a short key")
+		t.Fail()
+	}
+}
+
+func TestVerifyFederationEvent(t *testing.T) {
+	key, peer := testFederationKeys("retail", 1)
+	otherKey, other := testFederationKeys("payments", 2)
+	peers := []FederationPeer{peer, other}
+	now := time.Date(2021, 11, 1, 10, 0, 0, 0, time.UTC)
+	body, _ := json.Marshal(FederationEvent{ID: "e1", Origin: "retail", IP: "192.168.1.1", Table: "long_ban", Ts: now})
+
+	event, err := VerifyFederationEvent(peers, "retail", SignFederationEvent(key, body), body, now, 5*time.Minute)
+	if err != nil || event.IP != "192.168.1.1" || event.Table != "long_ban" {
+		t.Logf("Expected the event to verify: %v (err: %v)", event, err)
+		t.Fail()
+	}
+	cases := []struct {
+		name     string
+		origin   string
+		sig      string
+		now      time.Time
+		expected error
+	}{
+		{"unknown peer", "nobody", SignFederationEvent(key, body), now, ErrFederationUnknownPeer},
+		{"signed by someone else", "retail", SignFederationEvent(otherKey, body), now, ErrFederationSignature},
+		{"claims to be someone else", "payments", SignFederationEvent(otherKey, body), now, ErrFederationInvalid},
+		{"no signature", "retail", "", now, ErrFederationSignature},
+		{"old", "retail", SignFederationEvent(key, body), now.Add(time.Hour), ErrFederationStale},
+	}
+	for _, c := range cases {
+		if _, err := VerifyFederationEvent(peers, c.origin, c.sig, body, c.now, 5*time.Minute); err != c.expected {
+			t.Logf("%s: expected %v, got %v", c.name, c.expected, err)
+			t.Fail()
+		}
+	}
+	for _, bad := range []FederationEvent{
+		{ID: "e1", Origin: "retail", IP: "192.168.1.1", Table: "users", Ts: now},
+		// the id is what stops replays, so it has to be there
+		{Origin: "retail", IP: "192.168.1.1", Table: "long_ban", Ts: now},
+	} {
+		body, _ := json.Marshal(bad)
+		if _, err := VerifyFederationEvent(peers, "retail", SignFederationEvent(key, body), body, now, 5*time.Minute); err != ErrFederationInvalid {
+			t.Logf("Expected ErrFederationInvalid for %v, got %v", bad, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestSendFederationEvent(t *testing.T) {
+	key, peer := testFederationKeys("retail", 1)
+	now := time.Now().UTC()
+	var verifyErr error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, verifyErr = VerifyFederationEvent([]FederationPeer{peer}, r.Header.Get("X-Autowaf-Origin"),
+			r.Header.Get("X-Autowaf-Signature"), body, time.Now(), time.Minute)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	peer.URL = server.URL
+	body, _ := json.Marshal(FederationEvent{ID: "e1", Origin: "retail", IP: "192.168.1.1", Table: "short_ban", Ts: now})
+	err := SendFederationEvent(http.DefaultClient.Do, peer, "retail", body, SignFederationEvent(key, body))
+	if err != nil || verifyErr != nil {
+		t.Logf("Expected the peer to accept the event (err: %v, verify: %v)", err, verifyErr)
+		t.Fail()
+	}
+}
+
+// fakeFederationPeer answers with the next of statuses, then 202, and records the bodies it accepted
+type fakeFederationPeer struct {
+	mu       sync.Mutex
+	statuses []int
+	accepted []string
+}
+
+func (f *fakeFederationPeer) post(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := http.StatusAccepted
+	if len(f.statuses) > 0 {
+		status, f.statuses = f.statuses[0], f.statuses[1:]
+	}
+	if status == http.StatusAccepted || status == http.StatusConflict {
+		body, _ := ioutil.ReadAll(req.Body)
+		f.accepted = append(f.accepted, string(body))
+	}
+	return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func (f *fakeFederationPeer) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.accepted)
+}
+
+func TestFederationPeerSenderRetries(t *testing.T) {
+	key, peer := testFederationKeys("retail", 1)
+	// the peer is down for the first two sends, then has the third event already
+	fake := &fakeFederationPeer{statuses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusAccepted,
+		http.StatusAccepted, http.StatusConflict}}
+	queue := make(chan []byte, 10)
+	dropped := &Counter{}
+	go federationPeerSender(fake.post, peer, "retail", queue, key, 5, 10,
+		func(int) time.Duration { return 10 * time.Millisecond }, dropped)
+	defer close(queue)
+	// the queue keeps being read while the first event waits for its retry
+	for _, body := range []string{"one", "two", "three"} {
+		select {
+		case queue <- []byte(body):
+		case <-time.After(time.Second):
+			t.Logf("The queue is blocked")
+			t.FailNow()
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for fake.count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if fake.count() != 3 || dropped.Value() != 0 {
+		t.Logf("Expected all 3 events delivered, got %v with %v dropped", fake.accepted, dropped.Value())
+		t.Fail()
+	}
+}
+
+func TestFederationPeerSenderDrops(t *testing.T) {
+	key, peer := testFederationKeys("retail", 1)
+	fake := &fakeFederationPeer{statuses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}}
+	queue := make(chan []byte, 10)
+	dropped := &Counter{}
+	// one attempt each, and only one event can wait
+	go federationPeerSender(fake.post, peer, "retail", queue, key, 1, 1,
+		func(int) time.Duration { return time.Hour }, dropped)
+	defer close(queue)
+	queue <- []byte("one")
+	queue <- []byte("two")
+	queue <- []byte("three")
+	deadline := time.Now().Add(5 * time.Second)
+	for dropped.Value() < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if dropped.Value() < 1 || fake.count() != 0 {
+		t.Logf("Expected events to be dropped, got %v dropped and %v delivered", dropped.Value(), fake.accepted)
+		t.Fail()
+	}
+}
+
+func TestApplyFederationEventLongOnly(t *testing.T) {
+	// a short term ban isn't trusted, so the database isn't touched
+	envconf := &EnvConfig{FederationTrust: FederationTrustLong}
+	table, err := ApplyFederationEvent(nil, envconf, &FederationEvent{ID: "e1", Origin: "retail", IP: "192.168.1.1", Table: "short_ban"})
+	if err != nil || table != "" {
+		t.Logf("Expected the short term ban to be ignored, got %s (err: %v)", table, err)
+		t.Fail()
+	}
+}
+
+func TestFederationEventWriterRejects(t *testing.T) {
+	_, peer := testFederationKeys("retail", 1)
+	envConfig.FederationPeers = []FederationPeer{peer}
+	envConfig.FederationMaxSkew = 300
+	defer func() { envConfig.FederationPeers = nil }()
+	body := `{"id": "e1", "origin": "retail", "ip": "192.168.1.1", "table": "long_ban", "ts": "2021-11-01T10:00:00Z"}`
+	r := httptest.NewRequest("POST", "/federation/events", strings.NewReader(body))
+	r.Header.Set("X-Autowaf-Origin", "retail")
+	r.Header.Set("X-Autowaf-Signature", "ed25519=AAAA")
+	w := httptest.NewRecorder()
+	federationEventWriter(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Logf("Expected 401 for a bad signature, got %d", w.Code)
+		t.Fail()
+	}
+	// a made up origin doesn't get a label of its own
+	if label := federationPeerLabel(envConfig.FederationPeers, "made-up"); label != "unknown" {
+		t.Logf("Expected an unknown peer, got %s", label)
+		t.Fail()
+	}
+	if label := federationPeerLabel(envConfig.FederationPeers, "retail"); label != "retail" {
+		t.Logf("Expected retail, got %s", label)
+		t.Fail()
+	}
+}
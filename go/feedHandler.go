@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Blocklist feed formats
+const (
+	FeedFormatText = "text"
+	FeedFormatJSON = "json"
+	FeedFormatCSV  = "csv"
+	FeedFormatSTIX = "stix"
+)
+
+// the content type each format is served as
+var feedContentTypes = map[string]string{
+	FeedFormatText: "text/plain; charset=utf-8",
+	FeedFormatJSON: "application/json",
+	FeedFormatCSV:  "text/csv; charset=utf-8",
+	FeedFormatSTIX: "application/stix+json;version=2.1",
+}
+
+// stixNamespace is the namespace the feed's STIX ids are made in, so an address always gets the same id
+var stixNamespace = [16]byte{0x6b, 0x1f, 0x3e, 0x52, 0x0c, 0x8d, 0x4a, 0x1e, 0x9b, 0x57, 0x2d, 0x60, 0xa4, 0x13, 0xc8, 0x7f}
+
+// stixIdentityCreated is when the feed's STIX identity was made, it doesn't change
+var stixIdentityCreated = time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+
+// feedHash is the hash of entries, which changes whenever an entry is added, extended or removed
+func feedHash(entries []BanEntry) string {
+	sum := sha256.New()
+	for _, entry := range entries {
+		fmt.Fprintf(sum, "%s %d\n", entry.CIDR, entry.Expires.Unix())
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// BlockListFeed serves the blocklist. changed records the hash of the list being served and
+// returns when the list last changed, for Last-Modified.
+type BlockListFeed struct {
+	changed func(hash string, now time.Time) (time.Time, error)
+}
+
+// the feed served at /feed/blocklist, which keeps its version in the database so every
+// instance gives the same Last-Modified
+var blockListFeed = &BlockListFeed{changed: func(hash string, now time.Time) (time.Time, error) {
+	return FeedChanged(db, hash, now)
+}}
+
+// feedFormat picks the format from the format parameter, or else the Accept header
+func feedFormat(r *http.Request) (string, bool) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		_, ok := feedContentTypes[format]
+		return format, ok
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/stix+json"):
+		return FeedFormatSTIX, true
+	case strings.Contains(accept, "application/json"):
+		return FeedFormatJSON, true
+	case strings.Contains(accept, "text/csv"):
+		return FeedFormatCSV, true
+	}
+	return FeedFormatText, true
+}
+
+// etagMatches is true when the If-None-Match header lists etag
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// stixID makes a UUIDv5 STIX id for name
+func stixID(kind string, name string) string {
+	sum := sha1.Sum(append(stixNamespace[:], []byte(name)...))
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%s--%x-%x-%x-%x-%x", kind, sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// stixTime formats t the way STIX timestamps are written
+func stixTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// stixBundle makes a STIX 2.1 bundle with an indicator for each entry. The bundle's id comes
+// from the list's hash, so the same list is always the same bundle.
+func stixBundle(entries []BanEntry, hash string) map[string]interface{} {
+	identityID := stixID("identity", "autowaf")
+	objects := []interface{}{map[string]interface{}{
+		"type":           "identity",
+		"spec_version":   "2.1",
+		"id":             identityID,
+		"created":        stixTime(stixIdentityCreated),
+		"modified":       stixTime(stixIdentityCreated),
+		"name":           "autowaf",
+		"identity_class": "system",
+	}}
+	for _, entry := range entries {
+		kind := "ipv4-addr"
+		if network := entryNetwork(entry); network != nil && network.IP.To4() == nil {
+			kind = "ipv6-addr"
+		}
+		objects = append(objects, map[string]interface{}{
+			"type":            "indicator",
+			"spec_version":    "2.1",
+			"id":              stixID("indicator", entry.CIDR),
+			"created_by_ref":  identityID,
+			"created":         stixTime(entry.Added),
+			"modified":        stixTime(entry.Added),
+			"name":            "autowaf ban " + entry.CIDR,
+			"indicator_types": []string{"malicious-activity"},
+			"pattern":         fmt.Sprintf("[%s:value = '%s']", kind, entry.CIDR),
+			"pattern_type":    "stix",
+			"valid_from":      stixTime(entry.Added),
+			"valid_until":     stixTime(entry.Expires),
+		})
+	}
+	return map[string]interface{}{
+		"type":    "bundle",
+		"id":      stixID("bundle", hash),
+		"objects": objects,
+	}
+}
+
+// feedEntry is a ban in the JSON feed
+type feedEntry struct {
+	IP      string    `json:"ip"`
+	CIDR    string    `json:"cidr"`
+	Added   time.Time `json:"added"`
+	Expires time.Time `json:"expires"`
+	Source  string    `json:"source,omitempty"`
+}
+
+// blockListFeedWriter serves the current blocklist for firewalls that pull it rather than
+// having it pushed
+func blockListFeedWriter(w http.ResponseWriter, r *http.Request) {
+	blockListFeed.serve(w, r, currentBanList(db), time.Now())
+}
+
+// serve writes entries in the requested format, or Not Modified if the client has them already.
+// Without a Last-Modified, If-Modified-Since is ignored and only the ETag can give Not Modified.
+func (f *BlockListFeed) serve(w http.ResponseWriter, r *http.Request, entries []BanEntry, now time.Time) {
+	format, ok := feedFormat(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	hash := feedHash(entries)
+	modified, err := f.changed(hash, now)
+	if err != nil {
+		log.Warn().Str("Error", err.Error()).Msg("Error recording the blocklist feed's version")
+		modified = time.Time{}
+	}
+	// Last-Modified only has whole seconds
+	modified = modified.UTC().Truncate(time.Second)
+	etag := fmt.Sprintf("\"%s-%s\"", hash[:32], format)
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Vary", "Accept")
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.IsZero() &&
+		!modified.After(ims) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", feedContentTypes[format])
+	w.WriteHeader(http.StatusOK)
+	switch format {
+	case FeedFormatJSON:
+		feed := struct {
+			Generated time.Time   `json:"generated"`
+			Count     int         `json:"count"`
+			Entries   []feedEntry `json:"entries"`
+		}{Generated: modified, Count: len(entries), Entries: make([]feedEntry, len(entries))}
+		for i, entry := range entries {
+			feed.Entries[i] = feedEntry{IP: entry.IP, CIDR: entry.CIDR, Added: entry.Added.UTC(), Expires: entry.Expires.UTC(),
+				Source: entry.Source}
+		}
+		err = json.NewEncoder(w).Encode(feed)
+	case FeedFormatCSV:
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"ip", "cidr", "added", "expires"})
+		for _, entry := range entries {
+			writer.Write([]string{entry.IP, entry.CIDR, entry.Added.UTC().Format(time.RFC3339), entry.Expires.UTC().Format(time.RFC3339)})
+		}
+		writer.Flush()
+		err = writer.Error()
+	case FeedFormatSTIX:
+		err = json.NewEncoder(w).Encode(stixBundle(entries, hash))
+	default:
+		for _, entry := range entries {
+			if _, err = fmt.Fprintln(w, entry.CIDR); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error writing blocklist feed")
+	}
+}
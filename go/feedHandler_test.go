@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFeedEntries() []BanEntry {
+	added := time.Date(2021, 11, 1, 10, 0, 0, 0, time.UTC)
+	entries := []BanEntry{
+		NewBanEntry("192.168.1.1", added.Add(time.Hour)),
+		NewBanEntry("2001:db8::1", added.Add(24*time.Hour)),
+	}
+	for i := range entries {
+		entries[i].Added = added
+	}
+	return entries
+}
+
+// newTestFeed keeps the feed's version in memory, as the feed_version table would
+func newTestFeed() *BlockListFeed {
+	var lastHash string
+	var lastModified time.Time
+	return &BlockListFeed{changed: func(hash string, now time.Time) (time.Time, error) {
+		if hash != lastHash {
+			lastHash, lastModified = hash, now
+		}
+		return lastModified, nil
+	}}
+}
+
+func getFeed(feed *BlockListFeed, entries []BanEntry, now time.Time, url string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", url, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	feed.serve(w, r, entries, now)
+	return w
+}
+
+func TestFeedFormats(t *testing.T) {
+	feed := newTestFeed()
+	now := time.Date(2021, 11, 1, 11, 0, 0, 0, time.UTC)
+	entries := testFeedEntries()
+
+	w := getFeed(feed, entries, now, "/feed/blocklist", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "192.168.1.1/32\n2001:db8::1/128\n" {
+		t.Logf("Unexpected text feed: %d %q", w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	w = getFeed(feed, entries, now, "/feed/blocklist", map[string]string{"Accept": "text/csv"})
+	if !strings.HasPrefix(w.Body.String(), "ip,cidr,added,expires\n192.168.1.1,192.168.1.1/32,2021-11-01T10:00:00Z,2021-11-01T11:00:00Z\n") {
+		t.Logf("Unexpected CSV feed: %q", w.Body.String())
+		t.Fail()
+	}
+
+	w = getFeed(feed, entries, now, "/feed/blocklist?format=json", nil)
+	var parsed struct {
+		Count   int         `json:"count"`
+		Entries []feedEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &parsed); err != nil || parsed.Count != 2 || parsed.Entries[1].CIDR != "2001:db8::1/128" {
+		t.Logf("Unexpected JSON feed: %s (err: %v)", w.Body.String(), err)
+		t.Fail()
+	}
+
+	w = getFeed(feed, entries, now, "/feed/blocklist?format=stix", nil)
+	var bundle struct {
+		Type    string                   `json:"type"`
+		ID      string                   `json:"id"`
+		Objects []map[string]interface{} `json:"objects"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &bundle); err != nil || bundle.Type != "bundle" || len(bundle.Objects) != 3 {
+		t.Logf("Unexpected STIX feed: %s (err: %v)", w.Body.String(), err)
+		t.FailNow()
+	}
+	indicator := bundle.Objects[2]
+	if indicator["pattern"] != "[ipv6-addr:value = '2001:db8::1/128']" || indicator["valid_until"] != "2021-11-02T10:00:00.000Z" ||
+		!strings.HasPrefix(indicator["id"].(string), "indicator--") || w.Header().Get("Content-Type") != "application/stix+json;version=2.1" {
+		t.Logf("Unexpected indicator: %v", indicator)
+		t.Fail()
+	}
+	// ids are stable
+	again := getFeed(feed, entries, now, "/feed/blocklist?format=stix", nil)
+	if again.Body.String() != w.Body.String() {
+		t.Logf("The same list should give the same bundle")
+		t.Fail()
+	}
+
+	w = getFeed(feed, entries, now, "/feed/blocklist?format=xml", nil)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Logf("Expected 422 for an unknown format, got %d", w.Code)
+		t.Fail()
+	}
+}
+
+func TestFeedConditional(t *testing.T) {
+	feed := newTestFeed()
+	now := time.Date(2021, 11, 1, 11, 0, 0, 0, time.UTC)
+	entries := testFeedEntries()
+
+	first := getFeed(feed, entries, now, "/feed/blocklist", nil)
+	etag := first.Header().Get("ETag")
+	if etag == "" || first.Header().Get("Last-Modified") != "Mon, 01 Nov 2021 11:00:00 GMT" {
+		t.Logf("Unexpected headers: %v", first.Header())
+		t.FailNow()
+	}
+	// unchanged list, later request
+	later := now.Add(time.Hour)
+	w := getFeed(feed, entries, later, "/feed/blocklist", map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified || w.Header().Get("Last-Modified") != first.Header().Get("Last-Modified") {
+		t.Logf("Expected 304 with the original Last-Modified, got %d %v", w.Code, w.Header())
+		t.Fail()
+	}
+	w = getFeed(feed, entries, later, "/feed/blocklist", map[string]string{"If-Modified-Since": first.Header().Get("Last-Modified")})
+	if w.Code != http.StatusNotModified {
+		t.Logf("Expected 304 for If-Modified-Since, got %d", w.Code)
+		t.Fail()
+	}
+	// each format has its own etag
+	w = getFeed(feed, entries, later, "/feed/blocklist?format=csv", map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusOK {
+		t.Logf("Expected 200 for another format, got %d", w.Code)
+		t.Fail()
+	}
+	// a ban running out changes both, so clients that only send If-Modified-Since see it
+	w = getFeed(feed, entries[:1], later, "/feed/blocklist", map[string]string{"If-Modified-Since": first.Header().Get("Last-Modified")})
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag || w.Header().Get("Last-Modified") != "Mon, 01 Nov 2021 12:00:00 GMT" {
+		t.Logf("Expected a new list, got %d %v", w.Code, w.Header())
+		t.Fail()
+	}
+}
+
+func TestFeedVersionUnavailable(t *testing.T) {
+	feed := &BlockListFeed{changed: func(string, time.Time) (time.Time, error) {
+		return time.Time{}, errors.New("database unavailable")
+	}}
+	now := time.Date(2021, 11, 1, 11, 0, 0, 0, time.UTC)
+	// without a Last-Modified only the etag can give Not Modified
+	w := getFeed(feed, testFeedEntries(), now, "/feed/blocklist", map[string]string{"If-Modified-Since": "Mon, 01 Nov 2021 11:00:00 GMT"})
+	if w.Code != http.StatusOK || w.Header().Get("Last-Modified") != "" {
+		t.Logf("Expected the list without a Last-Modified, got %d %v", w.Code, w.Header())
+		t.Fail()
+	}
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Firewall backends
+const (
+	FirewallNftables = "nftables"
+	FirewallIPSet    = "ipset"
+)
+
+// how long a firewall command gets to run
+var firewallCommandTimeout = 30 * time.Second
+
+// a ban whose timeout in the set is off by more than this is given the right timeout
+const firewallTimeoutSlack = 60
+
+// errFirewallSetMissing is returned by List when the set doesn't exist
+var errFirewallSetMissing = errors.New("firewall set doesn't exist")
+
+// ExecRunner runs the program name with args, feeding it stdin, and returns its combined output
+type ExecRunner func(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error)
+
+// runProgram runs name directly, without a shell
+func runProgram(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	return cmd.CombinedOutput()
+}
+
+// firewallChange adds an IP or a network to a set with a timeout, or deletes it from the set
+type firewallChange struct {
+	Delete bool
+	Set    string
+	// IP is an address, or a network in CIDR form
+	IP string
+	// Timeout is in seconds
+	Timeout int
+}
+
+// FirewallBackend is the layer that talks to the kernel's sets
+type FirewallBackend interface {
+	// Setup creates the sets if they don't exist. The sets hold networks as well as addresses.
+	Setup(setV4, setV6 string) error
+	// List returns the elements in set and the seconds left on each, 0 for elements without a
+	// timeout. It returns errFirewallSetMissing when the set doesn't exist.
+	List(set string) (map[string]int, error)
+	// Apply makes the changes in one go
+	Apply(changes []firewallChange) error
+}
+
+// nftablesBackend keeps the sets in an nftables table
+type nftablesBackend struct {
+	run    ExecRunner
+	family string
+	table  string
+}
+
+func (n *nftablesBackend) nft(stdin []byte, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), firewallCommandTimeout)
+	defer cancel()
+	output, err := n.run(ctx, stdin, "nft", args...)
+	if err != nil {
+		return nil, fmt.Errorf("nft %s failed: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// Setup adds the table and sets, which does nothing when they already exist. The interval flag
+// lets the sets hold networks.
+func (n *nftablesBackend) Setup(setV4, setV6 string) error {
+	script := fmt.Sprintf("add table %[1]s %[2]s\n"+
+		"add set %[1]s %[2]s %[3]s { type ipv4_addr; flags interval,timeout; }\n"+
+		"add set %[1]s %[2]s %[4]s { type ipv6_addr; flags interval,timeout; }\n",
+		n.family, n.table, setV4, setV6)
+	_, err := n.nft([]byte(script), "-f", "-")
+	return err
+}
+
+// nftElementValue is an element's value in nft's JSON output, which is a string for an address
+// and a prefix object for a network
+type nftElementValue string
+
+func (v *nftElementValue) UnmarshalJSON(data []byte) error {
+	var plain string
+	if err := json.Unmarshal(data, &plain); err == nil {
+		*v = nftElementValue(plain)
+		return nil
+	}
+	var network struct {
+		Prefix *struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+	}
+	if err := json.Unmarshal(data, &network); err != nil || network.Prefix == nil {
+		return fmt.Errorf("nft set element %s isn't an address or a prefix", data)
+	}
+	*v = nftElementValue(fmt.Sprintf("%s/%d", network.Prefix.Addr, network.Prefix.Len))
+	return nil
+}
+
+// List reads the set's elements from nft's JSON output
+func (n *nftablesBackend) List(set string) (map[string]int, error) {
+	output, err := n.nft(nil, "-j", "list", "set", n.family, n.table, set)
+	if err != nil {
+		if strings.Contains(err.Error(), "No such file or directory") {
+			return nil, errFirewallSetMissing
+		}
+		return nil, err
+	}
+	var listing struct {
+		Nftables []struct {
+			Set *struct {
+				Elem []json.RawMessage `json:"elem"`
+			} `json:"set"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(output, &listing); err != nil {
+		return nil, err
+	}
+	elements := map[string]int{}
+	for _, item := range listing.Nftables {
+		if item.Set == nil {
+			continue
+		}
+		for _, raw := range item.Set.Elem {
+			// elements with a timeout are wrapped in an elem object, elements without are just the value
+			var timed struct {
+				Elem *struct {
+					Val     nftElementValue `json:"val"`
+					Expires int             `json:"expires"`
+				} `json:"elem"`
+			}
+			if err := json.Unmarshal(raw, &timed); err == nil && timed.Elem != nil {
+				elements[string(timed.Elem.Val)] = timed.Elem.Expires
+				continue
+			}
+			var plain nftElementValue
+			if err := json.Unmarshal(raw, &plain); err != nil {
+				return nil, err
+			}
+			elements[string(plain)] = 0
+		}
+	}
+	return elements, nil
+}
+
+// Apply runs the changes as one nft transaction, an element's timeout is changed by
+// deleting and adding it
+func (n *nftablesBackend) Apply(changes []firewallChange) error {
+	var script bytes.Buffer
+	for _, change := range changes {
+		if change.Delete {
+			fmt.Fprintf(&script, "delete element %s %s %s { %s }\n", n.family, n.table, change.Set, change.IP)
+		} else {
+			fmt.Fprintf(&script, "add element %s %s %s { %s timeout %ds }\n", n.family, n.table, change.Set, change.IP, change.Timeout)
+		}
+	}
+	_, err := n.nft(script.Bytes(), "-f", "-")
+	return err
+}
+
+// ipsetBackend keeps the sets with ipset
+type ipsetBackend struct {
+	run ExecRunner
+}
+
+func (i *ipsetBackend) ipset(stdin []byte, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), firewallCommandTimeout)
+	defer cancel()
+	output, err := i.run(ctx, stdin, "ipset", args...)
+	if err != nil {
+		return nil, fmt.Errorf("ipset %s failed: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return output, nil
+}
+
+// Setup creates the sets, -exist stops it failing when they're already there. hash:net sets
+// hold networks as well as addresses.
+func (i *ipsetBackend) Setup(setV4, setV6 string) error {
+	script := fmt.Sprintf("create %s hash:net family inet timeout 0 -exist\n"+
+		"create %s hash:net family inet6 timeout 0 -exist\n", setV4, setV6)
+	_, err := i.ipset([]byte(script), "restore")
+	return err
+}
+
+// List reads the set's elements from ipset save
+func (i *ipsetBackend) List(set string) (map[string]int, error) {
+	output, err := i.ipset(nil, "save", set)
+	if err != nil {
+		if strings.Contains(err.Error(), "does not exist") {
+			return nil, errFirewallSetMissing
+		}
+		return nil, err
+	}
+	elements := map[string]int{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != "add" || fields[1] != set {
+			continue
+		}
+		timeout := 0
+		for idx := 3; idx+1 < len(fields); idx++ {
+			if fields[idx] == "timeout" {
+				timeout, _ = strconv.Atoi(fields[idx+1])
+			}
+		}
+		elements[fields[2]] = timeout
+	}
+	return elements, nil
+}
+
+// Apply runs the changes with ipset restore, adding with -exist replaces the timeout
+func (i *ipsetBackend) Apply(changes []firewallChange) error {
+	var script bytes.Buffer
+	for _, change := range changes {
+		if change.Delete {
+			fmt.Fprintf(&script, "del %s %s -exist\n", change.Set, change.IP)
+		} else {
+			fmt.Fprintf(&script, "add %s %s timeout %d -exist\n", change.Set, change.IP, change.Timeout)
+		}
+	}
+	_, err := i.ipset(script.Bytes(), "restore")
+	return err
+}
+
+// FirewallSink keeps a host firewall set in step with the blocklist. Every element times out
+// when its ban runs out, so the firewall stays right even if autowaf stops.
+type FirewallSink struct {
+	name    string
+	backend FirewallBackend
+	setV4   string
+	setV6   string
+	now     func() time.Time
+	mu      sync.Mutex
+	ready   bool
+}
+
+// NewFirewallSink makes the sink for the backend in envconf
+func NewFirewallSink(envconf *EnvConfig) *FirewallSink {
+	var backend FirewallBackend
+	if envconf.FirewallBackend == FirewallIPSet {
+		backend = &ipsetBackend{run: runProgram}
+	} else {
+		backend = &nftablesBackend{run: runProgram, family: envconf.FirewallNftFamily, table: envconf.FirewallNftTable}
+	}
+	return &FirewallSink{
+		name:    envconf.FirewallBackend,
+		backend: backend,
+		setV4:   envconf.FirewallSetV4,
+		setV6:   envconf.FirewallSetV6,
+		now:     time.Now,
+	}
+}
+
+// Name is the backend
+func (f *FirewallSink) Name() string {
+	return f.name
+}
+
+// setFor returns the set an address or CIDR belongs in and the element it is in the set
+func (f *FirewallSink) setFor(value string) (string, string, bool) {
+	element, v4, ok := firewallElement(value)
+	if !ok {
+		return "", "", false
+	}
+	if v4 {
+		return f.setV4, element, true
+	}
+	return f.setV6, element, true
+}
+
+// firewallElement returns an address or CIDR in the form the sets list it, a plain address for
+// a single address, and whether it's IPv4
+func firewallElement(value string) (string, bool, bool) {
+	if !strings.Contains(value, "/") {
+		parsed := net.ParseIP(value)
+		if parsed == nil {
+			return "", false, false
+		}
+		if v4 := parsed.To4(); v4 != nil {
+			return v4.String(), true, true
+		}
+		return parsed.String(), false, true
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return "", false, false
+	}
+	ones, bits := network.Mask.Size()
+	// an IPv4-mapped network is parsed as IPv6
+	if v4 := network.IP.To4(); v4 != nil && (bits == 32 || ones >= 96) {
+		ones -= bits - 32
+		if ones == 32 {
+			return v4.String(), true, true
+		}
+		return fmt.Sprintf("%s/%d", v4, ones), true, true
+	}
+	if ones == bits {
+		return network.IP.String(), false, true
+	}
+	return network.String(), false, true
+}
+
+// coveredByNetwork is true when element is inside one of the networks, other than itself
+func coveredByNetwork(element string, networks []*net.IPNet) bool {
+	ip, ones := net.ParseIP(element), 0
+	if ip == nil {
+		var network *net.IPNet
+		var err error
+		if ip, network, err = net.ParseCIDR(element); err != nil {
+			return false
+		}
+		ones, _ = network.Mask.Size()
+	} else {
+		ones = len(ip) * 8
+		if ip.To4() != nil {
+			ones = 32
+		}
+	}
+	for _, network := range networks {
+		if size, _ := network.Mask.Size(); size < ones && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setup creates the sets the first time they're used
+func (f *FirewallSink) setup() error {
+	if f.ready {
+		return nil
+	}
+	if err := f.backend.Setup(f.setV4, f.setV6); err != nil {
+		return err
+	}
+	f.ready = true
+	return nil
+}
+
+// list returns the elements of set in the form setFor gives them
+func (f *FirewallSink) list(set string) (map[string]int, error) {
+	listed, err := f.backend.List(set)
+	if err != nil {
+		return nil, err
+	}
+	elements := make(map[string]int, len(listed))
+	for element, left := range listed {
+		if normal, _, ok := firewallElement(element); ok {
+			element = normal
+		}
+		elements[element] = left
+	}
+	return elements, nil
+}
+
+// current returns the elements of both sets, keyed by set then element. A set that doesn't
+// exist yet is empty.
+func (f *FirewallSink) current() (map[string]map[string]int, error) {
+	current := map[string]map[string]int{}
+	for _, set := range []string{f.setV4, f.setV6} {
+		elements, err := f.list(set)
+		if err == errFirewallSetMissing {
+			elements, err = map[string]int{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		current[set] = elements
+	}
+	return current, nil
+}
+
+// Sync adds the new bans, deletes the ones that are gone and fixes the timeouts of bans
+// that were extended. A dry run doesn't create the sets.
+func (f *FirewallSink) Sync(entries []BanEntry, dryRun bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !dryRun {
+		if err := f.setup(); err != nil {
+			return err
+		}
+	}
+	current, err := f.current()
+	if err != nil {
+		return err
+	}
+	now := f.now()
+	wanted := map[string]map[string]int{f.setV4: {}, f.setV6: {}}
+	networks := []*net.IPNet{}
+	for _, entry := range entries {
+		set, element, ok := f.setFor(entry.IP)
+		if !ok {
+			continue
+		}
+		remaining := int(entry.Expires.Sub(now).Seconds())
+		if remaining < 1 {
+			continue
+		}
+		if remaining > wanted[set][element] {
+			wanted[set][element] = remaining
+		}
+		if _, network, err := net.ParseCIDR(element); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	changes := []firewallChange{}
+	desired := map[string]map[string]bool{f.setV4: {}, f.setV6: {}}
+	for set, elements := range wanted {
+		for element, remaining := range elements {
+			// nftables interval sets can't hold overlapping elements, so an entry inside another
+			// entry's network is left to the network. If the network times out first, the entry
+			// is added again by the next sync.
+			if coveredByNetwork(element, networks) {
+				continue
+			}
+			desired[set][element] = true
+			left, present := current[set][element]
+			if present && left != 0 && left >= remaining-firewallTimeoutSlack && left <= remaining+firewallTimeoutSlack {
+				continue
+			}
+			if present {
+				changes = append(changes, firewallChange{Delete: true, Set: set, IP: element})
+			}
+			changes = append(changes, firewallChange{Set: set, IP: element, Timeout: remaining})
+		}
+	}
+	for set, elements := range current {
+		for ip := range elements {
+			if !desired[set][ip] {
+				changes = append(changes, firewallChange{Delete: true, Set: set, IP: ip})
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	// deletes go before adds, so an element that's re-timed is deleted before it's added again
+	// and the addresses a new network covers are gone before it's added
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Set != changes[j].Set {
+			return changes[i].Set < changes[j].Set
+		}
+		if changes[i].Delete != changes[j].Delete {
+			return changes[i].Delete
+		}
+		return changes[i].IP < changes[j].IP
+	})
+	if dryRun {
+		added, removed := []string{}, []string{}
+		for _, change := range changes {
+			if change.Delete && !desired[change.Set][change.IP] {
+				removed = append(removed, change.IP)
+			} else if !change.Delete {
+				added = append(added, fmt.Sprintf("%s (%ds)", change.IP, change.Timeout))
+			}
+		}
+		log.Info().Str("Sink", f.Name()).Strs("Added", added).Strs("Removed", removed).Msg("Dry run: not updating firewall sets")
+		return nil
+	}
+	if err := f.backend.Apply(changes); err != nil {
+		return err
+	}
+	log.Info().Str("Sink", f.Name()).Int("Changes", len(changes)).Msg("Updated firewall sets")
+	return nil
+}
+
+// Remove deletes ip from its set
+func (f *FirewallSink) Remove(ip string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	set, element, ok := f.setFor(ip)
+	if !ok {
+		return ErrIPNotFound
+	}
+	if err := f.setup(); err != nil {
+		return err
+	}
+	elements, err := f.list(set)
+	if err != nil {
+		return err
+	}
+	if _, present := elements[element]; !present {
+		return ErrIPNotFound
+	}
+	return f.backend.Apply([]firewallChange{{Delete: true, Set: set, IP: element}})
+}
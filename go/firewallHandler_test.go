@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// FakeFirewall keeps the sets in memory
+type FakeFirewall struct {
+	sets    map[string]map[string]int
+	applied [][]firewallChange
+}
+
+func (f *FakeFirewall) Setup(setV4, setV6 string) error {
+	for _, set := range []string{setV4, setV6} {
+		if f.sets[set] == nil {
+			f.sets[set] = map[string]int{}
+		}
+	}
+	return nil
+}
+
+func (f *FakeFirewall) List(set string) (map[string]int, error) {
+	if f.sets[set] == nil {
+		return nil, errFirewallSetMissing
+	}
+	elements := map[string]int{}
+	for ip, timeout := range f.sets[set] {
+		elements[ip] = timeout
+	}
+	return elements, nil
+}
+
+func (f *FakeFirewall) Apply(changes []firewallChange) error {
+	f.applied = append(f.applied, changes)
+	for _, change := range changes {
+		if change.Delete {
+			delete(f.sets[change.Set], change.IP)
+		} else {
+			f.sets[change.Set][change.IP] = change.Timeout
+		}
+	}
+	return nil
+}
+
+func newTestFirewallSink() (*FirewallSink, *FakeFirewall, time.Time) {
+	now := time.Date(2021, 11, 1, 10, 0, 0, 0, time.UTC)
+	fake := &FakeFirewall{sets: map[string]map[string]int{}}
+	sink := &FirewallSink{name: FirewallNftables, backend: fake, setV4: "autowaf_v4", setV6: "autowaf_v6",
+		now: func() time.Time { return now }}
+	return sink, fake, now
+}
+
+func TestFirewallSync(t *testing.T) {
+	sink, fake, now := newTestFirewallSink()
+	entries := []BanEntry{
+		NewBanEntry("192.168.1.1", now.Add(time.Hour)),
+		NewBanEntry("::ffff:192.168.1.2", now.Add(2*time.Hour)),
+		NewBanEntry("2001:db8::1", now.Add(time.Hour)),
+		// already expired
+		NewBanEntry("192.168.1.3", now.Add(-time.Minute)),
+	}
+	if err := sink.Sync(entries, false); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	if fake.sets["autowaf_v4"]["192.168.1.1"] != 3600 || fake.sets["autowaf_v4"]["192.168.1.2"] != 7200 ||
+		fake.sets["autowaf_v6"]["2001:db8::1"] != 3600 || len(fake.sets["autowaf_v4"]) != 2 {
+		t.Logf("Unexpected sets: %v", fake.sets)
+		t.Fail()
+	}
+
+	// the kernel counts the timeouts down, a few seconds off isn't a change
+	fake.sets["autowaf_v4"]["192.168.1.1"] = 3590
+	// a ban that was extended gets its new timeout, one that's gone is deleted
+	entries = []BanEntry{
+		NewBanEntry("192.168.1.1", now.Add(time.Hour)),
+		NewBanEntry("192.168.1.2", now.Add(5*time.Hour)),
+	}
+	fake.applied = nil
+	if err := sink.Sync(entries, false); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	if len(fake.applied) != 1 || len(fake.applied[0]) != 3 {
+		t.Logf("Expected one batch of 3 changes, got %v", fake.applied)
+		t.FailNow()
+	}
+	if fake.sets["autowaf_v4"]["192.168.1.2"] != 18000 || len(fake.sets["autowaf_v6"]) != 0 {
+		t.Logf("Unexpected sets: %v", fake.sets)
+		t.Fail()
+	}
+
+	// nothing to do
+	fake.applied = nil
+	sink.Sync(entries, false)
+	if len(fake.applied) != 0 {
+		t.Logf("Expected no changes, got %v", fake.applied)
+		t.Fail()
+	}
+}
+
+func TestFirewallDryRun(t *testing.T) {
+	sink, fake, now := newTestFirewallSink()
+	// the sets don't exist yet, and a dry run leaves them that way
+	if err := sink.Sync([]BanEntry{NewBanEntry("192.168.1.1", now.Add(time.Hour))}, true); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.Fail()
+	}
+	if len(fake.sets) != 0 || len(fake.applied) != 0 {
+		t.Logf("A dry run shouldn't change the firewall: %v %v", fake.sets, fake.applied)
+		t.Fail()
+	}
+}
+
+func TestFirewallSyncNetworks(t *testing.T) {
+	sink, fake, now := newTestFirewallSink()
+	_, network, _ := net.ParseCIDR("198.51.100.0/24")
+	intel := NewNetworkBanEntry(network, now.Add(48*time.Hour))
+	intel.Source = "spamhaus"
+	fake.Setup("autowaf_v4", "autowaf_v6")
+	// banned before the feed listed its network
+	fake.sets["autowaf_v4"]["198.51.100.7"] = 3600
+	entries := []BanEntry{intel, NewBanEntry("198.51.100.7", now.Add(time.Hour)), NewBanEntry("192.168.1.1", now.Add(time.Hour))}
+	if err := sink.Sync(entries, false); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	// the address inside the network is left to the network, which an interval set can't overlap
+	if fake.sets["autowaf_v4"]["198.51.100.0/24"] != 172800 || fake.sets["autowaf_v4"]["192.168.1.1"] != 3600 ||
+		len(fake.sets["autowaf_v4"]) != 2 {
+		t.Logf("Unexpected sets: %v", fake.sets)
+		t.Fail()
+	}
+	if len(fake.applied) != 1 || !fake.applied[0][0].Delete || fake.applied[0][0].IP != "198.51.100.7" {
+		t.Logf("Expected the covered address to be deleted before the network is added, got %v", fake.applied)
+		t.Fail()
+	}
+	// once the feed drops the network, the address is blocked on its own again
+	fake.applied = nil
+	sink.Sync(entries[1:], false)
+	if fake.sets["autowaf_v4"]["198.51.100.7"] != 3600 || len(fake.sets["autowaf_v4"]) != 2 {
+		t.Logf("Unexpected sets: %v", fake.sets)
+		t.Fail()
+	}
+	if err := sink.Remove("198.51.100.0/24"); err != ErrIPNotFound {
+		t.Logf("Expected ErrIPNotFound for the dropped network, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestFirewallRemove(t *testing.T) {
+	sink, fake, now := newTestFirewallSink()
+	sink.Sync([]BanEntry{NewBanEntry("192.168.1.1", now.Add(time.Hour))}, false)
+	if err := sink.Remove("192.168.1.1"); err != nil || len(fake.sets["autowaf_v4"]) != 0 {
+		t.Logf("Expected the IP to be removed (err: %v)", err)
+		t.Fail()
+	}
+	if err := sink.Remove("192.168.1.1"); err != ErrIPNotFound {
+		t.Logf("Expected ErrIPNotFound, got %v", err)
+		t.Fail()
+	}
+}
+
+// fakeRunner returns output and records what it was run with
+func fakeRunner(output string, calls *[]string) ExecRunner {
+	return func(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+		*calls = append(*calls, name+" "+strings.Join(args, " ")+"\n"+string(stdin))
+		return []byte(output), nil
+	}
+}
+
+func TestNftablesBackend(t *testing.T) {
+	calls := []string{}
+	listing := `{"nftables": [{"metainfo": {"version": "1.0.1"}}, {"set": {"family": "inet", "name": "autowaf_v4",
+		"table": "autowaf", "type": "ipv4_addr", "flags": ["timeout"],
+		"elem": [{"elem": {"val": "192.168.1.1", "timeout": 3600, "expires": 3500}}, "192.168.1.2",
+		{"elem": {"val": {"prefix": {"addr": "198.51.100.0", "len": 24}}, "timeout": 7200, "expires": 7000}},
+		{"prefix": {"addr": "203.0.113.0", "len": 24}}]}}]}`
+	backend := &nftablesBackend{run: fakeRunner(listing, &calls), family: "inet", table: "autowaf"}
+	elements, err := backend.List("autowaf_v4")
+	if err != nil || elements["192.168.1.1"] != 3500 || elements["192.168.1.2"] != 0 || elements["198.51.100.0/24"] != 7000 ||
+		elements["203.0.113.0/24"] != 0 || len(elements) != 4 {
+		t.Logf("Unexpected elements: %v (err: %v)", elements, err)
+		t.Fail()
+	}
+	backend.Apply([]firewallChange{
+		{Delete: true, Set: "autowaf_v4", IP: "192.168.1.1"},
+		{Set: "autowaf_v4", IP: "192.168.1.1", Timeout: 7200},
+	})
+	expected := "nft -f -\ndelete element inet autowaf autowaf_v4 { 192.168.1.1 }\n" +
+		"add element inet autowaf autowaf_v4 { 192.168.1.1 timeout 7200s }\n"
+	if calls[len(calls)-1] != expected {
+		t.Logf("Unexpected nft call: %q", calls[len(calls)-1])
+		t.Fail()
+	}
+}
+
+func TestIPSetBackend(t *testing.T) {
+	calls := []string{}
+	listing := "create autowaf_v4 hash:net family inet hashsize 1024 maxelem 65536 timeout 0\n" +
+		"add autowaf_v4 192.168.1.1 timeout 3500\nadd autowaf_v4 192.168.1.2\nadd autowaf_v4 198.51.100.0/24 timeout 7000\n"
+	backend := &ipsetBackend{run: fakeRunner(listing, &calls)}
+	elements, err := backend.List("autowaf_v4")
+	if err != nil || elements["192.168.1.1"] != 3500 || elements["192.168.1.2"] != 0 || elements["198.51.100.0/24"] != 7000 ||
+		len(elements) != 3 {
+		t.Logf("Unexpected elements: %v (err: %v)", elements, err)
+		t.Fail()
+	}
+	backend.Apply([]firewallChange{{Delete: true, Set: "autowaf_v4", IP: "192.168.1.2"}, {Set: "autowaf_v4", IP: "192.168.1.3", Timeout: 60}})
+	expected := "ipset restore\ndel autowaf_v4 192.168.1.2 -exist\nadd autowaf_v4 192.168.1.3 timeout 60 -exist\n"
+	if calls[len(calls)-1] != expected {
+		t.Logf("Unexpected ipset call: %q", calls[len(calls)-1])
+		t.Fail()
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrGCPPolicyChanged is returned when the sink's rules kept changing under an update
+var ErrGCPPolicyChanged = errors.New("Cloud Armor security policy changed while it was being updated")
+
+// ErrGCPForeignRule is returned when a rule the sink doesn't manage is in its priority range
+var ErrGCPForeignRule = errors.New("Cloud Armor policy has a rule autowaf doesn't manage in autowaf's priority range")
+
+// ErrGCPOperationTimeout is returned when a rule change doesn't finish in time
+var ErrGCPOperationTimeout = errors.New("Timed out waiting for the Cloud Armor operation")
+
+// how many times an update is retried when the sink's rules changed under it
+const gcpUpdateAttempts = 3
+
+const gcpScope = "https://www.googleapis.com/auth/compute"
+
+// gcpRuleDescription marks the rules the sink manages
+const gcpRuleDescription = "autowaf blocklist"
+
+// gcpRule is a Cloud Armor security policy rule
+type gcpRule struct {
+	Priority    int    `json:"priority"`
+	Action      string `json:"action"`
+	Description string `json:"description,omitempty"`
+	Preview     bool   `json:"preview,omitempty"`
+	Match       struct {
+		VersionedExpr string `json:"versionedExpr,omitempty"`
+		Config        *struct {
+			SrcIPRanges []string `json:"srcIpRanges"`
+		} `json:"config,omitempty"`
+	} `json:"match"`
+}
+
+// gcpPolicy is the part of a security policy the sink reads
+type gcpPolicy struct {
+	Name  string    `json:"name"`
+	Rules []gcpRule `json:"rules"`
+}
+
+// gcpOperation is the status of an asynchronous change to a policy
+type gcpOperation struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  *struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+// gcpServiceAccount is a service account key file
+type gcpServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// GCPSink keeps deny rules in a Cloud Armor security policy. The blocklist is split across
+// rules of at most ipsPerRule source ranges, at consecutive priorities from priority.
+type GCPSink struct {
+	client           *http.Client
+	apiURL           string
+	metadataURL      string
+	project          string
+	policy           string
+	credentialsFile  string
+	action           string
+	priority         int
+	ipsPerRule       int
+	maxRules         int
+	operationTimeout time.Duration
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewGCPSink makes the sink for the policy in envconf
+func NewGCPSink(envconf *EnvConfig) *GCPSink {
+	return &GCPSink{
+		client:           &http.Client{Timeout: 150 * time.Second},
+		apiURL:           strings.TrimRight(envconf.GCPAPIURL, "/"),
+		metadataURL:      strings.TrimRight(envconf.GCPMetadataURL, "/"),
+		project:          envconf.GCPProject,
+		policy:           envconf.GCPSecurityPolicy,
+		credentialsFile:  envconf.GCPCredentialsFile,
+		action:           envconf.GCPDenyAction,
+		priority:         envconf.GCPRulePriority,
+		ipsPerRule:       envconf.GCPIPsPerRule,
+		maxRules:         envconf.GCPMaxRules,
+		operationTimeout: time.Duration(envconf.GCPOperationTimeout) * time.Second,
+	}
+}
+
+// Name is cloudarmor
+func (g *GCPSink) Name() string {
+	return "cloudarmor"
+}
+
+// accessToken returns a token for the service account in the credentials file, or for the
+// instance's service account from the metadata server, reusing it until shortly before it expires
+func (g *GCPSink) accessToken() (string, error) {
+	if g.token != "" && time.Now().Before(g.tokenExpiry) {
+		return g.token, nil
+	}
+	var resp *http.Response
+	if g.credentialsFile != "" {
+		assertion, tokenURI, err := g.signedAssertion()
+		if err != nil {
+			return "", err
+		}
+		resp, err = g.client.PostForm(tokenURI, url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		})
+		if err != nil {
+			return "", err
+		}
+	} else {
+		req, err := http.NewRequest("GET", g.metadataURL+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err = g.client.Do(req)
+		if err != nil {
+			return "", err
+		}
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1048576)).Decode(&token); err != nil {
+		return "", fmt.Errorf("GCP token endpoint returned %d with a body that isn't JSON", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return "", fmt.Errorf("GCP token endpoint returned %d: %s %s", resp.StatusCode, token.Error, token.ErrorDescription)
+	}
+	g.token = token.AccessToken
+	g.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn-60) * time.Second)
+	return g.token, nil
+}
+
+// signedAssertion makes the JWT that's exchanged for a token, signed with the service account's key
+func (g *GCPSink) signedAssertion() (string, string, error) {
+	data, err := ioutil.ReadFile(g.credentialsFile)
+	if err != nil {
+		return "", "", err
+	}
+	var account gcpServiceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return "", "", fmt.Errorf("%s isn't a service account key: %s", g.credentialsFile, err)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return "", "", fmt.Errorf("%s doesn't have a private key", g.credentialsFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", "", err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", "", fmt.Errorf("%s doesn't have an RSA private key", g.credentialsFile)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	now := time.Now().Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   account.ClientEmail,
+		"scope": gcpScope,
+		"aud":   account.TokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), account.TokenURI, nil
+}
+
+// call makes a request to the compute API and decodes the response into result
+func (g *GCPSink) call(method, path string, body interface{}, result interface{}) error {
+	token, err := g.accessToken()
+	if err != nil {
+		return err
+	}
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, g.apiURL+"/projects/"+url.PathEscape(g.project)+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16*1048576))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(data, &apiErr)
+		return fmt.Errorf("Cloud Armor %s %s returned %d: %s", method, path, resp.StatusCode, apiErr.Error.Message)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+// policyPath is the path of the security policy, with method appended
+func (g *GCPSink) policyPath(method string) string {
+	path := "/global/securityPolicies/" + url.PathEscape(g.policy)
+	if method != "" {
+		path += "/" + method
+	}
+	return path
+}
+
+// getPolicy reads the security policy
+func (g *GCPSink) getPolicy() (*gcpPolicy, error) {
+	var policy gcpPolicy
+	if err := g.call("GET", g.policyPath(""), nil, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// waitForOperation waits for a change to the policy to finish
+func (g *GCPSink) waitForOperation(op gcpOperation) error {
+	deadline := time.Now().Add(g.operationTimeout)
+	for op.Status != "DONE" {
+		if time.Now().After(deadline) {
+			return ErrGCPOperationTimeout
+		}
+		// wait returns when the operation is done or after a couple of minutes, whichever is first
+		if err := g.call("POST", "/global/operations/"+url.PathEscape(op.Name)+"/wait", nil, &op); err != nil {
+			return err
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("Cloud Armor operation %s failed: %s %s", op.Name, op.Error.Errors[0].Code, op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
+// inRange is true for rules at the priorities the sink uses
+func (g *GCPSink) inRange(rule gcpRule) bool {
+	return rule.Priority >= g.priority && rule.Priority < g.priority+g.maxRules
+}
+
+// isOurRule is true for the rules the sink manages
+func (g *GCPSink) isOurRule(rule gcpRule) bool {
+	return g.inRange(rule) && rule.Description == gcpRuleDescription
+}
+
+// ruleRanges returns the rules the sink manages by priority, and the addresses they block.
+// Someone else's rule in the sink's range is an error, so it's never patched or removed.
+func (g *GCPSink) ruleRanges(policy *gcpPolicy) (map[int]gcpRule, []string, error) {
+	rules := map[int]gcpRule{}
+	ranges := []string{}
+	for _, rule := range policy.Rules {
+		if !g.inRange(rule) {
+			continue
+		}
+		if !g.isOurRule(rule) {
+			log.Error().Str("Sink", g.Name()).Int("Priority", rule.Priority).Str("Description", rule.Description).
+				Msg("Cloud Armor rule in autowaf's priority range isn't autowaf's, not updating the policy")
+			return nil, nil, ErrGCPForeignRule
+		}
+		rules[rule.Priority] = rule
+		if rule.Match.Config != nil {
+			ranges = append(ranges, rule.Match.Config.SrcIPRanges...)
+		}
+	}
+	sort.Strings(ranges)
+	return rules, ranges, nil
+}
+
+// buildRule makes the deny rule at priority for ranges
+func (g *GCPSink) buildRule(priority int, ranges []string) gcpRule {
+	rule := gcpRule{Priority: priority, Action: g.action, Description: gcpRuleDescription}
+	rule.Match.VersionedExpr = "SRC_IPS_V1"
+	rule.Match.Config = &struct {
+		SrcIPRanges []string `json:"srcIpRanges"`
+	}{SrcIPRanges: ranges}
+	return rule
+}
+
+// sameRule is true when existing already is desired
+func sameRule(existing gcpRule, desired gcpRule) bool {
+	if existing.Action != desired.Action || existing.Preview || existing.Match.Config == nil {
+		return false
+	}
+	return strings.Join(existing.Match.Config.SrcIPRanges, ",") == strings.Join(desired.Match.Config.SrcIPRanges, ",")
+}
+
+// update reads the policy, lets change work out the new addresses from the current ones and
+// changes the sink's rules to match. change returning nil leaves the policy as it is.
+//
+// Cloud Armor's per rule methods don't take the policy's fingerprint, so unlike the AWS and Azure
+// updates the writes aren't guarded: someone else changing the sink's rules at the same time can
+// overwrite them or be overwritten. To catch the first case the policy is read back after the
+// writes, and if the sink's rules don't block exactly what was written the update starts over
+// from the policy as it is then.
+func (g *GCPSink) update(change func(current []string) []string) (bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	changed := false
+	for attempt := 0; attempt < gcpUpdateAttempts; attempt++ {
+		policy, err := g.getPolicy()
+		if err != nil {
+			return changed, err
+		}
+		existing, current, err := g.ruleRanges(policy)
+		if err != nil {
+			return changed, err
+		}
+		desired := change(current)
+		if desired == nil || strings.Join(desired, ",") == strings.Join(current, ",") {
+			return changed, nil
+		}
+		needed := (len(desired) + g.ipsPerRule - 1) / g.ipsPerRule
+		if needed > g.maxRules {
+			return changed, fmt.Errorf("%d IPs need %d rules, more than the %d allowed", len(desired), needed, g.maxRules)
+		}
+		changed = true
+		if err := g.writeRules(existing, desired, needed); err != nil {
+			return changed, err
+		}
+		latest, err := g.getPolicy()
+		if err != nil {
+			return changed, err
+		}
+		_, written, err := g.ruleRanges(latest)
+		if err != nil {
+			return changed, err
+		}
+		if strings.Join(written, ",") == strings.Join(desired, ",") {
+			return changed, nil
+		}
+		log.Warn().Str("Sink", g.Name()).Msg("Cloud Armor rules changed while updating them, retrying")
+	}
+	return changed, ErrGCPPolicyChanged
+}
+
+// writeRules adds or patches the needed rules for desired and removes the rest of existing
+func (g *GCPSink) writeRules(existing map[int]gcpRule, desired []string, needed int) error {
+	var err error
+	for index := 0; index < needed; index++ {
+		end := (index + 1) * g.ipsPerRule
+		if end > len(desired) {
+			end = len(desired)
+		}
+		rule := g.buildRule(g.priority+index, desired[index*g.ipsPerRule:end])
+		var op gcpOperation
+		if current, ok := existing[rule.Priority]; ok {
+			if sameRule(current, rule) {
+				continue
+			}
+			err = g.call("POST", g.policyPath("patchRule")+fmt.Sprintf("?priority=%d", rule.Priority), rule, &op)
+		} else {
+			err = g.call("POST", g.policyPath("addRule"), rule, &op)
+		}
+		if err == nil {
+			err = g.waitForOperation(op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for priority := range existing {
+		if priority < g.priority+needed {
+			continue
+		}
+		var op gcpOperation
+		err = g.call("POST", g.policyPath("removeRule")+fmt.Sprintf("?priority=%d", priority), nil, &op)
+		if err == nil {
+			err = g.waitForOperation(op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync makes the sink's rules deny exactly entries
+func (g *GCPSink) Sync(entries []BanEntry, dryRun bool) error {
+	return syncRules(g, "Cloud Armor policy", g.update, entries, dryRun)
+}
+
+// Remove takes ip out of the sink's rules
+func (g *GCPSink) Remove(ip string) error {
+	return removeFromRules(g.update, ip)
+}
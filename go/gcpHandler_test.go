@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// FakeCloudArmor is enough of the compute API and the token endpoint for the sink
+type FakeCloudArmor struct {
+	mu    sync.Mutex
+	key   *rsa.PublicKey
+	rules []gcpRule
+	// clobbers is how many of the sink's rule changes someone else undoes straight after
+	clobbers int
+	tokens   int
+	changes  int
+}
+
+func (f *FakeCloudArmor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/token" {
+		r.ParseForm()
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		digest := sha256.Sum256([]byte(strings.Join(parts[:2], ".")))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+		if len(parts) != 3 || rsa.VerifyPKCS1v15(f.key, crypto.SHA256, digest[:], signature) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "Invalid JWT Signature."})
+			return
+		}
+		f.tokens++
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token", "expires_in": 3600})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	const policyPath = "/projects/proj/global/securityPolicies/policy"
+	priority, _ := strconv.Atoi(r.URL.Query().Get("priority"))
+	switch {
+	case r.Method == "GET" && r.URL.Path == policyPath:
+		json.NewEncoder(w).Encode(gcpPolicy{Name: "policy", Rules: f.rules})
+		return
+	case r.URL.Path == policyPath+"/addRule":
+		var rule gcpRule
+		json.NewDecoder(r.Body).Decode(&rule)
+		f.rules = append(f.rules, rule)
+	case r.URL.Path == policyPath+"/patchRule":
+		var rule gcpRule
+		json.NewDecoder(r.Body).Decode(&rule)
+		for i := range f.rules {
+			if f.rules[i].Priority == priority {
+				f.rules[i] = rule
+			}
+		}
+	case r.URL.Path == policyPath+"/removeRule":
+		kept := []gcpRule{}
+		for _, rule := range f.rules {
+			if rule.Priority != priority {
+				kept = append(kept, rule)
+			}
+		}
+		f.rules = kept
+	case strings.HasPrefix(r.URL.Path, "/projects/proj/global/operations/"):
+		json.NewEncoder(w).Encode(gcpOperation{Name: "op", Status: "DONE"})
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if f.clobbers > 0 {
+		f.clobbers--
+		f.rules = f.rules[:1]
+	}
+	f.changes++
+	// changes come back running, and are done once they've been waited on
+	json.NewEncoder(w).Encode(gcpOperation{Name: fmt.Sprintf("op%d", f.changes), Status: "RUNNING"})
+}
+
+// ranges returns the sink's rules by priority
+func (f *FakeCloudArmor) ranges() map[int]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ranges := map[int]string{}
+	for _, rule := range f.rules {
+		if rule.Description == gcpRuleDescription {
+			ranges[rule.Priority] = strings.Join(rule.Match.Config.SrcIPRanges, ",")
+		}
+	}
+	return ranges
+}
+
+func newTestGCPSink(t *testing.T) (*GCPSink, *FakeCloudArmor) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	fake := &FakeCloudArmor{key: &key.PublicKey, rules: []gcpRule{{Priority: 2147483647, Action: "allow"}}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	credentials, _ := json.Marshal(gcpServiceAccount{
+		ClientEmail: "autowaf@proj.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    server.URL + "/token",
+	})
+	credentialsFile := filepath.Join(t.TempDir(), "key.json")
+	ioutil.WriteFile(credentialsFile, credentials, 0600)
+	sink := NewGCPSink(&EnvConfig{
+		GCPSecurityPolicy:   "policy",
+		GCPProject:          "proj",
+		GCPCredentialsFile:  credentialsFile,
+		GCPAPIURL:           server.URL,
+		GCPDenyAction:       "deny(403)",
+		GCPRulePriority:     1000,
+		GCPIPsPerRule:       2,
+		GCPMaxRules:         3,
+		GCPOperationTimeout: 5,
+	})
+	return sink, fake
+}
+
+func TestGCPSync(t *testing.T) {
+	sink, fake := newTestGCPSink(t)
+	entries := []BanEntry{
+		NewBanEntry("192.168.1.1", time.Time{}),
+		NewBanEntry("192.168.1.2", time.Time{}),
+		NewBanEntry("2001:db8::1", time.Time{}),
+	}
+	if err := sink.Sync(entries, false); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	ranges := fake.ranges()
+	if len(ranges) != 2 || ranges[1000] != "192.168.1.1/32,192.168.1.2/32" || ranges[1001] != "2001:db8::1/128" {
+		t.Logf("Unexpected rules: %v", ranges)
+		t.Fail()
+	}
+	// nothing changed, so the rules aren't touched, and the token is reused
+	changes := fake.changes
+	if err := sink.Sync(entries, false); err != nil || fake.changes != changes || fake.tokens != 1 {
+		t.Logf("Expected no changes and 1 token, got %d and %d (err: %v)", fake.changes-changes, fake.tokens, err)
+		t.Fail()
+	}
+	// a dry run doesn't change the rules
+	if err := sink.Sync(entries[:1], true); err != nil || fake.changes != changes {
+		t.Logf("A dry run shouldn't change the rules (err: %v)", err)
+		t.Fail()
+	}
+	// shrinking the list patches the first rule and removes the second, leaving the default rule
+	if err := sink.Sync(entries[:1], false); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	ranges = fake.ranges()
+	if len(ranges) != 1 || ranges[1000] != "192.168.1.1/32" || len(fake.rules) != 2 {
+		t.Logf("Unexpected rules: %v", fake.rules)
+		t.Fail()
+	}
+	// too many IPs for the rules allowed
+	for i := 3; i < 8; i++ {
+		entries = append(entries, NewBanEntry(fmt.Sprintf("192.168.1.%d", i), time.Time{}))
+	}
+	changes = fake.changes
+	if err := sink.Sync(entries, false); err == nil || fake.changes != changes {
+		t.Logf("Expected an error for too many rules (err: %v)", err)
+		t.Fail()
+	}
+}
+
+func TestGCPRulesChanged(t *testing.T) {
+	sink, fake := newTestGCPSink(t)
+	// the rule that's added is removed again by someone else, which the read back catches
+	fake.clobbers = 1
+	if err := sink.Sync([]BanEntry{NewBanEntry("192.168.1.1", time.Time{})}, false); err != nil || len(fake.ranges()) != 1 {
+		t.Logf("Expected the update to be retried (err: %v)", err)
+		t.Fail()
+	}
+	fake.clobbers = gcpUpdateAttempts
+	if err := sink.Sync([]BanEntry{NewBanEntry("192.168.1.2", time.Time{})}, false); err != ErrGCPPolicyChanged {
+		t.Logf("Expected ErrGCPPolicyChanged, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestGCPRemove(t *testing.T) {
+	sink, fake := newTestGCPSink(t)
+	sink.Sync([]BanEntry{NewBanEntry("192.168.1.1", time.Time{}), NewBanEntry("192.168.1.2", time.Time{})}, false)
+	if err := sink.Remove("192.168.1.1"); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.Fail()
+	}
+	ranges := []string{}
+	for _, r := range fake.ranges() {
+		ranges = append(ranges, r)
+	}
+	sort.Strings(ranges)
+	if len(ranges) != 1 || ranges[0] != "192.168.1.2/32" {
+		t.Logf("Unexpected rules: %v", ranges)
+		t.Fail()
+	}
+	if err := sink.Remove("192.168.1.1"); err != ErrIPNotFound {
+		t.Logf("Expected ErrIPNotFound, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestGCPForeignRule(t *testing.T) {
+	sink, fake := newTestGCPSink(t)
+	foreign := gcpRule{Priority: 1001, Action: "allow", Description: "office network"}
+	fake.rules = append(fake.rules, foreign)
+	entries := []BanEntry{
+		NewBanEntry("192.168.1.1", time.Time{}),
+		NewBanEntry("192.168.1.2", time.Time{}),
+		NewBanEntry("192.168.1.3", time.Time{}),
+	}
+	if err := sink.Sync(entries, false); err != ErrGCPForeignRule || fake.changes != 0 {
+		t.Logf("Expected ErrGCPForeignRule and no changes, got %v and %d changes", err, fake.changes)
+		t.Fail()
+	}
+	if err := sink.Remove("192.168.1.1"); err != ErrGCPForeignRule {
+		t.Logf("Expected ErrGCPForeignRule, got %v", err)
+		t.Fail()
+	}
+	if len(fake.rules) != 2 || fake.rules[1].Priority != 1001 || fake.rules[1].Action != "allow" ||
+		fake.rules[1].Description != foreign.Description {
+		t.Logf("The foreign rule shouldn't have been touched: %+v", fake.rules)
+		t.Fail()
+	}
+}
+
+func TestGCPBadKey(t *testing.T) {
+	sink, fake := newTestGCPSink(t)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	fake.key = &other.PublicKey
+	err := sink.Sync([]BanEntry{}, false)
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Logf("Expected the token error, got %v", err)
+		t.Fail()
+	}
+}
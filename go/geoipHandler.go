@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/rs/zerolog/log"
+)
+
+// geoIPCountry is the part of a GeoLite2 Country or City record autowaf uses
+type geoIPCountry struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	// the country the network is registered in, for networks without a located country
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// geoIPASN is a GeoLite2 ASN record
+type geoIPASN struct {
+	Number uint `maxminddb:"autonomous_system_number"`
+}
+
+// geoIPDatabase is one mmdb file and when it was last opened
+type geoIPDatabase struct {
+	path     string
+	reader   *maxminddb.Reader
+	modified time.Time
+	// the last error reloading it, so a file that stays broken is only audited once
+	lastError string
+}
+
+// GeoIP looks up the country and ASN of an IP in local GeoLite2 databases. Either
+// database can be left out. The files are reopened by Reload when they change, so
+// they can be updated without restarting autowaf.
+type GeoIP struct {
+	mu      sync.RWMutex
+	country geoIPDatabase
+	asn     geoIPDatabase
+}
+
+// NewGeoIP opens the country and ASN databases, returning nil when neither path is set
+func NewGeoIP(countryPath, asnPath string) (*GeoIP, error) {
+	if countryPath == "" && asnPath == "" {
+		return nil, nil
+	}
+	g := &GeoIP{country: geoIPDatabase{path: countryPath}, asn: geoIPDatabase{path: asnPath}}
+	for _, database := range []*geoIPDatabase{&g.country, &g.asn} {
+		if _, err := database.open(); err != nil {
+			g.Close()
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// open (re)opens the database if its file changed since it was last opened. The reader
+// it replaced is returned for the caller to close.
+func (d *geoIPDatabase) open() (*maxminddb.Reader, error) {
+	if d.path == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return nil, err
+	}
+	if d.reader != nil && info.ModTime().Equal(d.modified) {
+		return nil, nil
+	}
+	// the file is read rather than mapped, so an update written over it in place can't
+	// change the database under a lookup
+	content, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.FromBytes(content)
+	if err != nil {
+		return nil, err
+	}
+	old := d.reader
+	d.reader = reader
+	d.modified = info.ModTime()
+	return old, nil
+}
+
+// Reload reopens the databases whose files have changed. A file that can't be opened
+// leaves the database that's already open in use.
+func (g *GeoIP) Reload() {
+	if g == nil {
+		return
+	}
+	for _, database := range []*geoIPDatabase{&g.country, &g.asn} {
+		g.mu.Lock()
+		old, err := database.open()
+		g.mu.Unlock()
+		if err != nil {
+			log.Error().Str("Error", err.Error()).Str("Path", database.path).Msg("Error reloading GeoIP database")
+			if err.Error() != database.lastError {
+				database.lastError = err.Error()
+				RecordSystemAction(AdminActionGeoIPReload, map[string]string{"path": database.path}, "failed: "+err.Error())
+			}
+			continue
+		}
+		// nothing can still be reading the old one once the lock has been taken
+		if old != nil {
+			old.Close()
+			database.lastError = ""
+			log.Info().Str("Path", database.path).Msg("Reloaded GeoIP database")
+			RecordSystemAction(AdminActionGeoIPReload, map[string]string{"path": database.path}, "success")
+		}
+	}
+}
+
+// Close closes the databases
+func (g *GeoIP) Close() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, database := range []*geoIPDatabase{&g.country, &g.asn} {
+		if database.reader != nil {
+			database.reader.Close()
+			database.reader = nil
+		}
+	}
+}
+
+// Lookup returns the ISO country code and the autonomous system number of ip, empty
+// and 0 when they aren't known
+func (g *GeoIP) Lookup(ip string) (string, uint) {
+	parsed := net.ParseIP(ip)
+	if g == nil || parsed == nil {
+		return "", 0
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var country string
+	if g.country.reader != nil {
+		var record geoIPCountry
+		if err := g.country.reader.Lookup(parsed, &record); err != nil {
+			log.Debug().Str("Error", err.Error()).Str("IP", ip).Msg("Error looking up country")
+		}
+		country = record.Country.ISOCode
+		if country == "" {
+			country = record.RegisteredCountry.ISOCode
+		}
+	}
+	var asn uint
+	if g.asn.reader != nil {
+		var record geoIPASN
+		if err := g.asn.reader.Lookup(parsed, &record); err != nil {
+			log.Debug().Str("Error", err.Error()).Str("IP", ip).Msg("Error looking up ASN")
+		}
+		asn = record.Number
+	}
+	return strings.ToUpper(country), asn
+}
+
+// Enrich sets the country and ASN of the record's IP
+func (g *GeoIP) Enrich(record *NewFailure) {
+	record.Country, record.ASN = g.Lookup(record.IP)
+}
+
+// ParseASNs parses autonomous system numbers, with or without an AS prefix
+func ParseASNs(values []string) ([]uint, error) {
+	asns := []uint{}
+	for _, value := range values {
+		number, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(value), "AS"), 10, 32)
+		if err != nil || number == 0 {
+			return nil, fmt.Errorf("%s isn't an autonomous system number", value)
+		}
+		asns = append(asns, uint(number))
+	}
+	return asns, nil
+}
+
+// reloadGeoIP checks the GeoIP databases for new files every tick
+func reloadGeoIP(g *GeoIP, ticker *time.Ticker, quit *chan string) {
+	for {
+		select {
+		case <-ticker.C:
+			g.Reload()
+		case <-*quit:
+			ticker.Stop()
+			log.Debug().Msg("Exiting GeoIP reload")
+			return
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mmdbString encodes a string in the MaxMind DB data format
+func mmdbString(value string) []byte {
+	return append([]byte{0x40 | byte(len(value))}, value...)
+}
+
+// mmdbUint32 encodes a uint32
+func mmdbUint32(value uint32) []byte {
+	encoded := []byte{0xc0 | 4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(encoded[1:], value)
+	return encoded
+}
+
+// mmdbMap encodes a map from key/encoded value pairs
+func mmdbMap(pairs ...interface{}) []byte {
+	encoded := []byte{0xe0 | byte(len(pairs)/2)}
+	for i := 0; i < len(pairs); i += 2 {
+		encoded = append(encoded, mmdbString(pairs[i].(string))...)
+		encoded = append(encoded, pairs[i+1].([]byte)...)
+	}
+	return encoded
+}
+
+// writeTestMMDB writes an IPv4 MaxMind DB with 24 bit records mapping each network to its
+// encoded record
+func writeTestMMDB(t *testing.T, path string, records map[string][]byte) {
+	// a record is 0 when it's empty, a node index when it's positive and -(data offset + 1)
+	// when it points at data. The root is node 0, so no record points back at it.
+	nodes := [][2]int{{0, 0}}
+	data := []byte{}
+	for cidr, record := range records {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Bad test network %s", cidr)
+		}
+		ones, _ := network.Mask.Size()
+		ip := network.IP.To4()
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -(len(data) + 1)
+				break
+			}
+			if nodes[node][bit] <= 0 {
+				nodes = append(nodes, [2]int{0, 0})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		data = append(data, record...)
+	}
+	nodeCount := len(nodes)
+	content := []byte{}
+	for _, node := range nodes {
+		for _, record := range node {
+			value := nodeCount
+			if record > 0 {
+				value = record
+			} else if record < 0 {
+				value = nodeCount + 16 + (-record - 1)
+			}
+			content = append(content, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	content = append(content, make([]byte, 16)...)
+	content = append(content, data...)
+	content = append(content, []byte("\xAB\xCD\xEFMaxMind.com")...)
+	content = append(content, mmdbMap(
+		"node_count", mmdbUint32(uint32(nodeCount)),
+		"record_size", mmdbUint32(24),
+		"ip_version", mmdbUint32(4),
+		"database_type", mmdbString("autowaf-test"),
+		"binary_format_major_version", mmdbUint32(2),
+	)...)
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Error writing test database: %s", err)
+	}
+}
+
+func testCountryRecord(key, country string) []byte {
+	return mmdbMap(key, mmdbMap("iso_code", mmdbString(country)))
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	dir := t.TempDir()
+	countryPath := filepath.Join(dir, "GeoLite2-Country.mmdb")
+	asnPath := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+	writeTestMMDB(t, countryPath, map[string][]byte{
+		"192.0.2.0/24":    testCountryRecord("country", "DE"),
+		"198.51.100.0/24": testCountryRecord("registered_country", "NL"),
+	})
+	writeTestMMDB(t, asnPath, map[string][]byte{
+		"192.0.2.0/25": mmdbMap("autonomous_system_number", mmdbUint32(16509)),
+	})
+	g, err := NewGeoIP(countryPath, asnPath)
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	defer g.Close()
+	cases := []struct {
+		ip      string
+		country string
+		asn     uint
+	}{
+		{"192.0.2.10", "DE", 16509},
+		{"192.0.2.200", "DE", 0},
+		{"198.51.100.1", "NL", 0},
+		{"203.0.113.1", "", 0},
+		{"2001:db8::1", "", 0},
+		{"not an address", "", 0},
+	}
+	for _, c := range cases {
+		if country, asn := g.Lookup(c.ip); country != c.country || asn != c.asn {
+			t.Logf("%s: expected %s/%d, got %s/%d", c.ip, c.country, c.asn, country, asn)
+			t.Fail()
+		}
+	}
+	record := NewFailure{IP: "192.0.2.10"}
+	g.Enrich(&record)
+	if record.Country != "DE" || record.ASN != 16509 {
+		t.Logf("Unexpected enrichment: %+v", record)
+		t.Fail()
+	}
+}
+
+func TestGeoIPReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "GeoLite2-Country.mmdb")
+	writeTestMMDB(t, path, map[string][]byte{"192.0.2.0/24": testCountryRecord("country", "DE")})
+	g, err := NewGeoIP(path, "")
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	defer g.Close()
+	writeTestMMDB(t, path, map[string][]byte{"192.0.2.0/24": testCountryRecord("country", "FR")})
+	os.Chtimes(path, time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	g.Reload()
+	if country, _ := g.Lookup("192.0.2.1"); country != "FR" {
+		t.Logf("Expected the new database to be used, got %s", country)
+		t.Fail()
+	}
+	// a broken update leaves the last good database in use
+	ioutil.WriteFile(path, []byte("not a database"), 0644)
+	os.Chtimes(path, time.Now().Add(2*time.Hour), time.Now().Add(2*time.Hour))
+	g.Reload()
+	if country, _ := g.Lookup("192.0.2.1"); country != "FR" {
+		t.Logf("Expected the old database to still be used, got %s", country)
+		t.Fail()
+	}
+}
+
+func TestNewGeoIPDisabled(t *testing.T) {
+	g, err := NewGeoIP("", "")
+	if g != nil || err != nil {
+		t.Logf("Expected no GeoIP without databases (err: %v)", err)
+		t.Fail()
+	}
+	// events are still taken without the databases
+	record := NewFailure{IP: "192.0.2.10"}
+	g.Enrich(&record)
+	if record.Country != "" || record.ASN != 0 {
+		t.Logf("Unexpected enrichment: %+v", record)
+		t.Fail()
+	}
+	if _, err := NewGeoIP(filepath.Join(t.TempDir(), "missing.mmdb"), ""); err == nil {
+		t.Logf("Expected an error for a missing database")
+		t.Fail()
+	}
+}
+
+func TestParseASNs(t *testing.T) {
+	asns, err := ParseASNs([]string{"16509", "AS14061", "as24940"})
+	if err != nil || len(asns) != 3 || asns[0] != 16509 || asns[1] != 14061 || asns[2] != 24940 {
+		t.Logf("Unexpected ASNs: %v (err: %v)", asns, err)
+		t.Fail()
+	}
+	for _, bad := range []string{"ASX", "0", "-1", "4294967296"} {
+		if _, err := ParseASNs([]string{bad}); err == nil {
+			t.Logf("Expected an error for %s", bad)
+			t.Fail()
+		}
+	}
+}
@@ -3,11 +3,16 @@ module github.com/livinginsyn/autowaf
 go 1.17
 
 require (
-	github.com/aws/aws-sdk-go v1.41.19 // indirect
-	github.com/cloudfoundry-community/go-cfenv v1.18.0 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/aws/aws-sdk-go v1.41.19
+	github.com/cloudfoundry-community/go-cfenv v1.18.0
+	github.com/gorilla/mux v1.8.0
+	github.com/lib/pq v1.10.3
+	github.com/oschwald/maxminddb-golang v1.8.0
+	github.com/rs/zerolog v1.26.0
+)
+
+require (
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	github.com/lib/pq v1.10.3 // indirect
 	github.com/mitchellh/mapstructure v1.1.2 // indirect
-	github.com/rs/zerolog v1.26.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
 )
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// the biggest feed that's read
+const intelMaxBytes = 64 * 1048576
+
+// IntelFeed is an external blocklist, fetched from a URL or read from a local file
+type IntelFeed struct {
+	Name     string
+	Location string
+}
+
+// IntelFetcher returns the contents of a feed's location
+type IntelFetcher func(location string) ([]byte, error)
+
+// ParseIntelFeeds parses a comma separated list of name=location feeds
+func ParseIntelFeeds(value string) ([]IntelFeed, error) {
+	feeds := []IntelFeed{}
+	seen := map[string]bool{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("%s should be name=url or name=path", item)
+		}
+		if !identifierPattern.MatchString(parts[0]) {
+			return nil, fmt.Errorf("feed name %s should be up to 64 letters, digits, '_', '.' or '-'", parts[0])
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("feed name %s is used twice", parts[0])
+		}
+		seen[parts[0]] = true
+		feeds = append(feeds, IntelFeed{Name: parts[0], Location: parts[1]})
+	}
+	return feeds, nil
+}
+
+// ParseIntelList reads the networks in a feed. It takes one address or CIDR per line, with
+// anything after a '#' or ';' ignored, which covers plain lists, Spamhaus DROP and FireHOL
+// netsets. It returns the networks and the number of lines it couldn't read.
+func ParseIntelList(content []byte) ([]*net.IPNet, int) {
+	networks := []*net.IPNet{}
+	seen := map[string]bool{}
+	invalid := 0
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.IndexAny(line, "#;"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		value := fields[0]
+		if !strings.Contains(value, "/") {
+			value = hostCIDR(value)
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			invalid++
+			continue
+		}
+		if !seen[network.String()] {
+			seen[network.String()] = true
+			networks = append(networks, network)
+		}
+	}
+	return networks, invalid
+}
+
+// fetchIntel gets location over HTTP(S), or reads it from disk when it isn't a URL
+func fetchIntel(location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return ioutil.ReadFile(location)
+	}
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", location, resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, intelMaxBytes))
+}
+
+// ImportIntelFeed fetches feed and replaces its entries in the database. A feed that can't be
+// fetched or doesn't list anything is left as it was, so a failed download doesn't unban
+// everything it listed.
+func ImportIntelFeed(db *sql.DB, feed IntelFeed, fetch IntelFetcher, now time.Time) (int, error) {
+	content, err := fetch(feed.Location)
+	if err != nil {
+		return 0, err
+	}
+	networks, invalid := ParseIntelList(content)
+	if invalid > 0 {
+		log.Warn().Str("Feed", feed.Name).Int("Lines", invalid).Msg("Skipped threat intel lines that aren't addresses or CIDRs")
+	}
+	if len(networks) == 0 {
+		return 0, fmt.Errorf("feed %s didn't list any addresses", feed.Name)
+	}
+	if err := StoreIntelEntries(db, feed.Name, networks, now); err != nil {
+		return 0, err
+	}
+	return len(networks), nil
+}
+
+// importIntelFeeds is the background task that imports the threat intel feeds, once at the
+// start and then on a timer
+func importIntelFeeds(ticker *time.Ticker, quit *chan string) {
+	imported := RegisterCounter("autowaf_intel_imports_total", "Threat intel feed imports that succeeded")
+	failed := RegisterCounter("autowaf_intel_import_failures_total", "Threat intel feed imports that failed")
+	importAll := func() {
+		for _, feed := range envConfig.IntelFeeds {
+			count, err := ImportIntelFeed(db, feed, fetchIntel, time.Now().UTC())
+			if err != nil {
+				failed.Inc()
+				log.Error().Str("Error", err.Error()).Str("Feed", feed.Name).Msg("Error importing threat intel feed")
+				RecordSystemAction(AdminActionIntelReload, map[string]string{"feed": feed.Name}, "failed: "+err.Error())
+				continue
+			}
+			imported.Inc()
+			log.Info().Str("Feed", feed.Name).Int("Count", count).Msg("Imported threat intel feed")
+			RecordSystemAction(AdminActionIntelReload, map[string]interface{}{"feed": feed.Name, "count": count}, "success")
+		}
+	}
+	importAll()
+	for {
+		select {
+		case <-ticker.C:
+			importAll()
+		case <-*quit:
+			ticker.Stop()
+			log.Debug().Msg("Exiting threat intel import")
+			return
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseIntelFeeds(t *testing.T) {
+	feeds, err := ParseIntelFeeds("spamhaus=https://www.spamhaus.org/drop/drop.txt, local=/etc/autowaf/bad.txt")
+	if err != nil || len(feeds) != 2 || feeds[1].Name != "local" || feeds[1].Location != "/etc/autowaf/bad.txt" {
+		t.Logf("Unexpected feeds: %v (err: %v)", feeds, err)
+		t.Fail()
+	}
+	for _, bad := range []string{"nolocation", "a=x,a=y", "bad name=x", "empty="} {
+		if _, err := ParseIntelFeeds(bad); err == nil {
+			t.Logf("Expected an error for %s", bad)
+			t.Fail()
+		}
+	}
+}
+
+func TestParseIntelList(t *testing.T) {
+	content := `; Spamhaus DROP List 2021/11/01
+1.10.16.0/20 ; SBL256894
+#
+# FireHOL netset
+2.56.192.0/22
+203.0.113.7
+2001:db8::/32 # comment
+203.0.113.7/32
+not an address
+`
+	networks, invalid := ParseIntelList([]byte(content))
+	expected := []string{"1.10.16.0/20", "2.56.192.0/22", "203.0.113.7/32", "2001:db8::/32"}
+	if len(networks) != len(expected) || invalid != 1 {
+		t.Logf("Unexpected networks: %v, %d invalid", networks, invalid)
+		t.FailNow()
+	}
+	for i := range expected {
+		if networks[i].String() != expected[i] {
+			t.Logf("Expected %s, got %s", expected[i], networks[i])
+			t.Fail()
+		}
+	}
+}
+
+func TestFetchIntel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/drop.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("192.0.2.0/24 ; SBL1\n"))
+	}))
+	defer server.Close()
+	content, err := fetchIntel(server.URL + "/drop.txt")
+	if err != nil || string(content) != "192.0.2.0/24 ; SBL1\n" {
+		t.Logf("Unexpected content: %q (err: %v)", content, err)
+		t.Fail()
+	}
+	if _, err := fetchIntel(server.URL + "/missing.txt"); err == nil {
+		t.Logf("Expected an error for a 404")
+		t.Fail()
+	}
+	path := filepath.Join(t.TempDir(), "bad.txt")
+	ioutil.WriteFile(path, []byte("198.51.100.1\n"), 0644)
+	if content, err := fetchIntel(path); err != nil || string(content) != "198.51.100.1\n" {
+		t.Logf("Unexpected content: %q (err: %v)", content, err)
+		t.Fail()
+	}
+}
+
+func TestImportIntelFeedEmpty(t *testing.T) {
+	// an empty download doesn't touch the database, so a nil db is fine
+	fetch := func(location string) ([]byte, error) { return []byte("# nothing today\n"), nil }
+	if _, err := ImportIntelFeed(nil, IntelFeed{Name: "empty", Location: "x"}, fetch, time.Now()); err == nil {
+		t.Logf("Expected an error for a feed without addresses")
+		t.Fail()
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	allow, err := ParseAllowList([]string{"203.0.113.7", "198.51.100.0/24", "2001:db8::1"})
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	networks, _ := ParseIntelList([]byte("203.0.113.0/24\n192.0.2.0/24\n"))
+	entries := []BanEntry{
+		NewBanEntry("203.0.113.7", time.Time{}),
+		NewBanEntry("198.51.100.9", time.Time{}),
+		NewBanEntry("2001:db8::1", time.Time{}),
+		NewBanEntry("192.168.1.1", time.Time{}),
+		// contains an allowed address
+		NewNetworkBanEntry(networks[0], time.Time{}),
+		NewNetworkBanEntry(networks[1], time.Time{}),
+	}
+	kept := allow.Filter(entries)
+	if len(kept) != 2 || kept[0].CIDR != "192.168.1.1/32" || kept[1].CIDR != "192.0.2.0/24" {
+		t.Logf("Unexpected entries: %v", kept)
+		t.Fail()
+	}
+	if _, err := ParseAllowList([]string{"not an address"}); err == nil {
+		t.Logf("Expected an error for a bad address")
+		t.Fail()
+	}
+}
+
+func TestNewNetworkBanEntry(t *testing.T) {
+	networks, _ := ParseIntelList([]byte("203.0.113.7/32\n192.0.2.0/24\n"))
+	host := NewNetworkBanEntry(networks[0], time.Time{})
+	if host.IP != "203.0.113.7" || host.CIDR != "203.0.113.7/32" {
+		t.Logf("Expected a single address entry, got %v", host)
+		t.Fail()
+	}
+	network := NewNetworkBanEntry(networks[1], time.Time{})
+	if network.IP != "192.0.2.0/24" || network.CIDR != "192.0.2.0/24" {
+		t.Logf("Expected a network entry, got %v", network)
+		t.Fail()
+	}
+}
+
+func TestNewBanEntryMappedAddress(t *testing.T) {
+	entry := NewBanEntry("::ffff:192.168.1.2", time.Time{})
+	if entry.IP != "192.168.1.2" || entry.CIDR != "192.168.1.2/32" {
+		t.Logf("Expected the IPv4 address, got %v", entry)
+		t.Fail()
+	}
+	if entry := NewBanEntry("2001:DB8::1", time.Time{}); entry.IP != "2001:db8::1" || entry.CIDR != "2001:db8::1/128" {
+		t.Logf("Expected the IPv6 address, got %v", entry)
+		t.Fail()
+	}
+}
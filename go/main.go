@@ -7,11 +7,15 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/wafv2"
 	"github.com/cloudfoundry-community/go-cfenv"
 	"github.com/gorilla/mux"
@@ -23,6 +27,10 @@ import (
 var db *sql.DB
 var awsSessions []*session.Session
 var envConfig EnvConfig
+var banQueue *BanQueue
+
+// geoIP enriches failures with their country and ASN, nil when no databases are set
+var geoIP *GeoIP
 
 // NewFailure is the event coming in for logon failures
 type NewFailure struct {
@@ -31,6 +39,40 @@ type NewFailure struct {
 	Username string    `json:"username"`
 	Pwhash   string    `json:"pwhash"`
 	Reason   string    `json:"reason"`
+	// optional request metadata, stored as JSON and matched by scoped policies
+	UserAgent    string            `json:"user_agent,omitempty"`
+	App          string            `json:"app,omitempty"`
+	Endpoint     string            `json:"endpoint,omitempty"`
+	ForwardedFor []string          `json:"forwarded_for,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	// where the IP is, set from the GeoIP databases at ingest and never taken from the client
+	Country string `json:"-"`
+	ASN     uint   `json:"-"`
+	// what the failure counts for, set by ReasonWeights.Apply when it's stored. The backtest
+	// reads them back rather than weighing the reason again.
+	Weight        float64 `json:"-"`
+	ReasonIgnored bool    `json:"-"`
+	// set by GetAuditEvents for failures that stopped counting when an admin unblocked the IP
+	Unblocked bool `json:"-"`
+	// the stored values under every pepper key, set by Pepper.Apply
+	pwhashMatches   []string
+	usernameMatches []string
+}
+
+// PwhashMatches returns the values a stored pwhash can have for this record
+func (record *NewFailure) PwhashMatches() []string {
+	if record.pwhashMatches == nil {
+		return []string{record.Pwhash}
+	}
+	return record.pwhashMatches
+}
+
+// UsernameMatches returns the values a stored username can have for this record
+func (record *NewFailure) UsernameMatches() []string {
+	if record.usernameMatches == nil {
+		return []string{record.Username}
+	}
+	return record.usernameMatches
 }
 
 // HealthCheck is the oject returned to a health check
@@ -41,6 +83,19 @@ type HealthCheck struct {
 // UnbanRequest is the request object to unban an IP
 type UnbanRequest struct {
 	IP string `json:"ip"`
+	// ExemptHours, when set, also stops the IP from being banned again for that many hours
+	ExemptHours int    `json:"exempt_hours"`
+	Operator    string `json:"operator"`
+	Reason      string `json:"reason"`
+}
+
+// BanRequest is the body of /banIP
+type BanRequest struct {
+	IP string `json:"ip"`
+	// Table is short_ban or long_ban, short_ban when it's left out
+	Table    string `json:"table"`
+	Operator string `json:"operator"`
+	Reason   string `json:"reason"`
 }
 
 // updateBlockLists is the background task that runs on a timer
@@ -53,35 +108,22 @@ func updateBlockLists(ticker *time.Ticker, quit *chan string) {
 			CleanOldSQL(db, "short_ban", envConfig.ShortTermPeriod)
 			CleanOldSQL(db, "long_ban", envConfig.LongTermPeriod)
 			CleanOldSQL(db, "logon_audit", envConfig.RetentionPeriod*60)
+			CleanOldSQL(db, "webhook_outbox", envConfig.RetentionPeriod*24)
+			CleanOldSQL(db, "ban_history", envConfig.RetentionPeriod*24)
+			CleanShadowBans(db, envConfig.ShadowPolicies)
+			CleanTrustedIPs(db)
+			CleanExemptions(db)
+			CleanIntel(db, envConfig.IntelMaxAge)
+			CleanFederationReports(db, envConfig.FederationQuorumWindow)
 			// get new+current
-			iplist := make(map[string]*string)
-			GetRecords(db, "short_ban", iplist)
-			GetRecords(db, "long_ban", iplist)
+			banList := currentBanList(db)
 
 			log.Debug().Msg("Outputting IPs to ban")
-			//make a list of pointers to the ips
-			//needed for UpdateIPSet() UpdateIPSetInput
-			ipStrPnts := make([]*string, len(iplist))
-			cntr := 0
-			for ipaddr := range iplist {
-				log.Debug().Str("IP", ipaddr).Msg("Banning IP")
-				ipStrPnts[cntr] = iplist[ipaddr]
-				cntr = cntr + 1
-			}
-			//update AWS regions
-			for _, session := range awsSessions {
-				wafclient := wafv2.New(session)
-				ipset, err := GetIPSet(wafclient.ListIPSets, &envConfig)
-				if err != nil {
-					log.Error().
-						Str("Error", err.Error()).
-						Str("IPset Name", envConfig.BlockListName).
-						Msg("Couldn't find an ipset")
-					continue
-				}
-				// error is handled/logged in this function
-				_ = UpdateIPSet(ipStrPnts, wafclient.UpdateIPSet, ipset)
+			for _, entry := range banList {
+				log.Debug().Str("IP", entry.CIDR).Msg("Banning IP")
 			}
+			//update AWS regions and the other sinks
+			syncSinks(banList, envConfig.DryRun)
 		case <-*quit:
 			ticker.Stop()
 			log.Debug().Msg("Exiting background timer")
@@ -90,6 +132,21 @@ func updateBlockLists(ticker *time.Ticker, quit *chan string) {
 	}
 }
 
+// logIPSetDiff logs what updating ipset with iplist would change, for dry runs
+func logIPSetDiff(ipSetGetter IPSetGetter, ipset *wafv2.IPSetSummary, iplist []*string, region string) {
+	current, err := GetIPSetAddresses(ipSetGetter, ipset)
+	if err != nil {
+		return
+	}
+	added, removed := DiffAddresses(current, iplist)
+	log.Info().
+		Str("Region", region).
+		Str("IPset Name", *ipset.Name).
+		Strs("Added", added).
+		Strs("Removed", removed).
+		Msg("Dry run: not updating ipset")
+}
+
 // APIs
 func logonFailureWriter(w http.ResponseWriter, r *http.Request) {
 	log.Debug().Msg("Logon Failure Writer Starting")
@@ -114,20 +171,65 @@ func logonFailureWriter(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	// write the new record to the database
-	err = InsertEvent(db, &newRecord)
+	if _, err := newRecord.Metadata(); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(err.Error())
+		return
+	}
+	// write the new record to the database and queue it for evaluation
+	err = ingestFailure(&newRecord)
+	if err == ErrQueueFull {
+		log.Warn().Str("IP", newRecord.IP).Msg("Ban evaluation queue is saturated, rejecting event")
+		w.Header().Set("Retry-After", strconv.Itoa(envConfig.QueueRetryAfter))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	log.Debug().Msg("Inserted event into logon_audit")
-	//async call check and inserts
-	go CheckAndInsert(db, &newRecord, "short_ban", envConfig.ShortTermPeriod, envConfig.ShortTermLimit)
-	go CheckAndInsert(db, &newRecord, "long_ban", envConfig.LongTermPeriod, envConfig.LongTermLimit)
 	//return to user
 	w.WriteHeader(http.StatusOK)
 }
 
+// ingestFailure stores a logon failure and queues it for ban evaluation.
+// Every source of failure events should go through here.
+func ingestFailure(record *NewFailure) error {
+	// turn the event away before it's stored so that a retry doesn't count twice
+	if err := banQueue.Admit(); err != nil {
+		return err
+	}
+	envConfig.Pepper.Apply(record)
+	geoIP.Enrich(record)
+	envConfig.ReasonWeights.Apply(record)
+	err := InsertEvent(db, record)
+	if err != nil {
+		return err
+	}
+	log.Debug().Msg("Inserted event into logon_audit")
+	// done before the event is evaluated, so the counts don't see this user twice across a key rotation
+	if err := RekeyEvent(db, record); err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error moving old pepper key values onto the active key")
+	}
+	if record.ReasonIgnored {
+		// it's kept for the audit but never counts, so there's nothing to evaluate
+		return nil
+	}
+	if err := banQueue.Enqueue(record); err != nil {
+		// the event is stored, so it still counts the next time this IP is evaluated
+		log.Warn().Str("IP", record.IP).Msg("Ban evaluation queue filled up, skipping evaluation")
+	}
+	return nil
+}
+
+// evaluateBans is run by the ban queue workers for every stored event
+func evaluateBans(record *NewFailure) {
+	policies := envConfig.BanPolicies()
+	for i := range policies {
+		CheckAndInsert(db, record, &policies[i])
+	}
+}
+
 func healthCheckWriter(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -152,27 +254,39 @@ func unblockIP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err := json.Unmarshal(body, &unbanObj); err != nil {
+		RecordAdminAction(r, AdminActionUnblock, "", body, "rejected: "+err.Error())
 		w.WriteHeader(422) // unprocessable entity
 		if err := json.NewEncoder(w).Encode(err); err != nil {
 			panic(err)
 		}
 		return
 	}
+	if net.ParseIP(unbanObj.IP) == nil {
+		RecordAdminAction(r, AdminActionUnblock, unbanObj.Operator, body, "rejected: invalid ip")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode("ip must be an IP address")
+		return
+	}
+	if unbanObj.ExemptHours < 0 || unbanObj.ExemptHours > envConfig.ExemptionMaxHours {
+		RecordAdminAction(r, AdminActionUnblock, unbanObj.Operator, body, "rejected: invalid exempt_hours")
+		w.WriteHeader(422)
+		json.NewEncoder(w).Encode(fmt.Sprintf("exempt_hours must be between 0 and %d", envConfig.ExemptionMaxHours))
+		return
+	}
 
 	trueErr := 0
+	// exempt the IP first so that new failures can't ban it again while it's being unbanned
+	if unbanObj.ExemptHours > 0 {
+		if err := ExemptIP(db, unbanObj.IP, unbanObj.Operator, unbanObj.Reason, unbanObj.ExemptHours); err != nil {
+			trueErr += 1
+		}
+	}
 	// update the DB
 	c := make(chan error)
 	go IgnoreIPRecords(db, unbanObj.IP, c)
 
-	//update AWS
-	for _, session := range awsSessions {
-		wafclient := wafv2.New(session)
-		err := RemoveIPfromIPSet(wafclient.ListIPSets, wafclient.GetIPSet,
-			wafclient.UpdateIPSet, &envConfig, &unbanObj.IP)
-		if (err != nil) && (err != ErrIPNotFound) {
-			trueErr += 1
-		}
-	}
+	//update AWS and the other sinks
+	trueErr += removeFromSinks(unbanObj.IP)
 
 	//get result from db update
 	dberr := <-c
@@ -181,36 +295,108 @@ func unblockIP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if trueErr != 0 {
+		RecordAdminAction(r, AdminActionUnblock, unbanObj.Operator, body, fmt.Sprintf("failed: %d errors", trueErr))
 		w.WriteHeader(http.StatusInternalServerError)
 	} else {
+		RecordAdminAction(r, AdminActionUnblock, unbanObj.Operator, body, "success")
+		emitBanEvent(BanEvent{Type: EventIPUnblocked, IP: unbanObj.IP, Ts: time.Now().UTC()})
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
-func main() {
-	// command line args
-	noBgTaskFlag := flag.Bool("nobgtask", false, "turn off the background task that updates the WAF")
-	localDbgFlag := flag.Bool("ldb", false, "")
-	flag.Parse()
-	// parse environmental variables
-	envConfig = GetEnvVars()
-	if *localDbgFlag {
-		envConfig.DBPort = 54320
-		envConfig.UpdateRate = 1
+func banIP(w http.ResponseWriter, r *http.Request) {
+	log.Debug().Msg("New ban IP request")
+	var banObj BanRequest
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		log.Warn().Str("Error", err.Error()).Msg("Error reading http request body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := r.Body.Close(); err != nil {
+		log.Warn().Str("Error", err.Error()).Msg("Error closing request body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(body, &banObj); err != nil {
+		RecordAdminAction(r, AdminActionBan, "", body, "rejected: "+err.Error())
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(err)
+		return
+	}
+	if banObj.Table == "" {
+		banObj.Table = "short_ban"
+	}
+	if net.ParseIP(banObj.IP) == nil || !validTable(banObj.Table) {
+		RecordAdminAction(r, AdminActionBan, banObj.Operator, body, "rejected: invalid ip or table")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode("ip must be an IP address and table short_ban or long_ban")
+		return
+	}
+	// the ban reaches the sinks on the next run of the WAF update task, like any other
+	if err := InsertBan(db, banObj.IP, banObj.Table); err != nil {
+		RecordAdminAction(r, AdminActionBan, banObj.Operator, body, "failed: "+err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
-	var pgURI string
-	if !*localDbgFlag {
+	RecordAdminAction(r, AdminActionBan, banObj.Operator, body, "success")
+	w.WriteHeader(http.StatusOK)
+}
+
+// openDatabase connects to the database from cloudfoundry's environmental variables,
+// or to the local debug database described by envConfig when localDbg is set
+func openDatabase(localDbg bool) *sql.DB {
+	var psqlInfo string
+	if !localDbg {
 		appEnv, _ := cfenv.Current()
 		rdsService, err := appEnv.Services.WithNameUsingPattern(".{1,}-autowaf")
 		if err != nil {
 			log.Fatal().Str("Error", err.Error()).Msg("Failed to find autowaf service in env")
 		}
 
-		var ok bool
-		pgURI, ok = rdsService[0].CredentialString("uri")
+		pgURI, ok := rdsService[0].CredentialString("uri")
 		if !ok {
 			log.Fatal().Msg("Couldn't load pg URI from cfenv")
 		}
+		psqlInfo = pgURI
+	} else {
+		psqlInfo = fmt.Sprintf("host=%s port=%d user=%s "+
+			"password=%s dbname=%s sslmode=disable",
+			envConfig.DBHostname, envConfig.DBPort, envConfig.DBUserName, envConfig.DBpw, envConfig.DBName)
+	}
+
+	database, err := sql.Open("postgres", psqlInfo)
+	if err != nil {
+		log.Fatal().Str("Error", err.Error()).Msg("Couldn't open database")
+	}
+	return database
+}
+
+func main() {
+	// subcommands
+	if len(os.Args) > 1 && os.Args[1] == "backtest" {
+		runBacktest(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		runKeygen()
+		return
+	}
+	// command line args
+	noBgTaskFlag := flag.Bool("nobgtask", false, "turn off the background task that updates the WAF")
+	localDbgFlag := flag.Bool("ldb", false, "")
+	dryRunFlag := flag.Bool("dryrun", false, "log the changes the background task would make to the WAF instead of making them")
+	flag.Parse()
+	// parse environmental variables
+	envConfig = GetEnvVars()
+	if *dryRunFlag {
+		envConfig.DryRun = true
+	}
+	if *localDbgFlag {
+		envConfig.DBPort = 54320
+		envConfig.UpdateRate = 1
 	}
 	// configure logger
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
@@ -230,28 +416,41 @@ func main() {
 			},
 		})))
 	}
-	// for _, session := range awsSessions {
-	// 	log.Info().Str("region", *session.Config.Region).Msg("Debug region")
-	// }
-
-	// setup DB
-	var err error
-	var psqlInfo string
-	if !*localDbgFlag {
-		psqlInfo = pgURI
-	} else {
-		psqlInfo = fmt.Sprintf("host=%s port=%d user=%s "+
-			"password=%s dbname=%s sslmode=disable",
-			envConfig.DBHostname, envConfig.DBPort, envConfig.DBUserName, envConfig.DBpw, envConfig.DBName)
+	for _, session := range awsSessions {
+		sinks = append(sinks, NewAWSSink(session, &envConfig))
+	}
+	if envConfig.CloudflareListID != "" {
+		sinks = append(sinks, NewCloudflareSink(&envConfig))
+	}
+	if envConfig.DenyFilePath != "" {
+		sinks = append(sinks, NewDenyFileSink(&envConfig))
+	}
+	if envConfig.FirewallBackend != "" {
+		sinks = append(sinks, NewFirewallSink(&envConfig))
+	}
+	if envConfig.AzurePolicyName != "" {
+		sinks = append(sinks, NewAzureSink(&envConfig))
+	}
+	if envConfig.GCPSecurityPolicy != "" {
+		sinks = append(sinks, NewGCPSink(&envConfig))
 	}
 
-	db, err = sql.Open("postgres", psqlInfo)
+	// open the GeoIP databases before any events come in
+	var err error
+	geoIP, err = NewGeoIP(envConfig.GeoIPCountryDB, envConfig.GeoIPASNDB)
 	if err != nil {
-		log.Fatal().Str("Error", err.Error()).Msg("Couldn't open database")
+		log.Fatal().Str("Error", err.Error()).Msg("Error opening GeoIP database")
 	}
 
+	// setup DB
+	db = openDatabase(*localDbgFlag)
+
 	log.Debug().Msg("Creating database tables (if not exists)")
 	CreateTablesIfNotExist(db)
+	RecordConfigLoad(&envConfig)
+
+	// start the workers that evaluate incoming events for bans
+	banQueue = NewBanQueue(envConfig.QueueDepth, envConfig.QueueWorkers, evaluateBans)
 
 	// create background task that updates the WAF
 	ticker := time.NewTicker(time.Duration(envConfig.UpdateRate) * time.Minute)
@@ -260,13 +459,85 @@ func main() {
 		go updateBlockLists(ticker, &quit)
 	}
 
+	// consume failure events published to SQS
+	sqsQuit := make(chan string)
+	if envConfig.SQSQueueURL != "" {
+		sqsSession := session.Must(session.NewSessionWithOptions(session.Options{
+			SharedConfigState: session.SharedConfigEnable,
+			Config: aws.Config{
+				Region: &envConfig.SQSRegion,
+			},
+		}))
+		go consumeSQS(sqs.New(sqsSession), &sqsQuit)
+	}
+
+	// receive failure events over syslog
+	if envConfig.SyslogUDPAddr != "" || envConfig.SyslogTCPAddr != "" {
+		startSyslogListeners(&envConfig)
+	}
+
+	// deliver webhooks for ban changes
+	webhookQuit := make(chan string)
+	if len(envConfig.WebhookURLs) > 0 {
+		webhookTicker := time.NewTicker(time.Duration(envConfig.WebhookPollInterval) * time.Second)
+		go deliverWebhooks(webhookTicker, &webhookQuit)
+	}
+
+	// follow local log files for failures
+	tailQuit := make(chan string)
+	if len(envConfig.TailFiles) > 0 {
+		startTailing(&envConfig, &tailQuit)
+	}
+
+	// import the threat intel feeds
+	intelQuit := make(chan string)
+	if len(envConfig.IntelFeeds) > 0 && !*noBgTaskFlag {
+		intelTicker := time.NewTicker(time.Duration(envConfig.IntelRefreshRate) * time.Minute)
+		go importIntelFeeds(intelTicker, &intelQuit)
+	}
+
+	// pick up new GeoIP databases without a restart
+	geoIPQuit := make(chan string)
+	if geoIP != nil {
+		geoIPTicker := time.NewTicker(time.Duration(envConfig.GeoIPReloadInterval) * time.Minute)
+		go reloadGeoIP(geoIP, geoIPTicker, &geoIPQuit)
+	}
+
+	// pass new bans on to the federation peers
+	if len(envConfig.FederationPeers) > 0 {
+		startFederation(&envConfig)
+	}
+
 	// setup URL handlers/routes
 	r := mux.NewRouter()
 	r.HandleFunc("/logonfailure", logonFailureWriter).Methods("POST")
+	r.HandleFunc("/logonsuccess", logonSuccessWriter).Methods("POST")
 	r.HandleFunc("/healthcheck", healthCheckWriter).Methods("GET")
 	r.HandleFunc("/unblockIP", unblockIP).Methods("POST")
+	r.HandleFunc("/banIP", banIP).Methods("POST")
+	r.HandleFunc("/metrics", metricsWriter).Methods("GET")
+	r.HandleFunc("/events/stream", eventStreamWriter).Methods("GET")
+	r.HandleFunc("/admin/audit", adminAuditWriter).Methods("GET")
+	r.HandleFunc("/feed/blocklist", blockListFeedWriter).Methods("GET")
+	r.HandleFunc("/federation/events", federationEventWriter).Methods("POST")
 
 	log.Debug().Msg("Starting http handler")
 	http.ListenAndServe(":8080", r)
 	quit <- "quit"
+	if envConfig.SQSQueueURL != "" {
+		sqsQuit <- "quit"
+	}
+	if len(envConfig.TailFiles) > 0 {
+		tailQuit <- "quit"
+	}
+	if len(envConfig.WebhookURLs) > 0 {
+		webhookQuit <- "quit"
+	}
+	if len(envConfig.IntelFeeds) > 0 && !*noBgTaskFlag {
+		intelQuit <- "quit"
+	}
+	if geoIP != nil {
+		geoIPQuit <- "quit"
+	}
+	banQueue.Close()
 }
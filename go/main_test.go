@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUnblockIPValidation(t *testing.T) {
+	envConfig.ExemptionMaxHours = 24
+	for _, body := range []string{
+		`{"ip": "garbage", "exempt_hours": 5}`,
+		`{"exempt_hours": 5}`,
+		`{"ip": "192.168.1.1", "exempt_hours": -1}`,
+		`{"ip": "192.168.1.1", "exempt_hours": 25}`,
+	} {
+		w := httptest.NewRecorder()
+		unblockIP(w, httptest.NewRequest("POST", "/unblockIP", strings.NewReader(body)))
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Logf("Expected 422 for %s, got %d", body, w.Code)
+			t.Fail()
+		}
+	}
+}
+
+func TestBanIPValidation(t *testing.T) {
+	for _, body := range []string{
+		`not json`,
+		`{"ip": "not an address"}`,
+		`{"ip": "192.168.1.1", "table": "other_ban"}`,
+	} {
+		w := httptest.NewRecorder()
+		banIP(w, httptest.NewRequest("POST", "/banIP", strings.NewReader(body)))
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Logf("Expected 422 for %s, got %d", body, w.Code)
+			t.Fail()
+		}
+	}
+}
+
+func TestRequestSourceIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/admin/audit", nil)
+	r.RemoteAddr = "10.0.0.1:41234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7")
+	// without trusted proxies the header is the client's, so it's not believed
+	if ip := requestSourceIP(r); ip != "10.0.0.1" {
+		t.Logf("Expected 10.0.0.1, got %s", ip)
+		t.Fail()
+	}
+	envConfig.TrustedProxies, _ = ParseAllowList([]string{"10.0.0.0/24"})
+	defer func() { envConfig.TrustedProxies = nil }()
+	// the first address is the client's own claim, the last is the one the proxy added
+	if ip := requestSourceIP(r); ip != "203.0.113.7" {
+		t.Logf("Expected the right-most forwarded address, got %s", ip)
+		t.Fail()
+	}
+	// trusted hops are skipped
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7, 10.0.0.2")
+	if ip := requestSourceIP(r); ip != "203.0.113.7" {
+		t.Logf("Expected the address before the trusted proxies, got %s", ip)
+		t.Fail()
+	}
+	// a request from outside the proxies can't choose its address
+	r.RemoteAddr = "192.0.2.1:41234"
+	if ip := requestSourceIP(r); ip != "192.0.2.1" {
+		t.Logf("Expected 192.0.2.1, got %s", ip)
+		t.Fail()
+	}
+}
+
+func TestAdminAuditWriterValidation(t *testing.T) {
+	for _, query := range []string{"?from=yesterday", "?to=2021-11-01", "?limit=0", "?limit=100000"} {
+		w := httptest.NewRecorder()
+		adminAuditWriter(w, httptest.NewRequest("GET", "/admin/audit"+query, nil))
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Logf("Expected 422 for %s, got %d", query, w.Code)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// limits on the optional request metadata of a failure
+const (
+	metadataMaxValue        = 1024
+	metadataMaxForwardedFor = 32
+	metadataMaxLabels       = 32
+)
+
+// Dimensions of a failure that policies can be scoped by. Labels are matched as label.<key>
+// and forwarded_for matches a failure when any of its hops is the value.
+const (
+	DimensionApp          = "app"
+	DimensionEndpoint     = "endpoint"
+	DimensionUserAgent    = "user_agent"
+	DimensionForwardedFor = "forwarded_for"
+	dimensionLabel        = "label."
+)
+
+// failureMetadata is what's stored in the metadata column of logon_audit. Scoped policies only
+// count stored failures whose metadata contains their match, so the keys are the dimension names.
+type failureMetadata struct {
+	UserAgent    string            `json:"user_agent,omitempty"`
+	App          string            `json:"app,omitempty"`
+	Endpoint     string            `json:"endpoint,omitempty"`
+	ForwardedFor []string          `json:"forwarded_for,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+// Metadata returns the record's optional request metadata as JSON, nil when it has none
+func (record *NewFailure) Metadata() ([]byte, error) {
+	if record.UserAgent == "" && record.App == "" && record.Endpoint == "" && len(record.ForwardedFor) == 0 &&
+		len(record.Labels) == 0 {
+		return nil, nil
+	}
+	for _, value := range []string{record.UserAgent, record.App, record.Endpoint} {
+		if len(value) > metadataMaxValue {
+			return nil, fmt.Errorf("Metadata values can't be longer than %d characters", metadataMaxValue)
+		}
+	}
+	if len(record.ForwardedFor) > metadataMaxForwardedFor {
+		return nil, fmt.Errorf("forwarded_for can't have more than %d addresses", metadataMaxForwardedFor)
+	}
+	for _, address := range record.ForwardedFor {
+		if len(address) > metadataMaxValue {
+			return nil, fmt.Errorf("Metadata values can't be longer than %d characters", metadataMaxValue)
+		}
+	}
+	if len(record.Labels) > metadataMaxLabels {
+		return nil, fmt.Errorf("labels can't have more than %d entries", metadataMaxLabels)
+	}
+	for key, value := range record.Labels {
+		if !identifierPattern.MatchString(key) {
+			return nil, fmt.Errorf("label %q should be up to 64 letters, digits, '_', '.' or '-'", key)
+		}
+		if len(value) > metadataMaxValue {
+			return nil, fmt.Errorf("Metadata values can't be longer than %d characters", metadataMaxValue)
+		}
+	}
+	return json.Marshal(failureMetadata{
+		UserAgent:    record.UserAgent,
+		App:          record.App,
+		Endpoint:     record.Endpoint,
+		ForwardedFor: record.ForwardedFor,
+		Labels:       record.Labels,
+	})
+}
+
+// SetMetadata fills in the record's request metadata from what Metadata stored
+func (record *NewFailure) SetMetadata(stored []byte) error {
+	var metadata failureMetadata
+	if err := json.Unmarshal(stored, &metadata); err != nil {
+		return err
+	}
+	record.UserAgent = metadata.UserAgent
+	record.App = metadata.App
+	record.Endpoint = metadata.Endpoint
+	record.ForwardedFor = metadata.ForwardedFor
+	record.Labels = metadata.Labels
+	return nil
+}
+
+// Dimension returns the record's value for one of the dimensions, empty when it has none.
+// forwarded_for has more than one value, so use Matches for it.
+func (record *NewFailure) Dimension(name string) string {
+	switch name {
+	case DimensionApp:
+		return record.App
+	case DimensionEndpoint:
+		return record.Endpoint
+	case DimensionUserAgent:
+		return record.UserAgent
+	}
+	if strings.HasPrefix(name, dimensionLabel) {
+		return record.Labels[strings.TrimPrefix(name, dimensionLabel)]
+	}
+	return ""
+}
+
+// validDimension checks name is one of the dimensions
+func validDimension(name string) bool {
+	switch name {
+	case DimensionApp, DimensionEndpoint, DimensionUserAgent, DimensionForwardedFor:
+		return true
+	}
+	return strings.HasPrefix(name, dimensionLabel) && identifierPattern.MatchString(strings.TrimPrefix(name, dimensionLabel))
+}
+
+// ParsePolicyMatch parses a semicolon separated list of dimension=value conditions
+func ParsePolicyMatch(value string) (map[string]string, error) {
+	match := map[string]string{}
+	for _, item := range strings.Split(value, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		idx := strings.Index(item, "=")
+		if idx < 1 || idx == len(item)-1 {
+			return nil, fmt.Errorf("Condition %q should be dimension=value", item)
+		}
+		dimension := item[:idx]
+		if !validDimension(dimension) {
+			return nil, fmt.Errorf("Condition %q should use app, endpoint, user_agent, forwarded_for or label.<key>", item)
+		}
+		if _, ok := match[dimension]; ok {
+			return nil, fmt.Errorf("Condition on %s is given more than once", dimension)
+		}
+		match[dimension] = item[idx+1:]
+	}
+	return match, nil
+}
+
+// Matches is true when the record has every value of the policy's Match
+func (policy *BanPolicy) Matches(record *NewFailure) bool {
+	for dimension, value := range policy.Match {
+		if dimension == DimensionForwardedFor {
+			found := false
+			for _, hop := range record.ForwardedFor {
+				found = found || hop == value
+			}
+			if !found {
+				return false
+			}
+			continue
+		}
+		if record.Dimension(dimension) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// scope is the policy's Match as a JSON document the stored metadata has to contain, nil
+// when the policy counts every failure
+func (policy *BanPolicy) scope() interface{} {
+	if len(policy.Match) == 0 {
+		return nil
+	}
+	document := map[string]interface{}{}
+	labels := map[string]string{}
+	for dimension, value := range policy.Match {
+		if strings.HasPrefix(dimension, dimensionLabel) {
+			labels[strings.TrimPrefix(dimension, dimensionLabel)] = value
+			continue
+		}
+		if dimension == DimensionForwardedFor {
+			// an array contains another when it has all of its elements
+			document[dimension] = []string{value}
+			continue
+		}
+		document[dimension] = value
+	}
+	if len(labels) > 0 {
+		document["labels"] = labels
+	}
+	// maps of strings and string slices always encode
+	encoded, _ := json.Marshal(document)
+	return string(encoded)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFailureMetadata(t *testing.T) {
+	var record NewFailure
+	err := json.Unmarshal([]byte(`{"ip": "192.168.1.1", "username": "bob", "user_agent": "Mozilla/5.0",
+		"app": "portal", "endpoint": "/api/login", "forwarded_for": ["203.0.113.7", "10.0.0.2"],
+		"labels": {"tenant": "acme", "region": "eu"}}`), &record)
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	metadata, err := record.Metadata()
+	expected := `{"user_agent":"Mozilla/5.0","app":"portal","endpoint":"/api/login","forwarded_for":["203.0.113.7","10.0.0.2"],"labels":{"region":"eu","tenant":"acme"}}`
+	if err != nil || string(metadata) != expected {
+		t.Logf("Unexpected metadata: %s (err: %v)", metadata, err)
+		t.Fail()
+	}
+	plain := NewFailure{IP: "192.168.1.1", Username: "bob"}
+	if metadata, err := plain.Metadata(); metadata != nil || err != nil {
+		t.Logf("Expected no metadata, got %s (err: %v)", metadata, err)
+		t.Fail()
+	}
+}
+
+func TestFailureMetadataInvalid(t *testing.T) {
+	tooMany := map[string]string{}
+	for i := 0; i <= metadataMaxLabels; i++ {
+		tooMany[strings.Repeat("a", i+1)] = "x"
+	}
+	cases := map[string]NewFailure{
+		"long user agent":  {UserAgent: strings.Repeat("x", metadataMaxValue+1)},
+		"long chain":       {ForwardedFor: make([]string, metadataMaxForwardedFor+1)},
+		"bad label key":    {Labels: map[string]string{"tenant id": "acme"}},
+		"long label value": {Labels: map[string]string{"tenant": strings.Repeat("x", metadataMaxValue+1)}},
+		"too many labels":  {Labels: tooMany},
+	}
+	for name, record := range cases {
+		if _, err := record.Metadata(); err == nil {
+			t.Logf("%s: expected an error", name)
+			t.Fail()
+		}
+	}
+}
+
+func TestPolicyMatches(t *testing.T) {
+	match, err := ParsePolicyMatch("app=portal; label.tenant=acme")
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	policy := BanPolicy{Name: "portal", Match: match}
+	record := NewFailure{App: "portal", Labels: map[string]string{"tenant": "acme"}}
+	if !policy.Matches(&record) {
+		t.Logf("Expected %+v to match %v", record, match)
+		t.Fail()
+	}
+	for _, other := range []NewFailure{{App: "portal"}, {App: "api", Labels: map[string]string{"tenant": "acme"}}, {}} {
+		if policy.Matches(&other) {
+			t.Logf("Expected %+v not to match %v", other, match)
+			t.Fail()
+		}
+	}
+	// the scope is contained in the metadata stored for a matching record
+	if scope, ok := policy.scope().(string); !ok || scope != `{"app":"portal","labels":{"tenant":"acme"}}` {
+		t.Logf("Unexpected scope: %v", policy.scope())
+		t.Fail()
+	}
+	unscoped := BanPolicy{Name: "short"}
+	if !unscoped.Matches(&record) || unscoped.scope() != nil {
+		t.Log("A policy without a match should count every failure")
+		t.Fail()
+	}
+}
+
+func TestPolicyMatchesForwardedFor(t *testing.T) {
+	match, err := ParsePolicyMatch("forwarded_for=10.0.0.2")
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	policy := BanPolicy{Name: "proxy", Match: match}
+	// any hop matches
+	if !policy.Matches(&NewFailure{ForwardedFor: []string{"203.0.113.7", "10.0.0.2"}}) {
+		t.Log("Expected a failure through 10.0.0.2 to match")
+		t.Fail()
+	}
+	if policy.Matches(&NewFailure{ForwardedFor: []string{"203.0.113.7"}}) || policy.Matches(&NewFailure{}) {
+		t.Log("Expected failures not through 10.0.0.2 not to match")
+		t.Fail()
+	}
+	if scope, ok := policy.scope().(string); !ok || scope != `{"forwarded_for":["10.0.0.2"]}` {
+		t.Logf("Unexpected scope: %v", policy.scope())
+		t.Fail()
+	}
+}
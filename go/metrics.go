@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing metric
+type Counter struct {
+	value uint64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add adds n to the counter
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// metric is a single series exposed on /metrics
+type metric struct {
+	name   string
+	labels string
+	help   string
+	kind   string
+	value  func() float64
+}
+
+var metricsMu sync.Mutex
+var metricsList = make(map[string]*metric)
+var counters = make(map[string]*Counter)
+
+// RegisterCounter creates (or returns the existing) counter with the given name and labels.
+// labels are passed as key/value pairs, e.g. RegisterCounter("x", "help", "policy", "strict")
+func RegisterCounter(name, help string, labels ...string) *Counter {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	key := name + formatLabels(labels)
+	if existing, ok := counters[key]; ok {
+		return existing
+	}
+	c := &Counter{}
+	counters[key] = c
+	metricsList[key] = &metric{
+		name:   name,
+		labels: formatLabels(labels),
+		help:   help,
+		kind:   "counter",
+		value:  func() float64 { return float64(c.Value()) },
+	}
+	return c
+}
+
+// RegisterGauge exposes the value returned by fn as a gauge
+func RegisterGauge(name, help string, fn func() float64, labels ...string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	key := name + formatLabels(labels)
+	metricsList[key] = &metric{
+		name:   name,
+		labels: formatLabels(labels),
+		help:   help,
+		kind:   "gauge",
+		value:  fn,
+	}
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// metricsWriter exposes all registered metrics in the prometheus text format
+func metricsWriter(w http.ResponseWriter, r *http.Request) {
+	metricsMu.Lock()
+	series := make([]*metric, 0, len(metricsList))
+	for _, m := range metricsList {
+		series = append(series, m)
+	}
+	metricsMu.Unlock()
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+		return series[i].labels < series[j].labels
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	lastName := ""
+	for _, m := range series {
+		if m.name != lastName {
+			fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+			fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+			lastName = m.name
+		}
+		fmt.Fprintf(w, "%s%s %g\n", m.name, m.labels, m.value())
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultReason is the reason given to failures matched by a pattern without a reason field
+const DefaultReason = "LOG_PATTERN_MATCH"
+
+// grokPatterns are the named patterns that can be used as %{NAME} or %{NAME:field}
+var grokPatterns = map[string]string{
+	"IPV4":              `(?:[0-9]{1,3}\.){3}[0-9]{1,3}`,
+	"IPV6":              `(?:[0-9A-Fa-f]{0,4}:){2,7}(?:[0-9A-Fa-f]{0,4}|(?:[0-9]{1,3}\.){3}[0-9]{1,3})`,
+	"IP":                `(?:(?:[0-9A-Fa-f]{0,4}:){2,7}(?:[0-9A-Fa-f]{0,4}|(?:[0-9]{1,3}\.){3}[0-9]{1,3})|(?:[0-9]{1,3}\.){3}[0-9]{1,3})`,
+	"USERNAME":          `[a-zA-Z0-9._@+-]+`,
+	"USER":              `[a-zA-Z0-9._@+-]+`,
+	"WORD":              `\b\w+\b`,
+	"NOTSPACE":          `\S+`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"INT":               `[+-]?[0-9]+`,
+	"NUMBER":            `[+-]?[0-9]+(?:\.[0-9]+)?`,
+	"QS":                `"(?:[^"\\]|\\.)*"`,
+	"TIMESTAMP_ISO8601": `[0-9]{4}-[0-9]{2}-[0-9]{2}[T ][0-9]{2}:[0-9]{2}:[0-9]{2}(?:\.[0-9]+)?(?:Z|[+-][0-9]{2}:?[0-9]{2})?`,
+	"SYSLOGTIMESTAMP":   `[A-Z][a-z]{2} +[0-9]{1,2} [0-9]{2}:[0-9]{2}:[0-9]{2}`,
+	"HTTPDATE":          `[0-9]{2}/[A-Z][a-z]{2}/[0-9]{4}:[0-9]{2}:[0-9]{2}:[0-9]{2} [+-][0-9]{4}`,
+}
+
+var grokReference = regexp.MustCompile(`%\{([A-Z0-9_]+)(?::([a-z_]+))?\}`)
+
+// timestamp layouts tried, in order, for the ts field of a pattern
+var logTimestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02 15:04:05",
+	"02/Jan/2006:15:04:05 -0700",
+	time.Stamp,
+}
+
+// FailurePattern is a compiled regex (or grok) pattern that extracts a failure from a line of text.
+// The named groups ts, ip, username, pwhash, reason, user_agent, app and endpoint map to the NewFailure
+// fields of the same name, and forwarded_for is split on commas into ForwardedFor.
+type FailurePattern struct {
+	Source string
+	re     *regexp.Regexp
+}
+
+// CompileFailurePattern compiles pattern, expanding any grok references in it
+func CompileFailurePattern(pattern string) (*FailurePattern, error) {
+	var expandErr error
+	expanded := grokReference.ReplaceAllStringFunc(pattern, func(ref string) string {
+		parts := grokReference.FindStringSubmatch(ref)
+		grok, ok := grokPatterns[parts[1]]
+		if !ok {
+			expandErr = fmt.Errorf("Unknown grok pattern %s", parts[1])
+			return ref
+		}
+		if parts[2] == "" {
+			return "(?:" + grok + ")"
+		}
+		return "(?P<" + parts[2] + ">" + grok + ")"
+	})
+	if expandErr != nil {
+		return nil, expandErr
+	}
+	re, err := regexp.Compile(expanded)
+	if err != nil {
+		return nil, err
+	}
+	if re.SubexpIndex("ip") == -1 {
+		return nil, errors.New("Pattern must have an ip field")
+	}
+	return &FailurePattern{Source: pattern, re: re}, nil
+}
+
+// Match extracts a failure from line. ts is used when the pattern has no (parseable) ts field.
+func (p *FailurePattern) Match(line string, ts time.Time) (*NewFailure, bool) {
+	groups := p.re.FindStringSubmatch(line)
+	if groups == nil {
+		return nil, false
+	}
+	record := NewFailure{Ts: ts, Reason: DefaultReason}
+	for i, name := range p.re.SubexpNames() {
+		value := groups[i]
+		if value == "" {
+			continue
+		}
+		switch name {
+		case "ts":
+			if parsed, ok := parseLogTimestamp(value, ts); ok {
+				record.Ts = parsed
+			}
+		case "ip":
+			record.IP = value
+		case "username":
+			record.Username = value
+		case "pwhash":
+			record.Pwhash = value
+		case "reason":
+			record.Reason = value
+		case "user_agent":
+			record.UserAgent = value
+		case "app":
+			record.App = value
+		case "endpoint":
+			record.Endpoint = value
+		case "forwarded_for":
+			for _, address := range strings.Split(value, ",") {
+				if address = strings.TrimSpace(address); address != "" {
+					record.ForwardedFor = append(record.ForwardedFor, address)
+				}
+			}
+		}
+	}
+	return &record, true
+}
+
+// ParseFailureLine turns a log line into a failure. Lines that are JSON objects are decoded
+// like a /logonfailure request, anything else is matched against patterns in order.
+func ParseFailureLine(patterns []*FailurePattern, line string, ts time.Time) (*NewFailure, bool) {
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, "{") {
+		var record NewFailure
+		if err := json.Unmarshal([]byte(trimmed), &record); err == nil && record.IP != "" {
+			if record.Ts.IsZero() {
+				record.Ts = ts
+			}
+			return &record, true
+		}
+	}
+	for _, pattern := range patterns {
+		if record, ok := pattern.Match(line, ts); ok {
+			return record, true
+		}
+	}
+	return nil, false
+}
+
+// LoadFailurePatterns compiles the patterns in path, one per line. Blank lines and lines
+// starting with # are skipped. defaults are used when path is empty.
+func LoadFailurePatterns(path string, defaults []string) ([]*FailurePattern, error) {
+	sources := defaults
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		sources = []string{}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			sources = append(sources, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	patterns := make([]*FailurePattern, 0, len(sources))
+	for _, source := range sources {
+		pattern, err := CompileFailurePattern(source)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q: %s", source, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// parseLogTimestamp parses the timestamp formats commonly found in logs. Syslog style
+// timestamps have no year so they're placed in the year of now.
+func parseLogTimestamp(value string, now time.Time) (time.Time, bool) {
+	for _, layout := range logTimestampLayouts {
+		parsed, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		if layout == time.Stamp {
+			parsed = time.Date(now.Year(), parsed.Month(), parsed.Day(), parsed.Hour(),
+				parsed.Minute(), parsed.Second(), 0, now.Location())
+			// a December timestamp read in January belongs to last year
+			if parsed.After(now.Add(24 * time.Hour)) {
+				parsed = parsed.AddDate(-1, 0, 0)
+			}
+		}
+		return parsed, true
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompileFailurePatternGrok(t *testing.T) {
+	p, err := CompileFailurePattern(`Failed password for %{USERNAME:username} from %{IP:ip} port %{INT}`)
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	now := time.Date(2021, 11, 1, 10, 0, 0, 0, time.UTC)
+	record, ok := p.Match("Failed password for bob from 192.168.1.1 port 22 ssh2", now)
+	if !ok {
+		t.Log("Pattern should have matched")
+		t.FailNow()
+	}
+	if record.IP != "192.168.1.1" || record.Username != "bob" || record.Reason != DefaultReason || !record.Ts.Equal(now) {
+		t.Logf("Unexpected failure: %+v", record)
+		t.Fail()
+	}
+}
+
+func TestCompileFailurePatternErrors(t *testing.T) {
+	if _, err := CompileFailurePattern(`%{NOPE:ip}`); err == nil {
+		t.Log("Unknown grok patterns should be an error")
+		t.Fail()
+	}
+	if _, err := CompileFailurePattern(`user %{USERNAME:username}`); err == nil {
+		t.Log("Patterns without an ip field should be an error")
+		t.Fail()
+	}
+}
+
+func TestFailurePatternTimestamp(t *testing.T) {
+	p, _ := CompileFailurePattern(`^%{IP:ip} - \S+ \[%{HTTPDATE:ts}\] "POST /login[^"]*" (?P<reason>401)`)
+	record, ok := p.Match(`10.0.0.1 - - [01/Nov/2021:10:00:00 +0000] "POST /login HTTP/1.1" 401 12`, time.Now())
+	if !ok {
+		t.Log("Pattern should have matched")
+		t.FailNow()
+	}
+	if !record.Ts.Equal(time.Date(2021, 11, 1, 10, 0, 0, 0, time.UTC)) || record.Reason != "401" {
+		t.Logf("Unexpected failure: %+v", record)
+		t.Fail()
+	}
+}
+
+func TestFailurePatternMetadata(t *testing.T) {
+	p, _ := CompileFailurePattern(`^%{IP:ip} "(?P<forwarded_for>[^"]*)" "POST (?P<endpoint>\S+)[^"]*" 401 "(?P<user_agent>[^"]*)"`)
+	record, ok := p.Match(`10.0.0.1 "203.0.113.7, 10.0.0.2" "POST /api/login HTTP/1.1" 401 "curl/7.79.1"`, time.Now())
+	if !ok {
+		t.Log("Pattern should have matched")
+		t.FailNow()
+	}
+	if record.Endpoint != "/api/login" || record.UserAgent != "curl/7.79.1" || len(record.ForwardedFor) != 2 ||
+		record.ForwardedFor[0] != "203.0.113.7" || record.ForwardedFor[1] != "10.0.0.2" {
+		t.Logf("Unexpected failure: %+v", record)
+		t.Fail()
+	}
+}
+
+func TestParseFailureLineJSON(t *testing.T) {
+	record, ok := ParseFailureLine(nil, `{"ts": "2021-11-01T10:00:00Z", "ip": "192.168.1.1", "username": "bob", "reason": "PASSWORD_FAILURE"}`, time.Now())
+	if !ok || record.IP != "192.168.1.1" || record.Reason != "PASSWORD_FAILURE" {
+		t.Logf("Unexpected failure: %+v", record)
+		t.Fail()
+	}
+	if _, ok := ParseFailureLine(nil, `{"msg": "unrelated"}`, time.Now()); ok {
+		t.Log("JSON without an ip shouldn't match")
+		t.Fail()
+	}
+}
+
+func TestParseLogTimestampYearRollover(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 5, 0, 0, time.UTC)
+	ts, ok := parseLogTimestamp("Dec 31 23:59:00", now)
+	if !ok || ts.Year() != 2021 {
+		t.Logf("Expected a 2021 timestamp, got %s", ts)
+		t.Fail()
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// the pwhash column is VARCHAR(100), which leaves room for the key ID, the colon and 64 hex characters
+const maxPepperKeyID = 35
+
+// Pepper HMACs values with server side keys before they're stored, so that a copy of the
+// database on its own doesn't reveal anything usable. Stored values are keyid:hex, so that
+// keys can be rotated: new values use the active key, and lookups match the value under
+// every key until the rows hashed with an old key age out of logon_audit.
+type Pepper struct {
+	keys          map[string][]byte
+	order         []string
+	active        string
+	HashUsernames bool
+}
+
+// ParsePepperKeys parses a comma separated list of id:secret keys. active is the ID of the key
+// new values are hashed with, when it's blank the first key is used. A blank list returns nil,
+// which stores values as they are sent.
+func ParsePepperKeys(value string, active string, hashUsernames bool) (*Pepper, error) {
+	pepper := &Pepper{keys: map[string][]byte{}, HashUsernames: hashUsernames}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Pepper key should be id:secret")
+		}
+		if len(parts[0]) > maxPepperKeyID || strings.Contains(parts[0], " ") {
+			return nil, fmt.Errorf("Pepper key ID %q should be at most %d characters without spaces", parts[0], maxPepperKeyID)
+		}
+		if _, ok := pepper.keys[parts[0]]; ok {
+			return nil, fmt.Errorf("Pepper key %q is defined more than once", parts[0])
+		}
+		pepper.keys[parts[0]] = []byte(parts[1])
+		pepper.order = append(pepper.order, parts[0])
+	}
+	if len(pepper.order) == 0 {
+		if active != "" || hashUsernames {
+			return nil, fmt.Errorf("Hashing is configured but there are no pepper keys")
+		}
+		return nil, nil
+	}
+	if active == "" {
+		active = pepper.order[0]
+	}
+	if _, ok := pepper.keys[active]; !ok {
+		return nil, fmt.Errorf("Active pepper key %q isn't one of the pepper keys", active)
+	}
+	pepper.active = active
+	return pepper, nil
+}
+
+// hashWith HMACs value with the key keyID
+func (p *Pepper) hashWith(keyID string, value string) string {
+	mac := hmac.New(sha256.New, p.keys[keyID])
+	mac.Write([]byte(value))
+	return keyID + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Hash returns value hashed with the active key. Blank values stay blank.
+func (p *Pepper) Hash(value string) string {
+	if p == nil || value == "" {
+		return value
+	}
+	return p.hashWith(p.active, value)
+}
+
+// Matches returns value hashed with every key, for looking up values stored before a rotation
+func (p *Pepper) Matches(value string) []string {
+	if p == nil || value == "" {
+		return []string{value}
+	}
+	matches := make([]string, 0, len(p.order))
+	for _, keyID := range p.order {
+		matches = append(matches, p.hashWith(keyID, value))
+	}
+	return matches
+}
+
+// staleValues returns the matches other than current, which are the values a rotation left
+// behind under the old keys
+func staleValues(matches []string, current string) []string {
+	stale := []string{}
+	for _, match := range matches {
+		if match != current {
+			stale = append(stale, match)
+		}
+	}
+	return stale
+}
+
+// Apply replaces the record's pwhash, and username when HashUsernames is set, with their
+// hashes. It's done once as the record comes in so the plain values are never stored.
+func (p *Pepper) Apply(record *NewFailure) {
+	if p == nil {
+		return
+	}
+	record.pwhashMatches = p.Matches(record.Pwhash)
+	record.Pwhash = p.Hash(record.Pwhash)
+	if p.HashUsernames {
+		record.usernameMatches = p.Matches(record.Username)
+		record.Username = p.Hash(record.Username)
+	}
+}
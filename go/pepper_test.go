@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPepperHash(t *testing.T) {
+	pepper, err := ParsePepperKeys("k1:secret, k2:other", "", false)
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	expected := "k1:a9c5855444345e1057474541772ae12f2a86d21633a8d55449d0c3e818ac20bd"
+	if hashed := pepper.Hash("hunter2"); hashed != expected {
+		t.Logf("Expected %s, got %s", expected, hashed)
+		t.Fail()
+	}
+	if pepper.Hash("") != "" {
+		t.Log("Blank values should stay blank")
+		t.Fail()
+	}
+	matches := pepper.Matches("hunter2")
+	if len(matches) != 2 || matches[0] != expected || matches[1][:3] != "k2:" {
+		t.Logf("Unexpected matches: %v", matches)
+		t.Fail()
+	}
+}
+
+func TestPepperRotation(t *testing.T) {
+	old, _ := ParsePepperKeys("k1:secret", "", false)
+	rotated, err := ParsePepperKeys("k1:secret,k2:other", "k2", false)
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	stored := old.Hash("hunter2")
+	if rotated.Hash("hunter2") == stored {
+		t.Log("New values should use the active key")
+		t.Fail()
+	}
+	found := false
+	for _, match := range rotated.Matches("hunter2") {
+		found = found || match == stored
+	}
+	if !found {
+		t.Log("Values stored with the old key should still match")
+		t.Fail()
+	}
+}
+
+// applyRekey does to stored what rekeyUsernames does to the username column
+func applyRekey(stored []string, current string, stale []string) {
+	for i := range stored {
+		for _, value := range stale {
+			if stored[i] == value {
+				stored[i] = current
+			}
+		}
+	}
+}
+
+// distinct counts the distinct values, like count(DISTINCT username)
+func distinct(values []string) int {
+	seen := map[string]bool{}
+	for _, value := range values {
+		seen[value] = true
+	}
+	return len(seen)
+}
+
+func TestPepperRotationCountsOnce(t *testing.T) {
+	old, _ := ParsePepperKeys("k1:secret", "", true)
+	rotated, _ := ParsePepperKeys("k1:secret,k2:other", "k2", true)
+	// alice failed from the IP before the rotation, and bob only before it
+	stored := []string{old.Hash("alice"), old.Hash("bob")}
+	record := NewFailure{IP: "192.168.1.1", Username: "alice"}
+	rotated.Apply(&record)
+	stored = append(stored, record.Username)
+	if distinct(stored) != 3 {
+		t.Logf("Expected alice under both keys before the rekey, got %v", stored)
+		t.FailNow()
+	}
+	stale := staleValues(record.UsernameMatches(), record.Username)
+	if len(stale) != 1 || stale[0] != old.Hash("alice") {
+		t.Logf("Expected alice's old key value to be stale, got %v", stale)
+		t.Fail()
+	}
+	applyRekey(stored, record.Username, stale)
+	if distinct(stored) != 2 {
+		t.Logf("Expected alice to be counted once, got %v", stored)
+		t.Fail()
+	}
+
+	// without a rotation there's nothing to move
+	single, _ := ParsePepperKeys("k1:secret", "", true)
+	record = NewFailure{IP: "192.168.1.1", Username: "alice", Pwhash: "hunter2"}
+	single.Apply(&record)
+	if len(staleValues(record.UsernameMatches(), record.Username)) != 0 ||
+		len(staleValues(record.PwhashMatches(), record.Pwhash)) != 0 {
+		t.Log("Expected nothing stale with one key")
+		t.Fail()
+	}
+}
+
+func TestPepperApply(t *testing.T) {
+	pepper, _ := ParsePepperKeys("k1:secret", "", true)
+	record := NewFailure{IP: "192.168.1.1", Username: "bob", Pwhash: "hunter2"}
+	pepper.Apply(&record)
+	if record.Pwhash == "hunter2" || record.Username == "bob" {
+		t.Logf("Plain values shouldn't be left on the record: %+v", record)
+		t.Fail()
+	}
+	if len(record.PwhashMatches()) != 1 || record.PwhashMatches()[0] != record.Pwhash {
+		t.Logf("Unexpected pwhash matches: %v", record.PwhashMatches())
+		t.Fail()
+	}
+
+	// without keys the record is stored as it was sent
+	var none *Pepper
+	record = NewFailure{IP: "192.168.1.1", Username: "bob", Pwhash: "hunter2"}
+	none.Apply(&record)
+	if record.Pwhash != "hunter2" || record.UsernameMatches()[0] != "bob" {
+		t.Logf("Unexpected record: %+v", record)
+		t.Fail()
+	}
+}
+
+func TestParsePepperKeysInvalid(t *testing.T) {
+	for _, args := range [][]string{
+		{"k1", ""},
+		{"k1:secret,k1:other", ""},
+		{"k1:secret", "k2"},
+		{"", "k1"},
+		{"a-key-id-that-is-far-too-long-to-fit-in-the-column:secret", ""},
+	} {
+		if _, err := ParsePepperKeys(args[0], args[1], false); err == nil {
+			t.Logf("Expected an error for %v", args)
+			t.Fail()
+		}
+	}
+	if _, err := ParsePepperKeys("", "", true); err == nil {
+		t.Log("Hashing usernames without keys should be an error")
+		t.Fail()
+	}
+	if pepper, err := ParsePepperKeys("", "", false); pepper != nil || err != nil {
+		t.Log("No keys should turn hashing off")
+		t.Fail()
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Kinds of ban policy, they decide what is counted over the policy's period
+const (
+	// KindFailures counts the failures from the IP
+	KindFailures = "failures"
+	// KindUsernamesPerIP counts the distinct usernames the IP failed to log on as
+	KindUsernamesPerIP = "usernames-per-ip"
+	// KindIPsPerUsername counts the distinct IPs that failed to log on as the username,
+	// every one of them is banned when the limit is reached
+	KindIPsPerUsername = "ips-per-username"
+	// KindUnknownUser counts the failures from the IP with one of the policy's Reasons
+	KindUnknownUser = "unknown-user"
+	// KindPasswordSpray counts the distinct usernames tried with the event's password hash,
+	// every IP that tried the hash is banned when the limit is reached
+	KindPasswordSpray = "password-spray"
+	// KindHostingASN counts the failures from an IP in one of the policy's ASNs, IPs in
+	// other networks are never banned by it
+	KindHostingASN = "hosting-asn"
+	// KindFailuresPerASN counts the failures from the event's autonomous system, every
+	// IP in it that failed is banned when the limit is reached
+	KindFailuresPerASN = "failures-per-asn"
+)
+
+// What a policy does with a successful logon
+const (
+	// SuccessNone ignores successful logons
+	SuccessNone = "none"
+	// SuccessDiscount stops counting the failures from the same IP and username before the success
+	SuccessDiscount = "discount"
+	// SuccessTrust stops the policy from banning the IP for TRUST_PERIOD
+	SuccessTrust = "trust"
+)
+
+// BanPolicy decides when an IP goes into a ban table
+type BanPolicy struct {
+	Name string
+	// Kind is what is counted, an empty Kind is the same as KindFailures
+	Kind string
+	// Table is the ban table the IP is put in, short_ban or long_ban
+	Table string
+	// Period is the window, in hours, failures are counted over
+	Period int
+	// Limit is the count in Period that results in a ban
+	Limit int
+	// Reasons are the failure reasons counted by KindUnknownUser
+	Reasons []string
+	// Shadow policies only record what they would have banned in shadow_ban
+	Shadow bool
+	// OnSuccess is what a successful logon does for the policy, one of the Success constants
+	OnSuccess string
+	// ASNs are the autonomous systems counted by KindHostingASN
+	ASNs []uint
+	// events from HighRiskCountries are banned at Limit scaled by HighRiskFactor
+	HighRiskCountries []string
+	HighRiskFactor    float64
+	// Match scopes the policy to the failures with these dimension values, it counts
+	// every failure when it's empty
+	Match map[string]string
+}
+
+// LimitFor returns the limit for the record's IP, lowered when it's in a high risk country.
+// A lowered limit never goes below 1. failures-per-asn counts the failures of a whole
+// network, whatever country each IP is in, so its limit is never lowered.
+func (policy *BanPolicy) LimitFor(record *NewFailure) int {
+	if record.Country == "" || policy.HighRiskFactor <= 0 || policy.Kind == KindFailuresPerASN {
+		return policy.Limit
+	}
+	for _, country := range policy.HighRiskCountries {
+		if country == record.Country {
+			return int(math.Max(1, math.Ceil(float64(policy.Limit)*policy.HighRiskFactor)))
+		}
+	}
+	return policy.Limit
+}
+
+// HasASN is true when asn is one of the policy's ASNs
+func (policy *BanPolicy) HasASN(asn uint) bool {
+	if asn == 0 {
+		return false
+	}
+	for _, item := range policy.ASNs {
+		if item == asn {
+			return true
+		}
+	}
+	return false
+}
+
+// BanPolicies returns the policies every event is evaluated against
+func (envconf *EnvConfig) BanPolicies() []BanPolicy {
+	policies := []BanPolicy{
+		{Name: "short", Table: "short_ban", Period: envconf.ShortTermPeriod, Limit: envconf.ShortTermLimit},
+		{Name: "long", Table: "long_ban", Period: envconf.LongTermPeriod, Limit: envconf.LongTermLimit},
+	}
+	if envconf.UsernamesPerIPLimit > 0 {
+		policies = append(policies, BanPolicy{Name: KindUsernamesPerIP, Kind: KindUsernamesPerIP,
+			Table: envconf.UsernamesPerIPAction, Period: envconf.UsernamesPerIPPeriod, Limit: envconf.UsernamesPerIPLimit})
+	}
+	if envconf.IPsPerUsernameLimit > 0 {
+		policies = append(policies, BanPolicy{Name: KindIPsPerUsername, Kind: KindIPsPerUsername,
+			Table: envconf.IPsPerUsernameAction, Period: envconf.IPsPerUsernamePeriod, Limit: envconf.IPsPerUsernameLimit})
+	}
+	if envconf.UnknownUserLimit > 0 {
+		policies = append(policies, BanPolicy{Name: KindUnknownUser, Kind: KindUnknownUser,
+			Table: envconf.UnknownUserAction, Period: envconf.UnknownUserPeriod, Limit: envconf.UnknownUserLimit,
+			Reasons: envconf.UnknownUserReasons})
+	}
+	if envconf.PasswordSprayLimit > 0 {
+		policies = append(policies, BanPolicy{Name: KindPasswordSpray, Kind: KindPasswordSpray,
+			Table: envconf.PasswordSprayAction, Period: envconf.PasswordSprayPeriod, Limit: envconf.PasswordSprayLimit})
+	}
+	if len(envconf.HostingASNs) > 0 {
+		policies = append(policies, BanPolicy{Name: KindHostingASN, Kind: KindHostingASN,
+			Table: envconf.HostingASNAction, Period: envconf.HostingASNPeriod, Limit: envconf.HostingASNLimit})
+	}
+	if envconf.ASNFailureLimit > 0 {
+		policies = append(policies, BanPolicy{Name: KindFailuresPerASN, Kind: KindFailuresPerASN,
+			Table: envconf.ASNFailureAction, Period: envconf.ASNFailurePeriod, Limit: envconf.ASNFailureLimit})
+	}
+	policies = append(policies, envconf.ScopedPolicies...)
+	policies = append(policies, envconf.ShadowPolicies...)
+	for i := range policies {
+		if policies[i].Kind == KindHostingASN {
+			policies[i].ASNs = envconf.HostingASNs
+		}
+		policies[i].HighRiskCountries = envconf.HighRiskCountries
+		policies[i].HighRiskFactor = envconf.HighRiskFactor
+		policies[i].OnSuccess = envconf.SuccessAction
+		if action, ok := envconf.SuccessPolicyActions[policies[i].Name]; ok {
+			policies[i].OnSuccess = action
+		}
+	}
+	return policies
+}
+
+// validSuccessAction checks action is one of the Success constants
+func validSuccessAction(action string) bool {
+	return action == SuccessNone || action == SuccessDiscount || action == SuccessTrust
+}
+
+// ParseSuccessActions parses a comma separated list of policy:action pairs
+func ParseSuccessActions(value string) (map[string]string, error) {
+	actions := map[string]string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Success action %q should be policy:action", item)
+		}
+		if !validSuccessAction(parts[1]) {
+			return nil, fmt.Errorf("Success action %q should be none, discount or trust", item)
+		}
+		actions[parts[0]] = parts[1]
+	}
+	return actions, nil
+}
+
+// validKind checks kind is one of the policy kinds
+func validKind(kind string) bool {
+	switch kind {
+	case KindFailures, KindUsernamesPerIP, KindIPsPerUsername, KindUnknownUser, KindPasswordSpray,
+		KindHostingASN, KindFailuresPerASN:
+		return true
+	}
+	return false
+}
+
+// validTable checks table is a ban table
+func validTable(table string) bool {
+	return table == "short_ban" || table == "long_ban"
+}
+
+// ParseShadowPolicies parses a comma separated list of name:table:period:limit[:kind[:match]]
+// policies that only record what they would ban. unknownUserReasons are the reasons counted by
+// unknown-user policies.
+func ParseShadowPolicies(value string, unknownUserReasons []string) ([]BanPolicy, error) {
+	return parsePolicies(value, "Shadow policy", true, unknownUserReasons)
+}
+
+// ParseScopedPolicies parses a comma separated list of name:table:period:limit:kind:match
+// policies that ban. An empty kind is failures.
+func ParseScopedPolicies(value string, unknownUserReasons []string) ([]BanPolicy, error) {
+	policies, err := parsePolicies(value, "Scoped policy", false, unknownUserReasons)
+	if err != nil {
+		return nil, err
+	}
+	for _, policy := range policies {
+		if len(policy.Match) == 0 {
+			return nil, fmt.Errorf("Scoped policy %q needs a match", policy.Name)
+		}
+	}
+	return policies, nil
+}
+
+// parsePolicies parses the policies of SHADOW_POLICIES and SCOPED_POLICIES, what is the
+// start of their error messages
+func parsePolicies(value string, what string, shadow bool, unknownUserReasons []string) ([]BanPolicy, error) {
+	policies := []BanPolicy{}
+	seen := map[string]bool{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 6)
+		if len(parts) < 4 {
+			return nil, fmt.Errorf("%s %q should be name:table:period:limit[:kind[:match]]", what, item)
+		}
+		if !validTable(parts[1]) {
+			return nil, fmt.Errorf("%s %q has an invalid table", what, item)
+		}
+		kind := KindFailures
+		if len(parts) >= 5 && parts[4] != "" {
+			kind = parts[4]
+		}
+		if !validKind(kind) {
+			return nil, fmt.Errorf("%s %q has an invalid kind", what, item)
+		}
+		period, err := strconv.Atoi(parts[2])
+		if err != nil || period < 1 {
+			return nil, fmt.Errorf("%s %q has an invalid period", what, item)
+		}
+		limit, err := strconv.Atoi(parts[3])
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("%s %q has an invalid limit", what, item)
+		}
+		var match map[string]string
+		if len(parts) == 6 {
+			match, err = ParsePolicyMatch(parts[5])
+			if err != nil {
+				return nil, fmt.Errorf("%s %q has an invalid match: %s", what, item, err)
+			}
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("%s %q is defined more than once", what, parts[0])
+		}
+		seen[parts[0]] = true
+		policy := BanPolicy{
+			Name:   parts[0],
+			Kind:   kind,
+			Table:  parts[1],
+			Period: period,
+			Limit:  limit,
+			Shadow: shadow,
+			Match:  match,
+		}
+		if kind == KindUnknownUser {
+			policy.Reasons = unknownUserReasons
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// ReasonWeights is how much a failure counts towards the failures policies, by its reason
+type ReasonWeights struct {
+	weights map[string]float64
+	ignore  map[string]bool
+	Default float64
+}
+
+// ParseReasonWeights parses a comma separated list of reason:weight pairs and a comma separated
+// list of reasons to ignore. Reasons that aren't listed weigh defaultWeight.
+func ParseReasonWeights(value string, defaultWeight float64, ignore []string) (*ReasonWeights, error) {
+	if defaultWeight < 0 {
+		return nil, fmt.Errorf("The default reason weight can't be negative")
+	}
+	weights := &ReasonWeights{weights: map[string]float64{}, ignore: map[string]bool{}, Default: defaultWeight}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		idx := strings.LastIndex(item, ":")
+		if idx < 1 {
+			return nil, fmt.Errorf("Reason weight %q should be reason:weight", item)
+		}
+		weight, err := strconv.ParseFloat(item[idx+1:], 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("Reason weight %q has an invalid weight", item)
+		}
+		weights.weights[item[:idx]] = weight
+	}
+	for _, reason := range ignore {
+		weights.ignore[reason] = true
+	}
+	return weights, nil
+}
+
+// Weight returns how much a failure with reason counts
+func (w *ReasonWeights) Weight(reason string) float64 {
+	if w == nil {
+		return 1
+	}
+	if weight, ok := w.weights[reason]; ok {
+		return weight
+	}
+	return w.Default
+}
+
+// Ignored is true for reasons that don't count towards any policy
+func (w *ReasonWeights) Ignored(reason string) bool {
+	return w != nil && w.ignore[reason]
+}
+
+// Apply sets what the record counts for. Ignored reasons weigh nothing.
+func (w *ReasonWeights) Apply(record *NewFailure) {
+	record.ReasonIgnored = w.Ignored(record.Reason)
+	record.Weight = w.Weight(record.Reason)
+	if record.ReasonIgnored {
+		record.Weight = 0
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseShadowPolicies(t *testing.T) {
+	policies, err := ParseShadowPolicies("strict:short_ban:6:5, stricter-long:long_ban:720:10, spray:short_ban:1:3:unknown-user", []string{"USER_NOT_FOUND"})
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	if len(policies) != 3 {
+		t.Logf("Expected 3 policies, got %d", len(policies))
+		t.FailNow()
+	}
+	if policies[0].Name != "strict" || policies[0].Kind != KindFailures || policies[0].Table != "short_ban" ||
+		policies[0].Period != 6 || policies[0].Limit != 5 || !policies[0].Shadow {
+		t.Logf("Unexpected policy: %+v", policies[0])
+		t.Fail()
+	}
+	if policies[1].Name != "stricter-long" || policies[1].Table != "long_ban" || !policies[1].Shadow {
+		t.Logf("Unexpected policy: %+v", policies[1])
+		t.Fail()
+	}
+	if policies[2].Kind != KindUnknownUser || len(policies[2].Reasons) != 1 || policies[2].Reasons[0] != "USER_NOT_FOUND" {
+		t.Logf("Unexpected policy: %+v", policies[2])
+		t.Fail()
+	}
+}
+
+func TestParseShadowPoliciesEmpty(t *testing.T) {
+	policies, err := ParseShadowPolicies("", nil)
+	if err != nil || len(policies) != 0 {
+		t.Log("An empty value should have no policies")
+		t.Fail()
+	}
+}
+
+func TestParseShadowPoliciesInvalid(t *testing.T) {
+	for _, value := range []string{
+		"strict:short_ban:6",
+		"strict:other_table:6:5",
+		"strict:short_ban:six:5",
+		"strict:short_ban:6:0",
+		"strict:short_ban:6:5,strict:long_ban:6:5",
+		"strict:short_ban:6:5:other-kind",
+	} {
+		if _, err := ParseShadowPolicies(value, nil); err == nil {
+			t.Logf("Expected an error for %q", value)
+			t.Fail()
+		}
+	}
+}
+
+func TestBanPolicies(t *testing.T) {
+	env := EnvConfig{
+		ShortTermPeriod: 6,
+		ShortTermLimit:  10,
+		LongTermPeriod:  720,
+		LongTermLimit:   15,
+		ShadowPolicies:  []BanPolicy{{Name: "strict", Table: "short_ban", Period: 6, Limit: 5, Shadow: true}},
+	}
+	policies := env.BanPolicies()
+	if len(policies) != 3 || policies[0].Table != "short_ban" || policies[1].Limit != 15 || !policies[2].Shadow {
+		t.Logf("Unexpected policies: %+v", policies)
+		t.Fail()
+	}
+}
+
+func TestBanPoliciesDetectors(t *testing.T) {
+	env := EnvConfig{
+		ShortTermPeriod:      6,
+		ShortTermLimit:       10,
+		LongTermPeriod:       720,
+		LongTermLimit:        15,
+		IPsPerUsernameLimit:  5,
+		IPsPerUsernamePeriod: 1,
+		IPsPerUsernameAction: "long_ban",
+		PasswordSprayLimit:   20,
+		PasswordSprayPeriod:  2,
+		PasswordSprayAction:  "long_ban",
+	}
+	policies := env.BanPolicies()
+	if len(policies) != 4 {
+		t.Logf("Only enabled detectors should be added, got %+v", policies)
+		t.FailNow()
+	}
+	if policies[2].Kind != KindIPsPerUsername || policies[2].Table != "long_ban" || policies[2].Limit != 5 {
+		t.Logf("Unexpected policy: %+v", policies[2])
+		t.Fail()
+	}
+	if policies[3].Kind != KindPasswordSpray || policies[3].Period != 2 || policies[3].Limit != 20 {
+		t.Logf("Unexpected policy: %+v", policies[3])
+		t.Fail()
+	}
+}
+
+func TestBanPoliciesGeoIP(t *testing.T) {
+	env := EnvConfig{
+		ShortTermPeriod:   6,
+		ShortTermLimit:    10,
+		LongTermPeriod:    720,
+		LongTermLimit:     15,
+		HighRiskCountries: []string{"KP"},
+		HighRiskFactor:    0.25,
+		HostingASNs:       []uint{16509},
+		HostingASNLimit:   1,
+		HostingASNPeriod:  1,
+		HostingASNAction:  "short_ban",
+		ASNFailureLimit:   50,
+		ASNFailurePeriod:  1,
+		ASNFailureAction:  "long_ban",
+	}
+	policies := env.BanPolicies()
+	if len(policies) != 4 || policies[2].Kind != KindHostingASN || policies[3].Kind != KindFailuresPerASN ||
+		policies[3].Table != "long_ban" {
+		t.Logf("Unexpected policies: %+v", policies)
+		t.FailNow()
+	}
+	if !policies[2].HasASN(16509) || policies[2].HasASN(0) || policies[3].HasASN(16509) {
+		t.Logf("Only the hosting-asn policy should have the ASNs: %+v", policies)
+		t.Fail()
+	}
+	cases := []struct {
+		country  string
+		policy   int
+		expected int
+	}{
+		{"KP", 0, 3},
+		{"KP", 1, 4},
+		{"DE", 0, 10},
+		{"", 1, 15},
+		// never lowered below 1
+		{"KP", 2, 1},
+		// failures-per-asn isn't lowered
+		{"KP", 3, 50},
+	}
+	for _, c := range cases {
+		if limit := policies[c.policy].LimitFor(&NewFailure{Country: c.country}); limit != c.expected {
+			t.Logf("%s on %s: expected a limit of %d, got %d", c.country, policies[c.policy].Name, c.expected, limit)
+			t.Fail()
+		}
+	}
+}
+
+func TestParseScopedPolicies(t *testing.T) {
+	policies, err := ParseScopedPolicies("portal:short_ban:1:3::app=portal;endpoint=/api/login, eu:long_ban:24:10:usernames-per-ip:label.region=eu", nil)
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	if len(policies) != 2 || policies[0].Kind != KindFailures || policies[0].Shadow ||
+		policies[0].Match["app"] != "portal" || policies[0].Match["endpoint"] != "/api/login" ||
+		policies[1].Kind != KindUsernamesPerIP || policies[1].Match["label.region"] != "eu" {
+		t.Logf("Unexpected policies: %+v", policies)
+		t.Fail()
+	}
+	for _, value := range []string{
+		"portal:short_ban:1:3",
+		"portal:short_ban:1:3:",
+		"portal:short_ban:1:3::app",
+		"portal:short_ban:1:3::country=DE",
+		"portal:short_ban:1:3::app=a;app=b",
+	} {
+		if _, err := ParseScopedPolicies(value, nil); err == nil {
+			t.Logf("Expected an error for %q", value)
+			t.Fail()
+		}
+	}
+	// shadow policies can be scoped too
+	shadow, err := ParseShadowPolicies("portal-strict:short_ban:1:2:failures:app=portal", nil)
+	if err != nil || len(shadow) != 1 || !shadow[0].Shadow || shadow[0].Match["app"] != "portal" {
+		t.Logf("Unexpected shadow policies: %+v (err: %v)", shadow, err)
+		t.Fail()
+	}
+	env := EnvConfig{ScopedPolicies: policies, ShadowPolicies: shadow}
+	if all := env.BanPolicies(); len(all) != 5 || all[2].Name != "portal" || !all[4].Shadow {
+		t.Logf("Scoped policies should come before the shadow policies: %+v", all)
+		t.Fail()
+	}
+}
+
+func TestParseReasonWeights(t *testing.T) {
+	weights, err := ParseReasonWeights("MFA_FAILURE:5, USER_NOT_FOUND:0.5", 1, []string{"PASSWORD_EXPIRED"})
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	if weights.Weight("MFA_FAILURE") != 5 || weights.Weight("USER_NOT_FOUND") != 0.5 || weights.Weight("OTHER") != 1 {
+		t.Logf("Unexpected weights: %+v", weights)
+		t.Fail()
+	}
+	if !weights.Ignored("PASSWORD_EXPIRED") || weights.Ignored("MFA_FAILURE") {
+		t.Log("Only PASSWORD_EXPIRED should be ignored")
+		t.Fail()
+	}
+	record := NewFailure{Reason: "PASSWORD_EXPIRED"}
+	weights.Apply(&record)
+	if !record.ReasonIgnored || record.Weight != 0 {
+		t.Logf("An ignored reason should weigh nothing: %+v", record)
+		t.Fail()
+	}
+	var none *ReasonWeights
+	if none.Weight("MFA_FAILURE") != 1 || none.Ignored("MFA_FAILURE") {
+		t.Log("Without weights every failure should count as 1")
+		t.Fail()
+	}
+	for _, value := range []string{"MFA_FAILURE", "MFA_FAILURE:x", "MFA_FAILURE:-1", ":2"} {
+		if _, err := ParseReasonWeights(value, 1, nil); err == nil {
+			t.Logf("Expected an error for %q", value)
+			t.Fail()
+		}
+	}
+}
+
+func TestSuccessActions(t *testing.T) {
+	actions, err := ParseSuccessActions("long:none, strict:trust")
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	shadow, _ := ParseShadowPolicies("strict:short_ban:6:5", nil)
+	env := EnvConfig{SuccessAction: SuccessDiscount, SuccessPolicyActions: actions, ShadowPolicies: shadow}
+	policies := env.BanPolicies()
+	if policies[0].OnSuccess != SuccessDiscount || policies[1].OnSuccess != SuccessNone || policies[2].OnSuccess != SuccessTrust {
+		t.Logf("Unexpected policies: %+v", policies)
+		t.Fail()
+	}
+	if env.ShadowPolicies[0].OnSuccess != "" {
+		t.Log("BanPolicies shouldn't change the configured shadow policies")
+		t.Fail()
+	}
+	if !env.trustsSuccesses() {
+		t.Log("strict trusts IPs after a successful logon")
+		t.Fail()
+	}
+	for _, value := range []string{"long", "long:forgive", ":trust"} {
+		if _, err := ParseSuccessActions(value); err == nil {
+			t.Logf("Expected an error for %q", value)
+			t.Fail()
+		}
+	}
+}
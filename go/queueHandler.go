@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrQueueFull is returned when the ban evaluation queue can't take any more events
+var ErrQueueFull = errors.New("Ban evaluation queue is full")
+
+// BanEvaluator is a function that decides whether the IP in record should be banned
+type BanEvaluator func(record *NewFailure)
+
+// BanQueue is a bounded queue of events waiting for ban evaluation. A fixed pool
+// of workers drains it so that a flood of failures can't spawn an unbounded
+// number of goroutines (and database connections).
+type BanQueue struct {
+	jobs      chan *NewFailure
+	evaluate  BanEvaluator
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+
+	processed *Counter
+	dropped   *Counter
+	rejected  *Counter
+}
+
+// NewBanQueue creates a queue holding up to depth events and starts workers goroutines to drain it
+func NewBanQueue(depth, workers int, evaluate BanEvaluator) *BanQueue {
+	if depth < 1 {
+		depth = 1
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	q := &BanQueue{
+		jobs:     make(chan *NewFailure, depth),
+		evaluate: evaluate,
+		processed: RegisterCounter("autowaf_queue_processed_total",
+			"Events that have been evaluated for a ban"),
+		dropped: RegisterCounter("autowaf_queue_dropped_total",
+			"Events that were stored but couldn't be queued for ban evaluation"),
+		rejected: RegisterCounter("autowaf_queue_rejected_total",
+			"Events that were turned away because the queue was saturated"),
+	}
+	RegisterGauge("autowaf_queue_depth", "Events waiting for ban evaluation",
+		func() float64 { return float64(q.Depth()) })
+	RegisterGauge("autowaf_queue_capacity", "Maximum number of events waiting for ban evaluation",
+		func() float64 { return float64(q.Capacity()) })
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	log.Debug().Int("Depth", depth).Int("Workers", workers).Msg("Started ban evaluation queue")
+	return q
+}
+
+func (q *BanQueue) work() {
+	defer q.wg.Done()
+	for record := range q.jobs {
+		q.evaluate(record)
+		q.processed.Inc()
+	}
+}
+
+// Enqueue adds record to the queue without blocking. ErrQueueFull is returned if there is no room.
+func (q *BanQueue) Enqueue(record *NewFailure) error {
+	select {
+	case q.jobs <- record:
+		return nil
+	default:
+		q.dropped.Inc()
+		return ErrQueueFull
+	}
+}
+
+// Admit checks whether the queue has room for another event. Callers use it to
+// turn work away before doing anything expensive with it.
+func (q *BanQueue) Admit() error {
+	if q.Depth() >= q.Capacity() {
+		q.rejected.Inc()
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// Depth is the number of events currently waiting
+func (q *BanQueue) Depth() int {
+	return len(q.jobs)
+}
+
+// Capacity is the maximum number of events that can wait in the queue
+func (q *BanQueue) Capacity() int {
+	return cap(q.jobs)
+}
+
+// Close stops accepting events and waits for the workers to drain the queue
+func (q *BanQueue) Close() {
+	q.closeOnce.Do(func() {
+		close(q.jobs)
+	})
+	q.wg.Wait()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestBanQueueEvaluates(t *testing.T) {
+	var mu sync.Mutex
+	seen := []string{}
+	q := NewBanQueue(10, 2, func(record *NewFailure) {
+		mu.Lock()
+		seen = append(seen, record.IP)
+		mu.Unlock()
+	})
+	for _, ip := range []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"} {
+		if err := q.Enqueue(&NewFailure{IP: ip}); err != nil {
+			t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+			t.Fail()
+		}
+	}
+	q.Close()
+	if len(seen) != 3 {
+		t.Logf("Expected 3 evaluations, got %d", len(seen))
+		t.Fail()
+	}
+}
+
+func TestBanQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	started := make(chan struct{})
+	q := NewBanQueue(1, 1, func(record *NewFailure) {
+		started <- struct{}{}
+		<-block
+	})
+	// the worker holds the first event, the second one fills the queue
+	_ = q.Enqueue(&NewFailure{IP: "192.168.1.1"})
+	<-started
+	if err := q.Enqueue(&NewFailure{IP: "192.168.1.2"}); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.Fail()
+	}
+	if err := q.Admit(); err != ErrQueueFull {
+		t.Log("Admit should have reported a full queue")
+		t.Fail()
+	}
+	if err := q.Enqueue(&NewFailure{IP: "192.168.1.3"}); err != ErrQueueFull {
+		t.Log("Enqueue should have reported a full queue")
+		t.Fail()
+	}
+	close(block)
+	go func() {
+		for range started {
+		}
+	}()
+	q.Close()
+	close(started)
+}
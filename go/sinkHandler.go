@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/wafv2"
+	"github.com/rs/zerolog/log"
+)
+
+// BanEntry is an address on the blocklist
+type BanEntry struct {
+	// IP is the address, or the network in CIDR form for threat intel entries that cover more than one
+	IP string
+	// CIDR is the IP as a single address CIDR, e.g. 192.168.1.1/32, or the network
+	CIDR string
+	// Added is when the ban started, or was last extended
+	Added time.Time
+	// Expires is when the ban runs out, unless it's extended
+	Expires time.Time
+	// Source is the threat intel feed the entry came from, empty for autowaf's own bans
+	Source string
+}
+
+// NewBanEntry makes the blocklist entry for ip, in the form blocklistIP gives it
+func NewBanEntry(ip string, expires time.Time) BanEntry {
+	ip = blocklistIP(ip)
+	return BanEntry{IP: ip, CIDR: hostCIDR(ip), Expires: expires}
+}
+
+// blocklistIP is the form an address takes on the blocklist. An IPv4-mapped IPv6 address is
+// turned into the IPv4 address, so every sink gets the same IP and CIDR for it.
+func blocklistIP(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// NewNetworkBanEntry makes the blocklist entry for network, which is a plain address entry
+// when the network is a single address
+func NewNetworkBanEntry(network *net.IPNet, expires time.Time) BanEntry {
+	ones, bits := network.Mask.Size()
+	if ones == bits {
+		return NewBanEntry(network.IP.String(), expires)
+	}
+	return BanEntry{IP: network.String(), CIDR: network.String(), Expires: expires}
+}
+
+// entryNetwork returns the network a blocklist entry covers
+func entryNetwork(entry BanEntry) *net.IPNet {
+	_, network, err := net.ParseCIDR(entry.CIDR)
+	if err != nil {
+		return nil
+	}
+	return network
+}
+
+// AllowList is the networks that are never put on the blocklist
+type AllowList []*net.IPNet
+
+// ParseAllowList parses a list of addresses and CIDRs
+func ParseAllowList(values []string) (AllowList, error) {
+	allow := AllowList{}
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			value = hostCIDR(value)
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s isn't an address or CIDR", value)
+		}
+		allow = append(allow, network)
+	}
+	return allow, nil
+}
+
+// Covers is true when entry overlaps an allowed network. A network from a threat intel feed
+// that contains an allowed address is covered as a whole.
+func (a AllowList) Covers(entry BanEntry) bool {
+	network := entryNetwork(entry)
+	if network == nil {
+		return false
+	}
+	for _, allowed := range a {
+		if allowed.Contains(network.IP) || network.Contains(allowed.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the entries the allowlist doesn't cover
+func (a AllowList) Filter(entries []BanEntry) []BanEntry {
+	if len(a) == 0 {
+		return entries
+	}
+	kept := make([]BanEntry, 0, len(entries))
+	for _, entry := range entries {
+		if a.Covers(entry) {
+			log.Info().Str("IP", entry.CIDR).Str("Source", entry.Source).Msg("Leaving allowlisted address off the blocklist")
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	return kept
+}
+
+// hostCIDR returns ip as a CIDR that covers only that address
+func hostCIDR(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed != nil && parsed.To4() == nil {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
+
+// BlockListSink is somewhere the blocklist is pushed to, such as an AWS WAF IP set
+type BlockListSink interface {
+	// Name identifies the sink in logs and waf-sync events
+	Name() string
+	// Sync makes the sink's blocklist match entries. With dryRun it only logs what it would change.
+	Sync(entries []BanEntry, dryRun bool) error
+	// Remove takes ip off the sink's blocklist straight away. It returns ErrIPNotFound when
+	// the IP isn't on it.
+	Remove(ip string) error
+}
+
+// the sinks the blocklist is pushed to, set up in main
+var sinks []BlockListSink
+
+// currentBanList returns the short and long term bans and the threat intel entries, less
+// the allowlist, ordered by CIDR
+func currentBanList(db *sql.DB) []BanEntry {
+	entries := make(map[string]BanEntry)
+	if db == nil {
+		return sortedBanEntries(entries)
+	}
+	GetBanEntries(db, "short_ban", envConfig.ShortTermPeriod, entries)
+	GetBanEntries(db, "long_ban", envConfig.LongTermPeriod, entries)
+	GetIntelEntries(db, envConfig.IntelMaxAge, entries)
+	return envConfig.AllowList.Filter(sortedBanEntries(entries))
+}
+
+// sortedBanEntries returns the entries ordered by CIDR
+func sortedBanEntries(entries map[string]BanEntry) []BanEntry {
+	sorted := make([]BanEntry, 0, len(entries))
+	for _, entry := range entries {
+		sorted = append(sorted, entry)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].CIDR < sorted[j].CIDR })
+	return sorted
+}
+
+// syncSinks pushes entries to every sink, publishing a waf-sync event for each
+func syncSinks(entries []BanEntry, dryRun bool) {
+	for _, sink := range sinks {
+		err := sink.Sync(entries, dryRun)
+		if dryRun {
+			continue
+		}
+		syncEvent := BanEvent{Type: EventWAFSync, Region: sink.Name(), Count: len(entries), Ts: time.Now().UTC()}
+		if err != nil {
+			log.Error().Str("Sink", sink.Name()).Str("Error", err.Error()).Msg("Error syncing blocklist")
+			syncEvent.Error = err.Error()
+		}
+		eventBus.Publish(syncEvent)
+	}
+}
+
+// removeFromSinks takes ip off every sink's blocklist, returning the number of sinks that failed.
+// Sinks that didn't have the IP don't count as failures.
+func removeFromSinks(ip string) int {
+	// the sinks hold the address as NewBanEntry gave it to them
+	ip = blocklistIP(ip)
+	failures := 0
+	for _, sink := range sinks {
+		err := sink.Remove(ip)
+		if err != nil && err != ErrIPNotFound {
+			log.Error().Str("Sink", sink.Name()).Str("IP", ip).Str("Error", err.Error()).Msg("Error removing IP from blocklist")
+			failures++
+		}
+	}
+	return failures
+}
+
+// ruleUpdate reads a sink's current addresses, lets change work out the new ones from them and
+// writes those. change returning nil leaves the sink as it is. It returns whether anything changed.
+type ruleUpdate func(change func(current []string) []string) (bool, error)
+
+// syncRules is Sync for the sinks that keep the blocklist in policy rules: it makes the rules
+// hold exactly the entries, or with dryRun only logs what would change. what names the rules
+// in the logs, e.g. "Azure WAF policy".
+func syncRules(sink BlockListSink, what string, update ruleUpdate, entries []BanEntry, dryRun bool) error {
+	desired := make([]string, len(entries))
+	for i := range entries {
+		desired[i] = entries[i].CIDR
+	}
+	sort.Strings(desired)
+	if dryRun {
+		_, err := update(func(current []string) []string {
+			currentPtrs := make([]*string, len(current))
+			for i := range current {
+				currentPtrs[i] = &current[i]
+			}
+			desiredPtrs := make([]*string, len(desired))
+			for i := range desired {
+				desiredPtrs[i] = &desired[i]
+			}
+			added, removed := DiffAddresses(currentPtrs, desiredPtrs)
+			log.Info().Str("Sink", sink.Name()).Strs("Added", added).Strs("Removed", removed).Msg("Dry run: not updating " + what)
+			return nil
+		})
+		return err
+	}
+	changed, err := update(func(current []string) []string { return desired })
+	if err == nil && changed {
+		log.Info().Str("Sink", sink.Name()).Int("Count", len(desired)).Msg("Updated " + what)
+	}
+	return err
+}
+
+// removeFromRules is Remove for the sinks that keep the blocklist in policy rules
+func removeFromRules(update ruleUpdate, ip string) error {
+	target := hostCIDR(ip)
+	found := false
+	_, err := update(func(current []string) []string {
+		kept := []string{}
+		for _, cidr := range current {
+			if cidr == target {
+				found = true
+				continue
+			}
+			kept = append(kept, cidr)
+		}
+		if !found {
+			return nil
+		}
+		return kept
+	})
+	if err == nil && !found {
+		return ErrIPNotFound
+	}
+	return err
+}
+
+// AWSSink is the AWS WAF IP set in a region
+type AWSSink struct {
+	session *session.Session
+	envconf *EnvConfig
+}
+
+// NewAWSSink makes the sink for the region of session
+func NewAWSSink(session *session.Session, envconf *EnvConfig) *AWSSink {
+	return &AWSSink{session: session, envconf: envconf}
+}
+
+// Name is the AWS region
+func (s *AWSSink) Name() string {
+	return *s.session.Config.Region
+}
+
+// Sync replaces the addresses in the IP set
+func (s *AWSSink) Sync(entries []BanEntry, dryRun bool) error {
+	wafclient := wafv2.New(s.session)
+	iplist := make([]*string, len(entries))
+	for i := range entries {
+		iplist[i] = &entries[i].CIDR
+	}
+	ipset, err := GetIPSet(wafclient.ListIPSets, s.envconf)
+	if err != nil {
+		log.Error().
+			Str("Error", err.Error()).
+			Str("IPset Name", s.envconf.BlockListName).
+			Msg("Couldn't find an ipset")
+		return err
+	}
+	if dryRun {
+		logIPSetDiff(wafclient.GetIPSet, ipset, iplist, s.Name())
+		return nil
+	}
+	// error is handled/logged in this function
+	return UpdateIPSet(iplist, wafclient.UpdateIPSet, ipset)
+}
+
+// Remove takes ip out of the IP set
+func (s *AWSSink) Remove(ip string) error {
+	wafclient := wafv2.New(s.session)
+	return RemoveIPfromIPSet(wafclient.ListIPSets, wafclient.GetIPSet, wafclient.UpdateIPSet, s.envconf, &ip)
+}
@@ -3,24 +3,174 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"net"
+	"strconv"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/rs/zerolog/log"
 )
 
 //shortban and longban upsert SQL commands because you can't parameterize table names in Go
-var shortBanUpsert string = "INSERT INTO  short_ban(ip, ts_added) VALUES ($1, $2) ON CONFLICT(ip) DO UPDATE SET ts_added = $2;"
-var longBanUpsert string = "INSERT INTO  long_ban(ip, ts_added) VALUES ($1, $2) ON CONFLICT(ip) DO UPDATE SET ts_added = $2;"
+// xmax is 0 for a freshly inserted row, which tells a new ban apart from a refreshed one
+// a ban autowaf makes itself takes over one a federation peer made, clearing its origin
+var shortBanUpsert string = "INSERT INTO  short_ban(ip, ts_added) VALUES ($1, $2) ON CONFLICT(ip) DO UPDATE SET ts_added = $2, origin = NULL RETURNING (xmax = 0);"
+var longBanUpsert string = "INSERT INTO  long_ban(ip, ts_added) VALUES ($1, $2) ON CONFLICT(ip) DO UPDATE SET ts_added = $2, origin = NULL RETURNING (xmax = 0);"
 
-// shortban and longban cleanup statements
-var shortBanCleanup string = "DELETE FROM short_ban where ts_added < now() - ($1 || ' HOURS')::INTERVAL;"
-var longBanCleanup string = "DELETE FROM long_ban where ts_added < now() - ($1 || ' HOURS')::INTERVAL;"
+// every new ban autowaf makes itself, which the backtest compares with
+var banHistoryInsert string = "INSERT INTO ban_history(ip, ban_table, ts_added) VALUES ($1, $2, $3);"
+
+// federated ban upserts never shorten a ban or take over autowaf's own
+var shortBanFederatedUpsert string = `INSERT INTO short_ban(ip, ts_added, origin) VALUES ($1, $2, $3)
+	ON CONFLICT(ip) DO UPDATE SET ts_added = GREATEST(short_ban.ts_added, $2) RETURNING (xmax = 0);`
+var longBanFederatedUpsert string = `INSERT INTO long_ban(ip, ts_added, origin) VALUES ($1, $2, $3)
+	ON CONFLICT(ip) DO UPDATE SET ts_added = GREATEST(long_ban.ts_added, $2) RETURNING (xmax = 0);`
+
+// shortban and longban cleanup statements, returning each IP and whether it's still banned in the other table
+var shortBanCleanup string = `DELETE FROM short_ban s where ts_added < now() - ($1 || ' HOURS')::INTERVAL
+	RETURNING ip, EXISTS(SELECT 1 FROM long_ban l WHERE l.ip = s.ip);`
+var longBanCleanup string = `DELETE FROM long_ban l where ts_added < now() - ($1 || ' HOURS')::INTERVAL
+	RETURNING ip, EXISTS(SELECT 1 FROM short_ban s WHERE s.ip = l.ip);`
 var logonAuditCleanup string = "DELETE FROM logon_audit where ts < now() - ($1 || ' HOURS')::INTERVAL;"
+var webhookOutboxCleanup string = "DELETE FROM webhook_outbox where created < now() - ($1 || ' HOURS')::INTERVAL;"
+var banHistoryCleanup string = "DELETE FROM ban_history where ts_added < now() - ($1 || ' HOURS')::INTERVAL;"
+
+// ban policy counts, $3 leaves out failures discounted by a later successful logon and $4
+// is the metadata a scoped policy's failures contain, NULL for every failure
+var failureScore string = `SELECT COALESCE(SUM(weight), 0)
+	FROM logon_audit
+	WHERE ip = $1
+	AND ignore = FALSE
+	AND reason_ignored = FALSE
+	AND ts > now() - ($2 || ' HOURS')::INTERVAL
+	AND NOT (discounted AND $3)
+	AND ($4::JSONB IS NULL OR metadata @> $4);`
+var usernamesPerIPCount string = `SELECT count(DISTINCT username)
+	FROM logon_audit
+	WHERE ip = $1
+	AND ignore = FALSE
+	AND reason_ignored = FALSE
+	AND ts > now() - ($2 || ' HOURS')::INTERVAL
+	AND NOT (discounted AND $3)
+	AND ($4::JSONB IS NULL OR metadata @> $4);`
+var ipsPerUsernameCount string = `SELECT count(DISTINCT ip)
+	FROM logon_audit
+	WHERE username = ANY($1)
+	AND ignore = FALSE
+	AND reason_ignored = FALSE
+	AND ts > now() - ($2 || ' HOURS')::INTERVAL
+	AND NOT (discounted AND $3)
+	AND ($4::JSONB IS NULL OR metadata @> $4);`
+var unknownUserCount string = `SELECT count(*)
+	FROM logon_audit
+	WHERE ip = $1
+	AND ignore = FALSE
+	AND reason_ignored = FALSE
+	AND ts > now() - ($2 || ' HOURS')::INTERVAL
+	AND NOT (discounted AND $3)
+	AND ($4::JSONB IS NULL OR metadata @> $4)
+	AND reason = ANY($5);`
+var usernameIPs string = `SELECT DISTINCT ip
+	FROM logon_audit
+	WHERE username = ANY($1)
+	AND ignore = FALSE
+	AND reason_ignored = FALSE
+	AND ts > now() - ($2 || ' HOURS')::INTERVAL
+	AND NOT (discounted AND $3)
+	AND ($4::JSONB IS NULL OR metadata @> $4);`
+var usernamesPerPwhashCount string = `SELECT count(DISTINCT username)
+	FROM logon_audit
+	WHERE pwhash = ANY($1)
+	AND ignore = FALSE
+	AND reason_ignored = FALSE
+	AND ts > now() - ($2 || ' HOURS')::INTERVAL
+	AND NOT (discounted AND $3)
+	AND ($4::JSONB IS NULL OR metadata @> $4);`
+var pwhashIPs string = `SELECT DISTINCT ip
+	FROM logon_audit
+	WHERE pwhash = ANY($1)
+	AND ignore = FALSE
+	AND reason_ignored = FALSE
+	AND ts > now() - ($2 || ' HOURS')::INTERVAL
+	AND NOT (discounted AND $3)
+	AND ($4::JSONB IS NULL OR metadata @> $4);`
+var asnFailureScore string = `SELECT COALESCE(SUM(weight), 0)
+	FROM logon_audit
+	WHERE asn = $1
+	AND ignore = FALSE
+	AND reason_ignored = FALSE
+	AND ts > now() - ($2 || ' HOURS')::INTERVAL
+	AND NOT (discounted AND $3)
+	AND ($4::JSONB IS NULL OR metadata @> $4);`
+var asnIPs string = `SELECT DISTINCT ip
+	FROM logon_audit
+	WHERE asn = ANY($1::BIGINT[])
+	AND ignore = FALSE
+	AND reason_ignored = FALSE
+	AND ts > now() - ($2 || ' HOURS')::INTERVAL
+	AND NOT (discounted AND $3)
+	AND ($4::JSONB IS NULL OR metadata @> $4);`
+
+// pepper rotation statements. Rows stored under an old key are moved onto the active key when the
+// same username or password comes in again, so distinct counts see one value for it rather than
+// one per key.
+var rekeyUsernames string = "UPDATE logon_audit SET username = $1 WHERE username = ANY($2);"
+var rekeyPwhashes string = "UPDATE logon_audit SET pwhash = $1 WHERE pwhash = ANY($2);"
+
+// successful logon statements
+var discountFailures string = `UPDATE logon_audit SET discounted = TRUE
+	WHERE ip = $1
+	AND username = ANY($2)
+	AND ts <= $3
+	AND discounted = FALSE;`
+var trustedIPUpsert string = `INSERT INTO trusted_ip(ip, ts_added, expires) VALUES ($1, $2, $2::TIMESTAMP + ($3 || ' HOURS')::INTERVAL)
+	ON CONFLICT(ip) DO UPDATE SET ts_added = $2, expires = GREATEST(trusted_ip.expires, EXCLUDED.expires);`
+var trustedIPCheck string = "SELECT EXISTS(SELECT 1 FROM trusted_ip WHERE ip = $1 AND expires > now());"
+var trustedIPCleanup string = "DELETE FROM trusted_ip where expires < now();"
+
+// exemption statements
+var exemptionUpsert string = `INSERT INTO ip_exemption(ip, operator, reason, ts_added, expires)
+	VALUES ($1, $2, $3, $4, $4::TIMESTAMP + ($5 || ' HOURS')::INTERVAL)
+	ON CONFLICT(ip) DO UPDATE SET operator = $2, reason = $3, ts_added = $4, expires = EXCLUDED.expires;`
+var exemptionCheck string = "SELECT EXISTS(SELECT 1 FROM ip_exemption WHERE ip = $1 AND expires > now());"
+var exemptionCleanup string = "DELETE FROM ip_exemption where expires < now() RETURNING ip;"
+
+// shadow ban statements
+var shadowBanUpsert string = `INSERT INTO shadow_ban(policy, ip, ts_added, count) VALUES ($1, $2, $3, $4)
+	ON CONFLICT(policy, ip) DO UPDATE SET ts_added = $3, count = $4 RETURNING (xmax = 0);`
+var shadowBanCleanup string = "DELETE FROM shadow_ban where policy = $1 AND ts_added < now() - ($2 || ' HOURS')::INTERVAL;"
+var shadowBanOrphanCleanup string = "DELETE FROM shadow_ban where NOT (policy = ANY($1));"
 
 // get ips commands
-var shortBanIPs string = "SELECT ip from short_ban"
-var longBanIPs string = "SELECT ip from long_ban"
+// exempt IPs are left off the blocklist even if they're still in a ban table
+var shortBanIPs string = "SELECT ip, ts_added from short_ban WHERE ip NOT IN (SELECT ip FROM ip_exemption WHERE expires > now())"
+var longBanIPs string = "SELECT ip, ts_added from long_ban WHERE ip NOT IN (SELECT ip FROM ip_exemption WHERE expires > now())"
+
+// threat intel statements
+// an entry seen again keeps when it was first added, and entries a feed no longer lists are
+// deleted once the feed has been imported
+var intelUpsert string = `INSERT INTO intel_ban(cidr, source, ts_added, last_seen) VALUES ($1, $2, $3, $3)
+	ON CONFLICT(cidr, source) DO UPDATE SET last_seen = $3;`
+var intelExpireSource string = "DELETE FROM intel_ban WHERE source = $1 AND last_seen < $2;"
+var intelCleanup string = "DELETE FROM intel_ban WHERE last_seen < now() - ($1 || ' HOURS')::INTERVAL;"
+
+// exempt IPs inside an intel network leave the whole network off the blocklist
+var intelBanCIDRs string = `SELECT cidr, source, ts_added, last_seen FROM intel_ban i WHERE NOT EXISTS
+	(SELECT 1 FROM ip_exemption e WHERE e.expires > now() AND e.ip::inet <<= i.cidr::inet)`
+
+// federation quorum statements
+var federationReportUpsert string = `INSERT INTO federation_report(ip, peer, ban_table, ts) VALUES ($1, $2, $3, $4)
+	ON CONFLICT(ip, peer) DO UPDATE SET ban_table = $3, ts = $4;`
+var federationReportCount string = `SELECT COUNT(*), COUNT(*) FILTER (WHERE ban_table = 'long_ban') FROM federation_report
+	WHERE ip = $1 AND ts > now() - ($2 || ' HOURS')::INTERVAL;`
+var federationReportCleanup string = "DELETE FROM federation_report WHERE ts < now() - ($1 || ' HOURS')::INTERVAL;"
+
+// federation replay statements, an event id is kept until its timestamp is outside the skew window
+var federationSeenInsert string = `INSERT INTO federation_seen(origin, event_id, expires) VALUES ($1, $2, $3)
+	ON CONFLICT DO NOTHING RETURNING TRUE;`
+var federationSeenDelete string = "DELETE FROM federation_seen WHERE origin = $1 AND event_id = $2;"
+var federationSeenCleanup string = "DELETE FROM federation_seen WHERE expires < now();"
 
 // CreateTablesIfNotExist creates the sql tables in the DB if they don't exist
 func CreateTablesIfNotExist(db *sql.DB) {
@@ -29,7 +179,7 @@ func CreateTablesIfNotExist(db *sql.DB) {
 	// ABCD:ABCD:ABCD:ABCD:ABCD:ABCD:192.168.158.190
 
 	// at time of writing, max username length is 120:
-	tables := [3]string{
+	tables := []string{
 		`CREATE TABLE IF NOT EXISTS logon_audit (
 			id SERIAL PRIMARY KEY,
 			ts TIMESTAMP,
@@ -39,6 +189,18 @@ func CreateTablesIfNotExist(db *sql.DB) {
 			reason VARCHAR(100),
 			ignore boolean DEFAULT FALSE
 		);`,
+		// how much the failure counts towards the failures policies
+		`ALTER TABLE logon_audit ADD COLUMN IF NOT EXISTS weight REAL DEFAULT 1;`,
+		// set for failures whose reason is in REASON_IGNORE, which never count. ignore is only
+		// set when an admin unblocks the IP.
+		`ALTER TABLE logon_audit ADD COLUMN IF NOT EXISTS reason_ignored BOOLEAN DEFAULT FALSE;`,
+		// set once a successful logon from the same IP and username discounts the failure
+		`ALTER TABLE logon_audit ADD COLUMN IF NOT EXISTS discounted BOOLEAN DEFAULT FALSE;`,
+		// where the IP was when the failure came in, NULL without the GeoIP databases
+		`ALTER TABLE logon_audit ADD COLUMN IF NOT EXISTS country VARCHAR(2);`,
+		`ALTER TABLE logon_audit ADD COLUMN IF NOT EXISTS asn BIGINT;`,
+		// the optional request metadata of the failure, NULL when it has none
+		`ALTER TABLE logon_audit ADD COLUMN IF NOT EXISTS metadata JSONB;`,
 		`CREATE TABLE IF NOT EXISTS short_ban(
 			id SERIAL PRIMARY KEY,
 			ip varchar(45) UNIQUE,
@@ -47,6 +209,101 @@ func CreateTablesIfNotExist(db *sql.DB) {
 			id SERIAL PRIMARY KEY,
 			ip varchar(45) UNIQUE,
 			ts_added TIMESTAMP);`,
+		// the federation peer a ban came from, NULL for autowaf's own bans
+		`ALTER TABLE short_ban ADD COLUMN IF NOT EXISTS origin VARCHAR(64);`,
+		`ALTER TABLE long_ban ADD COLUMN IF NOT EXISTS origin VARCHAR(64);`,
+		// the bans autowaf made, which outlive the rows in short_ban and long_ban
+		`CREATE TABLE IF NOT EXISTS ban_history(
+			id SERIAL PRIMARY KEY,
+			ip varchar(45),
+			ban_table varchar(10),
+			ts_added TIMESTAMP);`,
+		// the hash of the blocklist feed and when it last changed, for Last-Modified
+		`CREATE TABLE IF NOT EXISTS feed_version(
+			id INTEGER PRIMARY KEY,
+			hash VARCHAR(64),
+			modified TIMESTAMP);`,
+		`CREATE TABLE IF NOT EXISTS shadow_ban(
+			id SERIAL PRIMARY KEY,
+			policy VARCHAR(100),
+			ip varchar(45),
+			ts_added TIMESTAMP,
+			count REAL,
+			UNIQUE (policy, ip));`,
+		// the score is a sum of reason weights, which don't have to be whole numbers
+		`ALTER TABLE shadow_ban ALTER COLUMN count TYPE REAL;`,
+		`CREATE TABLE IF NOT EXISTS webhook_outbox(
+			id SERIAL PRIMARY KEY,
+			url VARCHAR(2048),
+			event_type VARCHAR(50),
+			payload TEXT,
+			attempts INTEGER DEFAULT 0,
+			next_attempt TIMESTAMP DEFAULT now(),
+			delivered_at TIMESTAMP,
+			last_error TEXT,
+			created TIMESTAMP DEFAULT now());`,
+		`CREATE TABLE IF NOT EXISTS trusted_ip(
+			id SERIAL PRIMARY KEY,
+			ip varchar(45) UNIQUE,
+			ts_added TIMESTAMP,
+			expires TIMESTAMP);`,
+		`CREATE TABLE IF NOT EXISTS ip_exemption(
+			id SERIAL PRIMARY KEY,
+			ip varchar(45) UNIQUE,
+			operator VARCHAR(120),
+			reason TEXT,
+			ts_added TIMESTAMP,
+			expires TIMESTAMP);`,
+		// the intel query casts exemptions to inet, so only addresses can be stored
+		`DO $$ BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'ip_exemption_ip_inet') THEN
+				ALTER TABLE ip_exemption ADD CONSTRAINT ip_exemption_ip_inet CHECK (ip::inet IS NOT NULL) NOT VALID;
+			END IF;
+		END $$;`,
+		`CREATE TABLE IF NOT EXISTS admin_audit(
+			id SERIAL PRIMARY KEY,
+			ts TIMESTAMP DEFAULT now(),
+			action VARCHAR(50),
+			actor VARCHAR(120),
+			source_ip VARCHAR(45),
+			payload TEXT,
+			outcome TEXT);`,
+		// admin_audit is append only
+		`CREATE OR REPLACE FUNCTION admin_audit_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'admin_audit is append only';
+		END;
+		$$ LANGUAGE plpgsql;`,
+		`DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'admin_audit_append_only') THEN
+				CREATE TRIGGER admin_audit_append_only BEFORE UPDATE OR DELETE ON admin_audit
+					FOR EACH ROW EXECUTE PROCEDURE admin_audit_append_only();
+			END IF;
+		END;
+		$$;`,
+		`CREATE TABLE IF NOT EXISTS intel_ban(
+			cidr varchar(49),
+			source varchar(64),
+			ts_added TIMESTAMP,
+			last_seen TIMESTAMP,
+			PRIMARY KEY(cidr, source));`,
+		`CREATE TABLE IF NOT EXISTS federation_report(
+			ip varchar(45),
+			peer varchar(64),
+			ban_table varchar(10),
+			ts TIMESTAMP,
+			PRIMARY KEY(ip, peer));`,
+		`CREATE TABLE IF NOT EXISTS federation_seen(
+			origin varchar(64),
+			event_id varchar(64),
+			expires TIMESTAMP,
+			PRIMARY KEY(origin, event_id));`,
+		`CREATE INDEX IF NOT EXISTS logon_audit_pwhash ON logon_audit (pwhash, ts);`,
+		`CREATE INDEX IF NOT EXISTS logon_audit_username ON logon_audit (username, ts);`,
+		`CREATE INDEX IF NOT EXISTS logon_audit_asn ON logon_audit (asn, ts);`,
+		`CREATE INDEX IF NOT EXISTS ban_history_ts ON ban_history (ts_added);`,
+		`CREATE INDEX IF NOT EXISTS logon_audit_metadata ON logon_audit USING GIN (metadata jsonb_path_ops);`,
 	}
 	for _, sqlstring := range tables {
 		stmt, err := db.Prepare(sqlstring)
@@ -60,7 +317,8 @@ func CreateTablesIfNotExist(db *sql.DB) {
 	}
 }
 
-// InsertEvent puts a new event into the database
+// InsertEvent puts a new event into the database with the weight set by ReasonWeights.Apply.
+// Ignored reasons are stored but never count.
 func InsertEvent(db *sql.DB, record *NewFailure) error {
 	if record.IP == "" {
 		return errors.New("IP cannot be blank")
@@ -69,9 +327,20 @@ func InsertEvent(db *sql.DB, record *NewFailure) error {
 	if parsedIP == nil {
 		return errors.New("Failed to parse IP")
 	}
+	metadata, err := record.Metadata()
+	if err != nil {
+		return err
+	}
+	// a nil interface rather than a nil []byte, so pq stores NULL
+	var metadataArg interface{}
+	if metadata != nil {
+		metadataArg = string(metadata)
+	}
 	insertSQL := `INSERT INTO logon_audit
-	(ts,ip,username,pwhash,reason) VALUES ($1, $2, $3, $4, $5);`
-	_, err := db.Exec(insertSQL, record.Ts.Format(time.RFC3339), record.IP, record.Username, record.Pwhash, record.Reason)
+	(ts,ip,username,pwhash,reason,weight,reason_ignored,country,asn,metadata)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9::BIGINT, 0), $10::JSONB);`
+	_, err = db.Exec(insertSQL, record.Ts.Format(time.RFC3339), record.IP, record.Username, record.Pwhash, record.Reason,
+		record.Weight, record.ReasonIgnored, record.Country, int64(record.ASN), metadataArg)
 	if err != nil {
 		log.Error().Str("Error", err.Error()).Msg("Error inserting record into DB")
 		return err
@@ -79,48 +348,362 @@ func InsertEvent(db *sql.DB, record *NewFailure) error {
 	return nil
 }
 
-// CheckAndInsert checks to see if an IP should be added to `tablename`
-func CheckAndInsert(db *sql.DB, record *NewFailure, table string, period, limit int) {
+// RekeyEvent moves the record's username and pwhash stored under old pepper keys onto the
+// active key. Without a rotation there's nothing stale and no query is run.
+func RekeyEvent(db *sql.DB, record *NewFailure) error {
+	if stale := staleValues(record.UsernameMatches(), record.Username); len(stale) > 0 {
+		if _, err := db.Exec(rekeyUsernames, record.Username, pq.Array(stale)); err != nil {
+			return err
+		}
+	}
+	if stale := staleValues(record.PwhashMatches(), record.Pwhash); len(stale) > 0 {
+		if _, err := db.Exec(rekeyPwhashes, record.Pwhash, pq.Array(stale)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckAndInsert checks to see if an IP should be added to the policy's ban table
+func CheckAndInsert(db *sql.DB, record *NewFailure, policy *BanPolicy) {
 	// get the count from the DB
-	log.Debug().Msg("Running CheckAndInsert")
-	checksql := `SELECT count(*)
-		FROM logon_audit
-		WHERE ip = $1
-		AND ignore = FALSE
-		AND ts > now() - ($2 || ' HOURS')::INTERVAL;
-		`
+	log.Debug().Str("Policy", policy.Name).Msg("Running CheckAndInsert")
+	// a scoped policy only looks at failures from its own login surface
+	if !policy.Matches(record) {
+		return
+	}
+	discount := policy.OnSuccess == SuccessDiscount
+	scope := policy.scope()
+	var checksql string
+	var args []interface{}
+	switch policy.Kind {
+	case KindUsernamesPerIP:
+		checksql = usernamesPerIPCount
+		args = []interface{}{record.IP, policy.Period, discount, scope}
+	case KindIPsPerUsername:
+		if record.Username == "" {
+			return
+		}
+		checksql = ipsPerUsernameCount
+		args = []interface{}{pq.Array(record.UsernameMatches()), policy.Period, discount, scope}
+	case KindPasswordSpray:
+		// the hash is only ever compared in the DB, it's never logged or sent on
+		if record.Pwhash == "" {
+			return
+		}
+		checksql = usernamesPerPwhashCount
+		args = []interface{}{pq.Array(record.PwhashMatches()), policy.Period, discount, scope}
+	case KindUnknownUser:
+		checksql = unknownUserCount
+		args = []interface{}{record.IP, policy.Period, discount, scope, pq.Array(policy.Reasons)}
+	case KindHostingASN:
+		// only IPs in the listed networks are counted
+		if !policy.HasASN(record.ASN) {
+			return
+		}
+		checksql = failureScore
+		args = []interface{}{record.IP, policy.Period, discount, scope}
+	case KindFailuresPerASN:
+		if record.ASN == 0 {
+			return
+		}
+		checksql = asnFailureScore
+		args = []interface{}{int64(record.ASN), policy.Period, discount, scope}
+	default:
+		// failures count by the weight of their reason
+		checksql = failureScore
+		args = []interface{}{record.IP, policy.Period, discount, scope}
+	}
 
-	var ipcount int
-	row := db.QueryRow(checksql, record.IP, period)
-	err := row.Scan(&ipcount)
+	var score float64
+	row := db.QueryRow(checksql, args...)
+	err := row.Scan(&score)
 	if err != nil {
 		log.Error().Str("Error", err.Error()).Msg("Error getting count from logon audit")
 		return
 	}
-	if ipcount >= limit {
+	if score < float64(policy.LimitFor(record)) {
+		return
+	}
+	// spraying a username or a password, or failing from one network, bans every IP that's been doing it
+	ips := []string{record.IP}
+	if policy.Kind == KindIPsPerUsername {
+		ips, err = getIPs(db, usernameIPs, record.UsernameMatches(), policy.Period, discount, scope)
+		if err != nil {
+			log.Error().Str("Error", err.Error()).Msg("Error getting IPs for username from logon audit")
+			return
+		}
+	} else if policy.Kind == KindPasswordSpray {
+		ips, err = getIPs(db, pwhashIPs, record.PwhashMatches(), policy.Period, discount, scope)
+		if err != nil {
+			log.Error().Str("Error", err.Error()).Msg("Error getting IPs for password hash from logon audit")
+			return
+		}
+	} else if policy.Kind == KindFailuresPerASN {
+		ips, err = getIPs(db, asnIPs, []string{strconv.FormatUint(uint64(record.ASN), 10)}, policy.Period, discount, scope)
+		if err != nil {
+			log.Error().Str("Error", err.Error()).Msg("Error getting IPs for ASN from logon audit")
+			return
+		}
+	}
+	for _, ip := range ips {
+		if IsExempt(db, ip) {
+			log.Debug().Str("Policy", policy.Name).Str("IP", ip).Msg("IP over limit but exempt - not banning")
+			continue
+		}
+		if policy.OnSuccess == SuccessTrust && IsTrusted(db, ip) {
+			log.Debug().Str("Policy", policy.Name).Str("IP", ip).Msg("IP over limit but trusted - not banning")
+			continue
+		}
+		if policy.Shadow {
+			RecordShadowBan(db, policy, ip, score)
+			continue
+		}
 		log.Debug().
-			Str("Table", table).
-			Str("IP", record.IP).
+			Str("Policy", policy.Name).
+			Str("Table", policy.Table).
+			Str("IP", ip).
 			Str("Time", time.Now().Format(time.RFC3339)).
 			Msg("IP over limit - banning")
-		var insertStmt string
-		if table == "short_ban" {
-			insertStmt = shortBanUpsert
-		} else if table == "long_ban" {
-			insertStmt = longBanUpsert
-		} else {
-			log.Error().
-				Str("Table", table).
-				Str("IP", record.IP).
-				Msg("Check/insert: Invalid table name")
-			return
+		InsertBan(db, ip, policy.Table)
+	}
+}
+
+// InsertBan adds ip to table, or restarts its ban if it's already there
+func InsertBan(db *sql.DB, ip string, table string) error {
+	var insertStmt string
+	if table == "short_ban" {
+		insertStmt = shortBanUpsert
+	} else if table == "long_ban" {
+		insertStmt = longBanUpsert
+	} else {
+		log.Error().
+			Str("Table", table).
+			Str("IP", ip).
+			Msg("Check/insert: Invalid table name")
+		return fmt.Errorf("%s is not short_ban or long_ban", table)
+	}
+	// "INSERT INTO  short_ban(ip, ts_added) VALUES ($1, $2) ON CONFLICT(ip) DO UPDATE SET ts_added = $2;"
+	var inserted bool
+	now := time.Now().Format(time.RFC3339)
+	err := db.QueryRow(insertStmt, ip, now).Scan(&inserted)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error inserting record into ban table")
+		return err
+	}
+	log.Info().Str("IP", ip).Str("Added Time", now).Msg("Inserting into ban table")
+	if inserted {
+		if _, err := db.Exec(banHistoryInsert, ip, table, now); err != nil {
+			log.Error().Str("Error", err.Error()).Str("IP", ip).Msg("Error inserting record into ban history")
+		}
+		eventType := EventBanCreated
+		if table == "long_ban" {
+			eventType = EventBanEscalated
+		}
+		emitBanEvent(BanEvent{Type: eventType, IP: ip, Table: table, Ts: time.Now().UTC()})
+	}
+	return nil
+}
+
+// InsertFederatedBan adds a ban a federation peer reported, emitting its event with the peer as
+// the origin so that it isn't passed on again
+func InsertFederatedBan(db *sql.DB, ip string, table string, origin string, ts time.Time) error {
+	var insertStmt string
+	if table == "short_ban" {
+		insertStmt = shortBanFederatedUpsert
+	} else if table == "long_ban" {
+		insertStmt = longBanFederatedUpsert
+	} else {
+		return fmt.Errorf("invalid table name %s", table)
+	}
+	var inserted bool
+	if err := db.QueryRow(insertStmt, ip, ts.Format(time.RFC3339), origin).Scan(&inserted); err != nil {
+		return err
+	}
+	log.Info().Str("IP", ip).Str("Table", table).Str("Origin", origin).Msg("Inserting federated ban")
+	if inserted {
+		eventType := EventBanCreated
+		if table == "long_ban" {
+			eventType = EventBanEscalated
+		}
+		emitBanEvent(BanEvent{Type: eventType, IP: ip, Table: table, Ts: time.Now().UTC(), Origin: origin})
+	}
+	return nil
+}
+
+// RecordFederationReport records that peer reported a ban of ip, and returns how many peers
+// reported it in the last window hours, and how many of those reported a long term ban
+func RecordFederationReport(db *sql.DB, ip string, peer string, table string, ts time.Time, window int) (int, int, error) {
+	if _, err := db.Exec(federationReportUpsert, ip, peer, table, ts.Format(time.RFC3339)); err != nil {
+		return 0, 0, err
+	}
+	var reports, longReports int
+	err := db.QueryRow(federationReportCount, ip, window).Scan(&reports, &longReports)
+	return reports, longReports, err
+}
+
+// CleanFederationReports removes reports older than the quorum window, and the ids of events
+// that are too old to be accepted again
+func CleanFederationReports(db *sql.DB, window int) {
+	if _, err := db.Exec(federationReportCleanup, window); err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error deleting old federation reports")
+	}
+	if _, err := db.Exec(federationSeenCleanup); err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error deleting old federation event ids")
+	}
+}
+
+// RecordFederationEventID claims the id of an event from origin until expires. It returns false
+// when the id was already claimed, i.e. the event is a replay.
+func RecordFederationEventID(db *sql.DB, origin string, id string, expires time.Time) (bool, error) {
+	var claimed bool
+	err := db.QueryRow(federationSeenInsert, origin, id, expires.UTC().Format(time.RFC3339)).Scan(&claimed)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return claimed, err
+}
+
+// ForgetFederationEventID releases the id of an event that couldn't be applied, so the peer's
+// retry isn't taken for a replay
+func ForgetFederationEventID(db *sql.DB, origin string, id string) {
+	if _, err := db.Exec(federationSeenDelete, origin, id); err != nil {
+		log.Error().Str("Error", err.Error()).Str("Peer", origin).Msg("Error forgetting federation event id")
+	}
+}
+
+// getIPs runs one of the IP queries, returning the IPs with failures for any of the
+// stored values in the last period hours, in scope when it isn't nil
+func getIPs(db *sql.DB, query string, values []string, period int, discount bool, scope interface{}) ([]string, error) {
+	rows, err := db.Query(query, pq.Array(values), period, discount, scope)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ips := []string{}
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+	return ips, rows.Err()
+}
+
+// RecordShadowBan records that a shadow policy would have banned ip. Shadow bans
+// never reach the ban tables, so they never reach the WAF.
+func RecordShadowBan(db *sql.DB, policy *BanPolicy, ip string, score float64) {
+	var inserted bool
+	err := db.QueryRow(shadowBanUpsert, policy.Name, ip, time.Now().Format(time.RFC3339), score).Scan(&inserted)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Str("Policy", policy.Name).Msg("Error inserting record into shadow ban table")
+		return
+	}
+	if inserted {
+		RegisterCounter("autowaf_shadow_would_ban_total", "IPs a shadow policy would have banned",
+			"policy", policy.Name).Inc()
+		log.Info().Str("Policy", policy.Name).Str("Table", policy.Table).Str("IP", ip).Float64("Score", score).
+			Msg("Shadow policy would ban IP")
+	}
+}
+
+// CleanShadowBans removes shadow bans that have outlived their policy's period
+func CleanShadowBans(db *sql.DB, policies []BanPolicy) {
+	for _, policy := range policies {
+		if !policy.Shadow {
+			continue
+		}
+		_, err := db.Exec(shadowBanCleanup, policy.Name, policy.Period)
+		if err != nil {
+			log.Error().Str("Policy", policy.Name).Str("Error", err.Error()).Msg("Error deleting old shadow bans")
+		}
+	}
+	// policies that have since been removed from the config
+	names := []string{}
+	for _, policy := range policies {
+		if policy.Shadow {
+			names = append(names, policy.Name)
 		}
-		// "INSERT INTO  short_ban(ip, ts_added) VALUES ($1, $2) ON CONFLICT(ip) DO UPDATE SET ts_added = $2;"
-		_, err := db.Exec(insertStmt, record.IP, time.Now().Format(time.RFC3339))
+	}
+	_, err := db.Exec(shadowBanOrphanCleanup, pq.Array(names))
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error deleting shadow bans of removed policies")
+	}
+}
+
+// RecordSuccess handles a successful logon: failures before it from the same IP and username
+// are discounted, and the IP is trusted for trustHours when trustHours is more than 0.
+// usernames are the values the username can be stored as.
+func RecordSuccess(db *sql.DB, ip string, usernames []string, ts time.Time, trustHours int) error {
+	if net.ParseIP(ip) == nil {
+		return errors.New("Failed to parse IP")
+	}
+	_, err := db.Exec(discountFailures, ip, pq.Array(usernames), ts.Format(time.RFC3339))
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Str("IP", ip).Msg("Error discounting failures")
+		return err
+	}
+	if trustHours > 0 {
+		_, err = db.Exec(trustedIPUpsert, ip, ts.Format(time.RFC3339), trustHours)
 		if err != nil {
-			log.Error().Str("Error", err.Error()).Msg("Error inserting record into ban table")
-		} else {
-			log.Info().Str("IP", record.IP).Str("Added Time", time.Now().Format(time.RFC3339)).Msg("Inserting into ban table")
+			log.Error().Str("Error", err.Error()).Str("IP", ip).Msg("Error trusting IP")
+			return err
+		}
+	}
+	return nil
+}
+
+// IsTrusted is true when a successful logon from ip is still trusting it
+func IsTrusted(db *sql.DB, ip string) bool {
+	var trusted bool
+	if err := db.QueryRow(trustedIPCheck, ip).Scan(&trusted); err != nil {
+		log.Error().Str("Error", err.Error()).Str("IP", ip).Msg("Error checking if IP is trusted")
+		return false
+	}
+	return trusted
+}
+
+// CleanTrustedIPs removes IPs whose trust has run out
+func CleanTrustedIPs(db *sql.DB) {
+	if _, err := db.Exec(trustedIPCleanup); err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error deleting expired trusted IPs")
+	}
+}
+
+// ExemptIP stops ip from being banned for hours, recording who exempted it and why
+func ExemptIP(db *sql.DB, ip string, operator string, reason string, hours int) error {
+	_, err := db.Exec(exemptionUpsert, ip, operator, reason, time.Now().UTC().Format(time.RFC3339), hours)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Str("IP", ip).Msg("Error exempting IP")
+		return err
+	}
+	log.Info().Str("IP", ip).Str("Operator", operator).Str("Reason", reason).Int("Hours", hours).Msg("Exempted IP from bans")
+	return nil
+}
+
+// IsExempt is true when ip has an exemption that hasn't expired
+func IsExempt(db *sql.DB, ip string) bool {
+	var exempt bool
+	if err := db.QueryRow(exemptionCheck, ip).Scan(&exempt); err != nil {
+		log.Error().Str("Error", err.Error()).Str("IP", ip).Msg("Error checking if IP is exempt")
+		return false
+	}
+	return exempt
+}
+
+// CleanExemptions removes exemptions that have expired
+func CleanExemptions(db *sql.DB) {
+	rows, err := db.Query(exemptionCleanup)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error deleting expired exemptions")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err == nil {
+			log.Info().Str("IP", ip).Msg("Exemption expired")
 		}
 	}
 }
@@ -134,24 +717,43 @@ func CleanOldSQL(db *sql.DB, table string, intervalHours int) {
 		cleanSQL = longBanCleanup
 	} else if table == "logon_audit" {
 		cleanSQL = logonAuditCleanup
+	} else if table == "webhook_outbox" {
+		cleanSQL = webhookOutboxCleanup
+	} else if table == "ban_history" {
+		cleanSQL = banHistoryCleanup
 	} else {
 		log.Error().
 			Str("Table", table).
 			Msg("Cleanup: Invalid table name")
 		return
 	}
-	_, err := db.Exec(cleanSQL, intervalHours)
+	// the ban cleanups return the IPs whose ban expired. An IP still in the other ban table is
+	// still blocked, so its expiry is only reported once it leaves that table too.
+	rows, err := db.Query(cleanSQL, intervalHours)
 	if err != nil {
 		log.Error().Str("Table", table).Str("Error", err.Error()).Msg("Error deleting old records from the DB")
-	} else {
-		log.Debug().Str("Table", table).Msg("Cleaned up old/expired bans")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ip string
+		var stillBanned bool
+		if err := rows.Scan(&ip, &stillBanned); err != nil {
+			log.Error().Str("Table", table).Str("Error", err.Error()).Msg("Error reading expired ban")
+			continue
+		}
+		if stillBanned {
+			log.Debug().Str("Table", table).Str("IP", ip).Msg("Ban expired but the IP is still in the other ban table")
+			continue
+		}
+		emitBanEvent(BanEvent{Type: EventBanExpired, IP: ip, Table: table, Ts: time.Now().UTC()})
 	}
+	log.Debug().Str("Table", table).Msg("Cleaned up old/expired bans")
 }
 
-// GetRecords gets IP addresses from the table name provided.
-// This function also appends the "/32" to the IP address which is
-// required by AWS WAF to add to the blocklist
-func GetRecords(db *sql.DB, table string, iplist map[string]*string) {
+// GetBanEntries adds the IP addresses in the table name provided to entries, keyed by CIDR.
+// A ban expires period hours after it was added; an IP in both tables keeps the later expiry.
+func GetBanEntries(db *sql.DB, table string, period int, entries map[string]BanEntry) {
 	var query string
 	if table == "short_ban" {
 		query = shortBanIPs
@@ -160,7 +762,7 @@ func GetRecords(db *sql.DB, table string, iplist map[string]*string) {
 	} else {
 		log.Error().
 			Str("Table", table).
-			Msg("GetRecords: Invalid table name")
+			Msg("GetBanEntries: Invalid table name")
 		return
 	}
 	rows, err := db.Query(query)
@@ -171,16 +773,79 @@ func GetRecords(db *sql.DB, table string, iplist map[string]*string) {
 	defer rows.Close()
 	for rows.Next() {
 		var ip string
-		err = rows.Scan(&ip)
+		var added time.Time
+		err = rows.Scan(&ip, &added)
 		if err != nil {
 			log.Printf("Error getting IP from row in table %s: %s", table, err)
 			continue
 		}
-		// modify the IP to have a CIDR value
-		// TODO: handle this more gracefully in the future
-		ip = ip + "/32"
-		iplist[ip] = &ip
-		//*iplist = append(*iplist, &ip)
+		entry := NewBanEntry(ip, added.Add(time.Duration(period)*time.Hour))
+		entry.Added = added
+		if current, ok := entries[entry.CIDR]; !ok || entry.Expires.After(current.Expires) {
+			entries[entry.CIDR] = entry
+		}
+	}
+}
+
+// GetIntelEntries adds the threat intel entries to entries. An entry lasts maxAge hours after
+// its feed last listed it, so a feed that can't be fetched eventually stops banning.
+func GetIntelEntries(db *sql.DB, maxAge int, entries map[string]BanEntry) {
+	rows, err := db.Query(intelBanCIDRs)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error getting threat intel entries")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cidr, source string
+		var added, lastSeen time.Time
+		if err := rows.Scan(&cidr, &source, &added, &lastSeen); err != nil {
+			log.Error().Str("Error", err.Error()).Msg("Error getting threat intel entry from row")
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		entry := NewNetworkBanEntry(network, lastSeen.Add(time.Duration(maxAge)*time.Hour))
+		entry.Added = added
+		entry.Source = source
+		// autowaf's own bans win over the feeds'
+		if _, ok := entries[entry.CIDR]; !ok {
+			entries[entry.CIDR] = entry
+		}
+	}
+}
+
+// StoreIntelEntries replaces what source lists with networks
+func StoreIntelEntries(db *sql.DB, source string, networks []*net.IPNet, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(intelUpsert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, network := range networks {
+		if _, err := stmt.Exec(network.String(), source, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(intelExpireSource, source, now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// CleanIntel removes threat intel entries that haven't been seen for maxAge hours
+func CleanIntel(db *sql.DB, maxAge int) {
+	if _, err := db.Exec(intelCleanup, maxAge); err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error deleting stale threat intel entries")
 	}
 }
 
@@ -206,3 +871,136 @@ func IgnoreIPRecords(db *sql.DB, ip string, c chan error) {
 	}
 	c <- nil
 }
+
+// GetAuditEvents returns the failures in logon_audit between from and to (zero
+// times are open ended), oldest first, with the weight, country, ASN and request metadata
+// they were stored with. Records that were ignored when an admin unblocked their IP are flagged as Unblocked.
+func GetAuditEvents(db *sql.DB, from, to time.Time) ([]NewFailure, error) {
+	query := `SELECT ts, ip, username, reason, COALESCE(weight, 1), COALESCE(reason_ignored, FALSE),
+		COALESCE(ignore, FALSE), COALESCE(country, ''), COALESCE(asn, 0), metadata::TEXT
+		FROM logon_audit
+		WHERE ($1::TIMESTAMP IS NULL OR ts >= $1)
+		AND ($2::TIMESTAMP IS NULL OR ts < $2)
+		ORDER BY ts;`
+	var fromArg, toArg interface{}
+	if !from.IsZero() {
+		fromArg = from.Format(time.RFC3339)
+	}
+	if !to.IsZero() {
+		toArg = to.Format(time.RFC3339)
+	}
+	rows, err := db.Query(query, fromArg, toArg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []NewFailure{}
+	for rows.Next() {
+		var record NewFailure
+		var username, reason, metadata sql.NullString
+		var asn int64
+		if err := rows.Scan(&record.Ts, &record.IP, &username, &reason, &record.Weight, &record.ReasonIgnored,
+			&record.Unblocked, &record.Country, &asn, &metadata); err != nil {
+			return nil, err
+		}
+		record.ASN = uint(asn)
+		record.Username = username.String
+		record.Reason = reason.String
+		if metadata.Valid {
+			if err := record.SetMetadata([]byte(metadata.String)); err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, record)
+	}
+	return events, rows.Err()
+}
+
+// FeedChanged records hash as the blocklist feed's content and returns when the content last
+// changed, which is now unless the hash is the one already stored
+func FeedChanged(db *sql.DB, hash string, now time.Time) (time.Time, error) {
+	_, err := db.Exec(`INSERT INTO feed_version(id, hash, modified) VALUES (1, $1, $2)
+		ON CONFLICT (id) DO UPDATE SET hash = EXCLUDED.hash, modified = EXCLUDED.modified
+		WHERE feed_version.hash <> EXCLUDED.hash;`, hash, now.UTC().Format(time.RFC3339))
+	if err != nil {
+		return time.Time{}, err
+	}
+	var modified time.Time
+	err = db.QueryRow("SELECT modified FROM feed_version WHERE id = 1;").Scan(&modified)
+	return modified, err
+}
+
+// GetBanHistory returns the bans autowaf made between from and to (zero times are open
+// ended), oldest first
+func GetBanHistory(db *sql.DB, from, to time.Time) ([]BanRecord, error) {
+	query := `SELECT ip, ban_table, ts_added
+		FROM ban_history
+		WHERE ($1::TIMESTAMP IS NULL OR ts_added >= $1)
+		AND ($2::TIMESTAMP IS NULL OR ts_added < $2)
+		ORDER BY ts_added;`
+	var fromArg, toArg interface{}
+	if !from.IsZero() {
+		fromArg = from.Format(time.RFC3339)
+	}
+	if !to.IsZero() {
+		toArg = to.Format(time.RFC3339)
+	}
+	rows, err := db.Query(query, fromArg, toArg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bans := []BanRecord{}
+	for rows.Next() {
+		var ban BanRecord
+		if err := rows.Scan(&ban.IP, &ban.Table, &ban.Ts); err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+// InsertAdminAudit appends an administrative action to admin_audit
+func InsertAdminAudit(db *sql.DB, entry *AdminAuditEntry) error {
+	insertSQL := `INSERT INTO admin_audit
+	(ts,action,actor,source_ip,payload,outcome) VALUES ($1, $2, $3, $4, $5, $6);`
+	_, err := db.Exec(insertSQL, entry.Ts.Format(time.RFC3339), entry.Action, entry.Actor, entry.SourceIP, entry.Payload, entry.Outcome)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Str("Action", entry.Action).Msg("Error inserting record into admin audit")
+	}
+	return err
+}
+
+// GetAdminAudit returns the admin_audit entries between from and to (zero times are open ended),
+// newest first. A blank action returns every action.
+func GetAdminAudit(db *sql.DB, from, to time.Time, action string, limit int) ([]AdminAuditEntry, error) {
+	query := `SELECT id, ts, action, actor, source_ip, payload, outcome
+		FROM admin_audit
+		WHERE ($1::TIMESTAMP IS NULL OR ts >= $1)
+		AND ($2::TIMESTAMP IS NULL OR ts < $2)
+		AND ($3 = '' OR action = $3)
+		ORDER BY ts DESC, id DESC
+		LIMIT $4;`
+	var fromArg, toArg interface{}
+	if !from.IsZero() {
+		fromArg = from.Format(time.RFC3339)
+	}
+	if !to.IsZero() {
+		toArg = to.Format(time.RFC3339)
+	}
+	rows, err := db.Query(query, fromArg, toArg, action, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []AdminAuditEntry{}
+	for rows.Next() {
+		var entry AdminAuditEntry
+		if err := rows.Scan(&entry.ID, &entry.Ts, &entry.Action, &entry.Actor, &entry.SourceIP, &entry.Payload, &entry.Outcome); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
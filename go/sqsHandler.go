@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/rs/zerolog/log"
+)
+
+// SQSReceiver is a function pointer to sqs.ReceiveMessage or a mock of it
+type SQSReceiver func(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error)
+
+// SQSDeleter is a function pointer to sqs.DeleteMessage or a mock of it
+type SQSDeleter func(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error)
+
+// FailureIngester stores a failure and queues it for ban evaluation (see ingestFailure)
+type FailureIngester func(record *NewFailure) error
+
+// PollSQS long-polls the configured queue once and ingests every message it gets back.
+// Messages are only deleted once they were ingested. Anything that can't be decoded or
+// stored is left on the queue so that the redrive policy moves it to a dead letter queue.
+// The number of messages ingested is returned along with whether the ban queue was full.
+func PollSQS(receiver SQSReceiver, deleter SQSDeleter, ingest FailureIngester, envconf *EnvConfig) (int, bool, error) {
+	input := sqs.ReceiveMessageInput{
+		QueueUrl:            &envconf.SQSQueueURL,
+		MaxNumberOfMessages: aws.Int64(int64(envconf.SQSMaxMessages)),
+		WaitTimeSeconds:     aws.Int64(int64(envconf.SQSWaitTime)),
+	}
+	output, err := receiver(&input)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Str("Queue", envconf.SQSQueueURL).Msg("Error receiving messages from SQS")
+		return 0, false, err
+	}
+	ingested := 0
+	saturated := false
+	for _, message := range output.Messages {
+		if message.Body == nil || message.ReceiptHandle == nil {
+			continue
+		}
+		var record NewFailure
+		if err := json.Unmarshal([]byte(*message.Body), &record); err != nil {
+			log.Warn().Str("Error", err.Error()).Str("MessageId", aws.StringValue(message.MessageId)).
+				Msg("Couldn't decode SQS message, leaving it for the dead letter queue")
+			continue
+		}
+		err := ingest(&record)
+		if err == ErrQueueFull {
+			// leave it on the queue, it'll be visible again after the visibility timeout
+			saturated = true
+			continue
+		}
+		if err != nil {
+			log.Warn().Str("Error", err.Error()).Str("MessageId", aws.StringValue(message.MessageId)).
+				Msg("Couldn't ingest SQS message, leaving it for the dead letter queue")
+			continue
+		}
+		ingested++
+		_, err = deleter(&sqs.DeleteMessageInput{
+			QueueUrl:      &envconf.SQSQueueURL,
+			ReceiptHandle: message.ReceiptHandle,
+		})
+		if err != nil {
+			log.Error().Str("Error", err.Error()).Str("MessageId", aws.StringValue(message.MessageId)).
+				Msg("Error deleting message from SQS")
+		}
+	}
+	return ingested, saturated, nil
+}
+
+// consumeSQS is the background task that feeds the SQS queue into ingestFailure
+func consumeSQS(client *sqs.SQS, quit *chan string) {
+	log.Debug().Str("Queue", envConfig.SQSQueueURL).Msg("Starting SQS consumer")
+	for {
+		select {
+		case <-*quit:
+			log.Debug().Msg("Exiting SQS consumer")
+			return
+		default:
+		}
+		_, saturated, err := PollSQS(client.ReceiveMessage, client.DeleteMessage, ingestFailure, &envConfig)
+		if err != nil {
+			// don't hammer SQS while it's failing
+			time.Sleep(5 * time.Second)
+		} else if saturated {
+			time.Sleep(time.Duration(envConfig.QueueRetryAfter) * time.Second)
+		}
+	}
+}
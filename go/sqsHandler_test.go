@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// FakeSQS is an in-process stand in for an SQS queue
+type FakeSQS struct {
+	messages []*sqs.Message
+	deleted  []string
+}
+
+func (f *FakeSQS) Add(id, body string) {
+	f.messages = append(f.messages, &sqs.Message{
+		MessageId:     aws.String(id),
+		ReceiptHandle: aws.String("receipt-" + id),
+		Body:          aws.String(body),
+	})
+}
+
+func (f *FakeSQS) ReceiveMessage(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	n := int(*input.MaxNumberOfMessages)
+	if n > len(f.messages) {
+		n = len(f.messages)
+	}
+	return &sqs.ReceiveMessageOutput{Messages: f.messages[:n]}, nil
+}
+
+func (f *FakeSQS) DeleteMessage(input *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	f.deleted = append(f.deleted, *input.ReceiptHandle)
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func MockSQSReceiverFail(input *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	return nil, errors.New(MockGetError)
+}
+
+func sqsTestEnv() EnvConfig {
+	return EnvConfig{
+		SQSQueueURL:    "http://localhost/queue/test",
+		SQSWaitTime:    0,
+		SQSMaxMessages: 10,
+	}
+}
+
+func TestPollSQS(t *testing.T) {
+	env := sqsTestEnv()
+	fake := FakeSQS{}
+	fake.Add("1", `{"ts": "2021-11-01T10:00:00Z", "ip": "192.168.1.1", "username": "bob", "reason": "PASSWORD_FAILURE"}`)
+	fake.Add("2", `{"ts": "2021-11-01T10:00:01Z", "ip": "192.168.1.2", "username": "alice", "reason": "PASSWORD_FAILURE"}`)
+	ingested := []string{}
+	ingest := func(record *NewFailure) error {
+		ingested = append(ingested, record.IP)
+		return nil
+	}
+	n, saturated, err := PollSQS(fake.ReceiveMessage, fake.DeleteMessage, ingest, &env)
+	if err != nil || saturated || n != 2 {
+		t.Logf("Expected 2 ingested messages, got %d (saturated: %t, err: %v)", n, saturated, err)
+		t.Fail()
+	}
+	if len(ingested) != 2 || ingested[0] != "192.168.1.1" || ingested[1] != "192.168.1.2" {
+		t.Logf("Unexpected ingested IPs: %v", ingested)
+		t.Fail()
+	}
+	if len(fake.deleted) != 2 {
+		t.Logf("Expected 2 deleted messages, got %d", len(fake.deleted))
+		t.Fail()
+	}
+}
+
+func TestPollSQSLeavesPoisonMessages(t *testing.T) {
+	env := sqsTestEnv()
+	fake := FakeSQS{}
+	fake.Add("bad-json", `{"ts": "2021-11-01T10:00:00Z", "ip": `)
+	fake.Add("bad-ip", `{"ts": "2021-11-01T10:00:00Z", "ip": "8.8.8"}`)
+	fake.Add("good", `{"ts": "2021-11-01T10:00:00Z", "ip": "192.168.1.1"}`)
+	ingest := func(record *NewFailure) error {
+		if record.IP == "8.8.8" {
+			return errors.New("Failed to parse IP")
+		}
+		return nil
+	}
+	n, _, err := PollSQS(fake.ReceiveMessage, fake.DeleteMessage, ingest, &env)
+	if err != nil || n != 1 {
+		t.Logf("Expected 1 ingested message, got %d (err: %v)", n, err)
+		t.Fail()
+	}
+	if len(fake.deleted) != 1 || fake.deleted[0] != "receipt-good" {
+		t.Logf("Only the good message should have been deleted, got %v", fake.deleted)
+		t.Fail()
+	}
+}
+
+func TestPollSQSQueueFull(t *testing.T) {
+	env := sqsTestEnv()
+	fake := FakeSQS{}
+	fake.Add("1", `{"ts": "2021-11-01T10:00:00Z", "ip": "192.168.1.1"}`)
+	ingest := func(record *NewFailure) error {
+		return ErrQueueFull
+	}
+	n, saturated, _ := PollSQS(fake.ReceiveMessage, fake.DeleteMessage, ingest, &env)
+	if n != 0 || !saturated {
+		t.Log("Expected the poll to report a saturated queue")
+		t.Fail()
+	}
+	if len(fake.deleted) != 0 {
+		t.Log("Messages shouldn't be deleted while the queue is saturated")
+		t.Fail()
+	}
+}
+
+func TestPollSQSReceiveError(t *testing.T) {
+	env := sqsTestEnv()
+	fake := FakeSQS{}
+	_, _, err := PollSQS(MockSQSReceiverFail, fake.DeleteMessage, func(record *NewFailure) error { return nil }, &env)
+	if err == nil {
+		t.Log("Nil error (shouldn't be)")
+		t.Fail()
+	}
+}
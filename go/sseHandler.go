@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// how often a comment is sent on an idle stream to keep proxies from closing it
+var sseKeepAlive = 15 * time.Second
+
+// eventStreamWriter streams events from the event bus as Server-Sent Events.
+// The optional types query parameter is a comma separated list of event types to send.
+func eventStreamWriter(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	types := map[string]bool{}
+	for _, eventType := range strings.Split(r.URL.Query().Get("types"), ",") {
+		if eventType != "" {
+			types[eventType] = true
+		}
+	}
+
+	events := eventBus.Subscribe(100)
+	defer eventBus.Unsubscribe(events)
+	log.Debug().Str("Remote", r.RemoteAddr).Msg("Event stream opened")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Debug().Str("Remote", r.RemoteAddr).Msg("Event stream closed")
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event := <-events:
+			if len(types) > 0 && !types[event.Type] {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Error().Str("Error", err.Error()).Msg("Error encoding event for the event stream")
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// NewSuccess is the event coming in for successful logons
+type NewSuccess struct {
+	Ts       time.Time `json:"ts"`
+	IP       string    `json:"ip"`
+	Username string    `json:"username"`
+}
+
+// trustsSuccesses is true when any policy trusts IPs after a successful logon
+func (envconf *EnvConfig) trustsSuccesses() bool {
+	for _, policy := range envconf.BanPolicies() {
+		if policy.OnSuccess == SuccessTrust {
+			return true
+		}
+	}
+	return false
+}
+
+// ingestSuccess discounts the failures before a successful logon and trusts its IP,
+// depending on what the policies do with successful logons
+func ingestSuccess(success *NewSuccess) error {
+	if success.Ts.IsZero() {
+		success.Ts = time.Now().UTC()
+	}
+	// the username is looked up the same way it was stored
+	record := NewFailure{IP: success.IP, Username: success.Username}
+	envConfig.Pepper.Apply(&record)
+	trustHours := 0
+	if envConfig.trustsSuccesses() {
+		trustHours = envConfig.TrustPeriod
+	}
+	return RecordSuccess(db, success.IP, record.UsernameMatches(), success.Ts, trustHours)
+}
+
+// logonSuccessWriter is the handler for successful logons
+func logonSuccessWriter(w http.ResponseWriter, r *http.Request) {
+	log.Debug().Msg("Logon Success Writer Starting")
+	var newSuccess NewSuccess
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		log.Warn().Str("Error", err.Error()).Msg("Error reading http request body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := r.Body.Close(); err != nil {
+		log.Warn().Str("Error", err.Error()).Msg("Error closing request body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := json.Unmarshal(body, &newSuccess); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		if err := json.NewEncoder(w).Encode(err); err != nil {
+			panic(err)
+		}
+		return
+	}
+	if err := ingestSuccess(&newSuccess); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maximum size of a single syslog message we're willing to read
+const maxSyslogMessage = 64 * 1024
+
+// how long a TCP connection can take to send the next message before it's closed
+const syslogReadTimeout = 5 * time.Minute
+
+// errInvalidFrame is returned for an octet counted message with a bad length
+var errInvalidFrame = errors.New("Invalid syslog frame length")
+
+// errFrameTooLong is returned for a message that's longer than maxSyslogMessage
+var errFrameTooLong = errors.New("Syslog message is longer than the maximum")
+
+// DefaultSyslogPatterns are used when SYSLOG_PATTERN_FILE isn't set
+var DefaultSyslogPatterns = []string{
+	`Failed (?:password|publickey) for (?:invalid user )?%{USERNAME:username} from %{IP:ip}`,
+	`Invalid user %{USERNAME:username} from %{IP:ip}`,
+	`authentication failure;.* rhost=%{IP:ip}(?:\s+user=%{USERNAME:username})?`,
+}
+
+// SyslogMessage is the part of a syslog message we care about
+type SyslogMessage struct {
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	Message   string
+}
+
+// ParseSyslog parses an RFC5424 or RFC3164 syslog message. Anything that doesn't look like
+// either is treated as a bare message received at now.
+func ParseSyslog(raw string, now time.Time) SyslogMessage {
+	msg := SyslogMessage{Timestamp: now, Message: strings.TrimRight(raw, "\r\n\x00")}
+	rest := msg.Message
+	// <PRI>
+	if !strings.HasPrefix(rest, "<") {
+		return msg
+	}
+	end := strings.IndexByte(rest, '>')
+	if end < 2 || end > 4 {
+		return msg
+	}
+	if _, err := strconv.Atoi(rest[1:end]); err != nil {
+		return msg
+	}
+	rest = rest[end+1:]
+	// RFC5424 has a version number straight after the PRI
+	if len(rest) > 1 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		return parseRFC5424(rest[2:], msg)
+	}
+	return parseRFC3164(rest, msg)
+}
+
+// parseRFC5424 parses TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parseRFC5424(rest string, msg SyslogMessage) SyslogMessage {
+	fields := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		space := strings.IndexByte(rest, ' ')
+		if space == -1 {
+			msg.Message = ""
+			return msg
+		}
+		fields = append(fields, rest[:space])
+		rest = rest[space+1:]
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+		msg.Timestamp = ts
+	}
+	if fields[1] != "-" {
+		msg.Hostname = fields[1]
+	}
+	if fields[2] != "-" {
+		msg.AppName = fields[2]
+	}
+	msg.Message = strings.TrimPrefix(skipStructuredData(rest), "\ufeff")
+	return msg
+}
+
+// skipStructuredData returns what's left of rest after the STRUCTURED-DATA field
+func skipStructuredData(rest string) string {
+	if strings.HasPrefix(rest, "-") {
+		return strings.TrimPrefix(rest[1:], " ")
+	}
+	inElement := false
+	escaped := false
+	for i := 0; i < len(rest); i++ {
+		c := rest[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '[':
+			inElement = true
+		case c == ']':
+			inElement = false
+		case !inElement:
+			return strings.TrimPrefix(rest[i:], " ")
+		}
+	}
+	return ""
+}
+
+// parseRFC3164 parses "Mmm dd hh:mm:ss HOSTNAME TAG: MSG"
+func parseRFC3164(rest string, msg SyslogMessage) SyslogMessage {
+	msg.Message = rest
+	if len(rest) < len(time.Stamp)+1 {
+		return msg
+	}
+	ts, ok := parseLogTimestamp(rest[:len(time.Stamp)], msg.Timestamp)
+	if !ok {
+		return msg
+	}
+	msg.Timestamp = ts
+	rest = strings.TrimPrefix(rest[len(time.Stamp):], " ")
+	if space := strings.IndexByte(rest, ' '); space != -1 {
+		msg.Hostname = rest[:space]
+		rest = rest[space+1:]
+	}
+	// the TAG is optional, it's a single token ending in ": " or "[pid]: "
+	if tagEnd := strings.IndexAny(rest, "[: "); tagEnd > 0 && tagEnd <= 32 && rest[tagEnd] != ' ' {
+		if colon := strings.Index(rest, ": "); colon != -1 && !strings.Contains(rest[:colon], " ") {
+			msg.AppName = rest[:tagEnd]
+			rest = rest[colon+2:]
+		}
+	}
+	msg.Message = rest
+	return msg
+}
+
+// SyslogReceiver turns syslog messages into failure events
+type SyslogReceiver struct {
+	patterns []*FailurePattern
+	ingest   FailureIngester
+	received *Counter
+	matched  *Counter
+	dropped  *Counter
+	// readTimeout is how long a TCP connection can be idle, syslogReadTimeout unless a test sets it
+	readTimeout time.Duration
+}
+
+// NewSyslogReceiver creates a receiver that matches messages against patterns and passes failures to ingest
+func NewSyslogReceiver(patterns []*FailurePattern, ingest FailureIngester) *SyslogReceiver {
+	return &SyslogReceiver{
+		patterns: patterns,
+		ingest:   ingest,
+		received: RegisterCounter("autowaf_syslog_received_total", "Syslog messages received"),
+		matched:  RegisterCounter("autowaf_syslog_matched_total", "Syslog messages that matched a failure pattern"),
+		dropped:  RegisterCounter("autowaf_syslog_dropped_total", "Matched syslog messages that couldn't be ingested"),
+
+		readTimeout: syslogReadTimeout,
+	}
+}
+
+// Handle processes a single raw syslog message
+func (s *SyslogReceiver) Handle(raw string) {
+	s.received.Inc()
+	msg := ParseSyslog(raw, time.Now().UTC())
+	record, ok := ParseFailureLine(s.patterns, msg.Message, msg.Timestamp)
+	if !ok {
+		return
+	}
+	s.matched.Inc()
+	if err := s.ingest(record); err != nil {
+		s.dropped.Inc()
+		log.Warn().Str("Error", err.Error()).Str("IP", record.IP).Str("Host", msg.Hostname).
+			Msg("Couldn't ingest failure from syslog")
+	}
+}
+
+// ServeUDP reads one syslog message per datagram until conn is closed
+func (s *SyslogReceiver) ServeUDP(conn net.PacketConn) {
+	buf := make([]byte, maxSyslogMessage)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Debug().Str("Error", err.Error()).Msg("Stopping syslog UDP listener")
+			return
+		}
+		s.Handle(string(buf[:n]))
+	}
+}
+
+// ServeTCP accepts syslog connections until listener is closed
+func (s *SyslogReceiver) ServeTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Debug().Str("Error", err.Error()).Msg("Stopping syslog TCP listener")
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn reads messages framed with either octet counting or newlines (RFC6587). A message
+// longer than maxSyslogMessage or a connection that's idle for longer than the read timeout
+// closes the connection, as there's no telling where the next message starts.
+func (s *SyslogReceiver) serveConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, maxSyslogMessage)
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.readTimeout))
+		first, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+		var raw string
+		if first[0] >= '1' && first[0] <= '9' {
+			raw, err = readOctetCounted(reader)
+		} else {
+			raw, err = readLine(reader)
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Warn().Str("Error", err.Error()).Str("Remote", conn.RemoteAddr().String()).
+					Msg("Error reading syslog message")
+			}
+			return
+		}
+		if strings.TrimSpace(raw) != "" {
+			s.Handle(raw)
+		}
+	}
+}
+
+// readLine reads a newline framed message. The reader's buffer is maxSyslogMessage, so
+// ReadSlice never holds more than that.
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errFrameTooLong
+	}
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	return string(line), err
+}
+
+func readOctetCounted(reader *bufio.Reader) (string, error) {
+	length, err := reader.ReadSlice(' ')
+	if err == bufio.ErrBufferFull {
+		return "", errInvalidFrame
+	}
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(length)))
+	if err != nil || n < 1 || n > maxSyslogMessage {
+		return "", errInvalidFrame
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// startSyslogListeners starts the configured syslog listeners in the background
+func startSyslogListeners(envconf *EnvConfig) {
+	patterns, err := LoadFailurePatterns(envconf.SyslogPatternFile, DefaultSyslogPatterns)
+	if err != nil {
+		log.Fatal().Str("Error", err.Error()).Msg("Couldn't load syslog patterns")
+	}
+	receiver := NewSyslogReceiver(patterns, ingestFailure)
+	if envconf.SyslogUDPAddr != "" {
+		conn, err := net.ListenPacket("udp", envconf.SyslogUDPAddr)
+		if err != nil {
+			log.Fatal().Str("Error", err.Error()).Msg("Couldn't start syslog UDP listener")
+		}
+		log.Debug().Str("Address", envconf.SyslogUDPAddr).Msg("Listening for syslog over UDP")
+		go receiver.ServeUDP(conn)
+	}
+	if envconf.SyslogTCPAddr != "" {
+		listener, err := net.Listen("tcp", envconf.SyslogTCPAddr)
+		if err != nil {
+			log.Fatal().Str("Error", err.Error()).Msg("Couldn't start syslog TCP listener")
+		}
+		if envconf.SyslogTLSCert != "" {
+			cert, err := tls.LoadX509KeyPair(envconf.SyslogTLSCert, envconf.SyslogTLSKey)
+			if err != nil {
+				log.Fatal().Str("Error", err.Error()).Msg("Couldn't load syslog TLS certificate")
+			}
+			listener = tls.NewListener(listener, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS12,
+			})
+		}
+		log.Debug().Str("Address", envconf.SyslogTCPAddr).Bool("TLS", envconf.SyslogTLSCert != "").
+			Msg("Listening for syslog over TCP")
+		go receiver.ServeTCP(listener)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSyslogRFC5424(t *testing.T) {
+	raw := `<38>1 2021-11-01T10:00:00Z host1 sshd 123 - [meta key="a\]b"] Failed password for bob from 192.168.1.1 port 22`
+	msg := ParseSyslog(raw, time.Now())
+	if msg.Hostname != "host1" || msg.AppName != "sshd" {
+		t.Logf("Unexpected header: %+v", msg)
+		t.Fail()
+	}
+	if !msg.Timestamp.Equal(time.Date(2021, 11, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Logf("Unexpected timestamp: %s", msg.Timestamp)
+		t.Fail()
+	}
+	if msg.Message != "Failed password for bob from 192.168.1.1 port 22" {
+		t.Logf("Unexpected message: %q", msg.Message)
+		t.Fail()
+	}
+}
+
+func TestParseSyslogRFC3164(t *testing.T) {
+	now := time.Date(2021, 11, 2, 0, 0, 0, 0, time.UTC)
+	msg := ParseSyslog("<38>Nov  1 10:00:00 host1 sshd[123]: Invalid user bob from 192.168.1.1\n", now)
+	if msg.Hostname != "host1" || msg.AppName != "sshd" {
+		t.Logf("Unexpected header: %+v", msg)
+		t.Fail()
+	}
+	if !msg.Timestamp.Equal(time.Date(2021, 11, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Logf("Unexpected timestamp: %s", msg.Timestamp)
+		t.Fail()
+	}
+	if msg.Message != "Invalid user bob from 192.168.1.1" {
+		t.Logf("Unexpected message: %q", msg.Message)
+		t.Fail()
+	}
+}
+
+func TestParseSyslogBare(t *testing.T) {
+	now := time.Now()
+	msg := ParseSyslog("Failed password for bob from 192.168.1.1", now)
+	if msg.Message != "Failed password for bob from 192.168.1.1" || !msg.Timestamp.Equal(now) {
+		t.Logf("Unexpected message: %+v", msg)
+		t.Fail()
+	}
+}
+
+func TestSyslogReceiverTCPFraming(t *testing.T) {
+	patterns, err := LoadFailurePatterns("", DefaultSyslogPatterns)
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(2)
+	ips := []string{}
+	receiver := NewSyslogReceiver(patterns, func(record *NewFailure) error {
+		mu.Lock()
+		ips = append(ips, record.IP)
+		mu.Unlock()
+		wg.Done()
+		return nil
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Can't listen on loopback: %s", err)
+	}
+	defer listener.Close()
+	go receiver.ServeTCP(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.FailNow()
+	}
+	octet := "<38>Nov  1 10:00:00 host1 sshd[1]: Invalid user bob from 192.168.1.1"
+	conn.Write([]byte(strconv.Itoa(len(octet)) + " " + octet))
+	conn.Write([]byte("<38>Nov  1 10:00:00 host1 sshd[1]: Invalid user bob from 192.168.1.2\n"))
+	conn.Close()
+	wg.Wait()
+	if len(ips) != 2 || ips[0] != "192.168.1.1" || ips[1] != "192.168.1.2" {
+		t.Logf("Unexpected IPs: %v", ips)
+		t.Fail()
+	}
+}
+
+func TestSyslogReceiverTCPLimits(t *testing.T) {
+	ingested := 0
+	receiver := NewSyslogReceiver(nil, func(record *NewFailure) error {
+		ingested++
+		return nil
+	})
+	receiver.readTimeout = 50 * time.Millisecond
+	for name, payload := range map[string][]byte{
+		// a client that never sends a newline
+		"too long":        bytes.Repeat([]byte("a"), maxSyslogMessage+1),
+		"too long length": bytes.Repeat([]byte("1"), maxSyslogMessage+1),
+		// a client that stops half way through a message
+		"idle": []byte("<38>Nov  1 10:00:00 host1 sshd[1]: Invalid user bob"),
+	} {
+		server, client := net.Pipe()
+		done := make(chan bool)
+		go func() {
+			receiver.serveConn(server)
+			close(done)
+		}()
+		go client.Write(payload)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Logf("%s: expected the connection to be closed", name)
+			t.Fail()
+		}
+		client.Close()
+	}
+	if ingested != 0 {
+		t.Logf("Expected nothing to be ingested, got %d", ingested)
+		t.Fail()
+	}
+}
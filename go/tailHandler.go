@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultTailPatterns are used when TAIL_PATTERN_FILE isn't set. They cover sshd/PAM
+// auth logs and 401s on login endpoints in nginx's default access log format.
+var DefaultTailPatterns = append([]string{
+	`^%{IP:ip} - (?:-|%{NOTSPACE:username}) \[%{HTTPDATE:ts}\] "POST [^"]*login[^"]*" (?P<reason>401|403) `,
+}, DefaultSyslogPatterns...)
+
+// FileTailer follows a file the way `tail -F` does. It notices when the file
+// is rotated (a new file appears at the path) or truncated and starts over
+// from the beginning of the new content.
+type FileTailer struct {
+	Path    string
+	file    *os.File
+	info    os.FileInfo
+	offset  int64
+	partial string
+	started bool
+}
+
+// NewFileTailer creates a tailer for path. Content already in the file when it's
+// first opened is skipped, only lines written afterwards are returned.
+func NewFileTailer(path string) *FileTailer {
+	return &FileTailer{Path: path}
+}
+
+// Poll returns any complete lines written since the last poll
+func (t *FileTailer) Poll() ([]string, error) {
+	if t.file == nil {
+		if err := t.open(); err != nil {
+			if os.IsNotExist(err) {
+				// the file may not have been created (or rotated in) yet,
+				// when it shows up all of it is new
+				t.started = true
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+	lines, err := t.read()
+	if err != nil {
+		return lines, err
+	}
+	current, err := os.Stat(t.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// rotated away and the new file isn't there yet
+			return lines, nil
+		}
+		return lines, err
+	}
+	if !os.SameFile(current, t.info) {
+		log.Debug().Str("File", t.Path).Msg("File was rotated, reopening")
+		t.Close()
+		if err := t.open(); err != nil {
+			return lines, err
+		}
+		more, err := t.read()
+		return append(lines, more...), err
+	}
+	if current.Size() < t.offset {
+		log.Debug().Str("File", t.Path).Msg("File was truncated, reading from the start")
+		t.offset = 0
+		t.partial = ""
+		more, err := t.read()
+		return append(lines, more...), err
+	}
+	return lines, nil
+}
+
+func (t *FileTailer) open() error {
+	file, err := os.Open(t.Path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	t.file = file
+	t.info = info
+	t.offset = 0
+	t.partial = ""
+	if !t.started {
+		t.offset = info.Size()
+		t.started = true
+	}
+	return nil
+}
+
+// read returns the complete lines between offset and the end of the file
+func (t *FileTailer) read() ([]string, error) {
+	buf := make([]byte, 32*1024)
+	var lines []string
+	for {
+		n, err := t.file.ReadAt(buf, t.offset)
+		if n > 0 {
+			t.offset += int64(n)
+			chunk := t.partial + string(buf[:n])
+			parts := strings.Split(chunk, "\n")
+			t.partial = parts[len(parts)-1]
+			for _, line := range parts[:len(parts)-1] {
+				lines = append(lines, strings.TrimRight(line, "\r"))
+			}
+		}
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+	}
+}
+
+// Close closes the file currently being followed
+func (t *FileTailer) Close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// tailFiles is the background task that follows the configured log files and
+// ingests the failures found in them
+func tailFiles(tailers []*FileTailer, patterns []*FailurePattern, ticker *time.Ticker, quit *chan string) {
+	matched := RegisterCounter("autowaf_tail_matched_total", "Log file lines that matched a failure pattern")
+	dropped := RegisterCounter("autowaf_tail_dropped_total", "Matched log file lines that couldn't be ingested")
+	for {
+		select {
+		case <-ticker.C:
+			for _, tailer := range tailers {
+				lines, err := tailer.Poll()
+				if err != nil {
+					log.Warn().Str("Error", err.Error()).Str("File", tailer.Path).Msg("Error reading log file")
+				}
+				for _, line := range lines {
+					record, ok := ParseFailureLine(patterns, line, time.Now().UTC())
+					if !ok {
+						continue
+					}
+					matched.Inc()
+					if err := ingestFailure(record); err != nil {
+						dropped.Inc()
+						log.Warn().Str("Error", err.Error()).Str("File", tailer.Path).Str("IP", record.IP).
+							Msg("Couldn't ingest failure from log file")
+					}
+				}
+			}
+		case <-*quit:
+			ticker.Stop()
+			for _, tailer := range tailers {
+				tailer.Close()
+			}
+			log.Debug().Msg("Exiting log file tailer")
+			return
+		}
+	}
+}
+
+// startTailing starts following the configured log files in the background
+func startTailing(envconf *EnvConfig, quit *chan string) {
+	patterns, err := LoadFailurePatterns(envconf.TailPatternFile, DefaultTailPatterns)
+	if err != nil {
+		log.Fatal().Str("Error", err.Error()).Msg("Couldn't load log file patterns")
+	}
+	tailers := make([]*FileTailer, 0, len(envconf.TailFiles))
+	for _, path := range envconf.TailFiles {
+		log.Debug().Str("File", path).Msg("Tailing log file")
+		tailer := NewFileTailer(path)
+		// open the files now so that only lines written after startup are read
+		if _, err := tailer.Poll(); err != nil {
+			log.Warn().Str("Error", err.Error()).Str("File", path).Msg("Error opening log file")
+		}
+		tailers = append(tailers, tailer)
+	}
+	ticker := time.NewTicker(time.Duration(envconf.TailPollInterval) * time.Second)
+	go tailFiles(tailers, patterns, ticker, quit)
+}
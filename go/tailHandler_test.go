@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func appendToFile(t *testing.T, path, content string) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Couldn't open %s: %s", path, err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatalf("Couldn't write %s: %s", path, err)
+	}
+}
+
+func expectLines(t *testing.T, tailer *FileTailer, expected ...string) {
+	lines, err := tailer.Poll()
+	if err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.Fail()
+	}
+	if len(lines) != len(expected) {
+		t.Logf("Expected %v, got %v", expected, lines)
+		t.Fail()
+		return
+	}
+	for i := range lines {
+		if lines[i] != expected[i] {
+			t.Logf("Expected %v, got %v", expected, lines)
+			t.Fail()
+			return
+		}
+	}
+}
+
+func TestFileTailerSkipsExistingContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	appendToFile(t, path, "old line\n")
+	tailer := NewFileTailer(path)
+	defer tailer.Close()
+	expectLines(t, tailer)
+	appendToFile(t, path, "new line\npartial")
+	expectLines(t, tailer, "new line")
+	appendToFile(t, path, " line\n")
+	expectLines(t, tailer, "partial line")
+}
+
+func TestFileTailerRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "auth.log")
+	appendToFile(t, path, "")
+	tailer := NewFileTailer(path)
+	defer tailer.Close()
+	expectLines(t, tailer)
+	appendToFile(t, path, "before rotation\n")
+	if err := os.Rename(path, filepath.Join(dir, "auth.log.1")); err != nil {
+		t.Fatalf("Couldn't rotate: %s", err)
+	}
+	// written to the old file after the rename, but before we noticed
+	appendToFile(t, filepath.Join(dir, "auth.log.1"), "late line\n")
+	appendToFile(t, path, "after rotation\n")
+	expectLines(t, tailer, "before rotation", "late line", "after rotation")
+}
+
+func TestFileTailerTruncation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	appendToFile(t, path, "")
+	tailer := NewFileTailer(path)
+	defer tailer.Close()
+	expectLines(t, tailer)
+	appendToFile(t, path, "a fairly long line before truncation\n")
+	expectLines(t, tailer, "a fairly long line before truncation")
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatalf("Couldn't truncate: %s", err)
+	}
+	appendToFile(t, path, "short\n")
+	expectLines(t, tailer, "short")
+}
+
+func TestFileTailerMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	tailer := NewFileTailer(path)
+	defer tailer.Close()
+	expectLines(t, tailer)
+	appendToFile(t, path, "first line\n")
+	expectLines(t, tailer, "first line")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// WebhookPoster sends a webhook request, it's http.Client.Do or a mock of it
+type WebhookPoster func(req *http.Request) (*http.Response, error)
+
+// WebhookDelivery is a row of the webhook outbox
+type WebhookDelivery struct {
+	ID        int
+	URL       string
+	EventType string
+	Payload   string
+	Attempts  int
+}
+
+// retries back off from webhookBaseBackoff, doubling up to webhookMaxBackoff
+const webhookBaseBackoff = 30 * time.Second
+const webhookMaxBackoff = time.Hour
+
+// webhookWantsEvent checks the configured event filter. An empty filter accepts everything.
+func webhookWantsEvent(envconf *EnvConfig, eventType string) bool {
+	if len(envconf.WebhookEvents) == 0 {
+		return true
+	}
+	for _, wanted := range envconf.WebhookEvents {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// QueueWebhookEvent writes event to the outbox once for every configured webhook.
+// The outbox lives in the database so that events survive a restart.
+func QueueWebhookEvent(db *sql.DB, envconf *EnvConfig, event BanEvent) {
+	if !webhookWantsEvent(envconf, event.Type) {
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error encoding webhook event")
+		return
+	}
+	insertSQL := `INSERT INTO webhook_outbox (url, event_type, payload) VALUES ($1, $2, $3);`
+	for _, url := range envconf.WebhookURLs {
+		_, err := db.Exec(insertSQL, url, event.Type, string(payload))
+		if err != nil {
+			log.Error().Str("Error", err.Error()).Str("Event", event.Type).Str("IP", event.IP).
+				Msg("Error adding webhook event to the outbox")
+		}
+	}
+}
+
+// SignWebhook returns the value of the X-Autowaf-Signature header for payload
+func SignWebhook(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookBackoff is how long to wait before the next attempt after attempts failures
+func WebhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// SendWebhook posts a single delivery. Any non-2xx response is an error.
+func SendWebhook(poster WebhookPoster, secret string, delivery *WebhookDelivery) error {
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Autowaf-Event", delivery.EventType)
+	req.Header.Set("X-Autowaf-Delivery", strconv.Itoa(delivery.ID))
+	if secret != "" {
+		req.Header.Set("X-Autowaf-Signature", SignWebhook(secret, delivery.Payload))
+	}
+	resp, err := poster(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// DeliverWebhooks sends everything in the outbox that is due and records the outcome
+func DeliverWebhooks(db *sql.DB, poster WebhookPoster, envconf *EnvConfig) {
+	selectSQL := `SELECT id, url, event_type, payload, attempts
+		FROM webhook_outbox
+		WHERE delivered_at IS NULL
+		AND attempts < $1
+		AND next_attempt <= now()
+		ORDER BY id
+		LIMIT 100;`
+	rows, err := db.Query(selectSQL, envconf.WebhookMaxAttempts)
+	if err != nil {
+		log.Error().Str("Error", err.Error()).Msg("Error reading the webhook outbox")
+		return
+	}
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err := rows.Scan(&delivery.ID, &delivery.URL, &delivery.EventType, &delivery.Payload, &delivery.Attempts)
+		if err != nil {
+			log.Error().Str("Error", err.Error()).Msg("Error reading webhook from the outbox")
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	rows.Close()
+
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		sendErr := SendWebhook(poster, envconf.WebhookSecret, delivery)
+		if sendErr == nil {
+			_, err = db.Exec(`UPDATE webhook_outbox SET delivered_at = now(), attempts = attempts + 1 WHERE id = $1;`, delivery.ID)
+			if err != nil {
+				log.Error().Str("Error", err.Error()).Msg("Error marking webhook as delivered")
+			}
+			continue
+		}
+		attempts := delivery.Attempts + 1
+		log.Warn().Str("Error", sendErr.Error()).Str("URL", delivery.URL).Str("Event", delivery.EventType).
+			Int("Attempts", attempts).Msg("Error delivering webhook")
+		if attempts >= envconf.WebhookMaxAttempts {
+			log.Error().Str("URL", delivery.URL).Str("Event", delivery.EventType).
+				Msg("Giving up on webhook delivery")
+		}
+		retrySQL := `UPDATE webhook_outbox
+			SET attempts = $2, next_attempt = now() + ($3 || ' SECONDS')::INTERVAL, last_error = $4
+			WHERE id = $1;`
+		_, err = db.Exec(retrySQL, delivery.ID, attempts, int(WebhookBackoff(attempts).Seconds()), sendErr.Error())
+		if err != nil {
+			log.Error().Str("Error", err.Error()).Msg("Error scheduling webhook retry")
+		}
+	}
+}
+
+// deliverWebhooks is the background task that drains the webhook outbox
+func deliverWebhooks(ticker *time.Ticker, quit *chan string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for {
+		select {
+		case <-ticker.C:
+			DeliverWebhooks(db, client.Do, &envConfig)
+		case <-*quit:
+			ticker.Stop()
+			log.Debug().Msg("Exiting webhook delivery")
+			return
+		}
+	}
+}
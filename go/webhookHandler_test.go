@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	// echo -n '{"type":"ban-created"}' | openssl dgst -sha256 -hmac secret
+	expected := "sha256=a1628be83161680d1bad219c9d0b3315f8c879de81c06be33f14c817957cf1db"
+	signature := SignWebhook("secret", `{"type":"ban-created"}`)
+	if signature != expected {
+		t.Logf("Unexpected signature: %s", signature)
+		t.Fail()
+	}
+	if signature == SignWebhook("other", `{"type":"ban-created"}`) {
+		t.Log("Signatures should depend on the secret")
+		t.Fail()
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	if WebhookBackoff(1) != 30*time.Second || WebhookBackoff(2) != time.Minute || WebhookBackoff(3) != 2*time.Minute {
+		t.Log("Backoff should double from 30 seconds")
+		t.Fail()
+	}
+	if WebhookBackoff(20) != time.Hour {
+		t.Log("Backoff should be capped at an hour")
+		t.Fail()
+	}
+}
+
+func TestWebhookWantsEvent(t *testing.T) {
+	env := EnvConfig{}
+	if !webhookWantsEvent(&env, EventBanExpired) {
+		t.Log("An empty filter should accept everything")
+		t.Fail()
+	}
+	env.WebhookEvents = []string{EventBanCreated, EventIPUnblocked}
+	if !webhookWantsEvent(&env, EventIPUnblocked) || webhookWantsEvent(&env, EventBanExpired) {
+		t.Log("Filter wasn't applied")
+		t.Fail()
+	}
+}
+
+func TestSendWebhook(t *testing.T) {
+	payload := `{"type":"ban-created","ip":"192.168.1.1"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Autowaf-Signature") != SignWebhook("secret", string(body)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-Autowaf-Event") != EventBanCreated {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	delivery := WebhookDelivery{ID: 1, URL: server.URL, EventType: EventBanCreated, Payload: payload}
+	if err := SendWebhook(server.Client().Do, "secret", &delivery); err != nil {
+		t.Logf("Shouldn't have gotten an error. Err: %s", err.Error())
+		t.Fail()
+	}
+	if err := SendWebhook(server.Client().Do, "wrong", &delivery); err == nil {
+		t.Log("Nil error (shouldn't be)")
+		t.Fail()
+	}
+}